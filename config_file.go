@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// loadConfigFile sets the flags of fs from a file of "name = value" lines
+// using the flag names without the dash, a subset of TOML:
+//
+//	# comment
+//	repos-root-path = "/srv/git"
+//	port = 8080
+//	root = ["/public=/srv/public", "/private=/srv/private"]
+//
+// Strings may be quoted or bare, arrays set a repeatable flag once per
+// element. Flags given on the command line win over the file, so
+// loadConfigFile is called after fs.Parse.
+func loadConfigFile(fs *flag.FlagSet, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	explicit := make(map[string]bool)
+	fs.Visit(func(fl *flag.Flag) {
+		explicit[fl.Name] = true
+	})
+
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, raw, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("%s:%d: expected name = value", file, n)
+		}
+		key = strings.TrimSpace(key)
+
+		if fs.Lookup(key) == nil || key == "config" || key == "version" {
+			return fmt.Errorf("%s:%d: unknown setting %q, settings are named like the command line flags", file, n, key)
+		}
+		if seen[key] {
+			return fmt.Errorf("%s:%d: %q is set twice, use an array to repeat it", file, n, key)
+		}
+		seen[key] = true
+
+		values, err := parseConfigValue(strings.TrimSpace(raw))
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s: %s", file, n, key, err)
+		}
+		if explicit[key] {
+			continue
+		}
+
+		for _, v := range values {
+			if err := fs.Set(key, v); err != nil {
+				return fmt.Errorf("%s:%d: %s: invalid value %q: %s", file, n, key, v, err)
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// parseConfigValue parses a quoted or bare scalar, or a single line array
+// of them.
+func parseConfigValue(raw string) ([]string, error) {
+	if !strings.HasPrefix(raw, "[") {
+		v, err := parseConfigScalar(raw)
+		return []string{v}, err
+	}
+
+	inner, ok := strings.CutSuffix(raw, "]")
+	if !ok {
+		return nil, fmt.Errorf("unterminated array %s", raw)
+	}
+	inner = strings.TrimSpace(strings.TrimPrefix(inner, "["))
+
+	var values []string
+	for inner != "" {
+		var elem string
+		if strings.HasPrefix(inner, `"`) {
+			quoted, err := strconv.QuotedPrefix(inner)
+			if err != nil {
+				return nil, fmt.Errorf("invalid string in %s", raw)
+			}
+			elem, inner = quoted, inner[len(quoted):]
+		} else {
+			elem, inner, _ = strings.Cut(inner, ",")
+			inner = "," + inner
+		}
+
+		v, err := parseConfigScalar(strings.TrimSpace(elem))
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+
+		inner = strings.TrimSpace(inner)
+		if inner == "," {
+			break
+		}
+		if inner != "" && !strings.HasPrefix(inner, ",") {
+			return nil, fmt.Errorf("expected , between array elements in %s", raw)
+		}
+		inner = strings.TrimSpace(strings.TrimPrefix(inner, ","))
+	}
+	return values, nil
+}
+
+func parseConfigScalar(raw string) (string, error) {
+	if strings.HasPrefix(raw, `"`) {
+		v, err := strconv.Unquote(raw)
+		if err != nil {
+			return "", fmt.Errorf("invalid string %s", raw)
+		}
+		return v, nil
+	}
+
+	if raw == "" {
+		return "", fmt.Errorf("missing value")
+	}
+	// A trailing comment after a bare value.
+	if i := strings.Index(raw, " #"); i >= 0 {
+		raw = strings.TrimSpace(raw[:i])
+	}
+	return raw, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testFlags is a flag set with a setting of every kind the server has.
+type testFlags struct {
+	fs          *flag.FlagSet
+	root        string
+	roots       []string
+	port        int
+	receivePack bool
+	idle        time.Duration
+}
+
+func newTestFlags() *testFlags {
+	tf := &testFlags{fs: flag.NewFlagSet("test", flag.ContinueOnError)}
+	tf.fs.SetOutput(io.Discard)
+	tf.fs.StringVar(&tf.root, "repos-root-path", "/etc/git-http-backend", "")
+	tf.fs.Func("root", "", func(v string) error {
+		tf.roots = append(tf.roots, v)
+		return nil
+	})
+	tf.fs.IntVar(&tf.port, "port", 80, "")
+	tf.fs.BoolVar(&tf.receivePack, "git-receive-pack", true, "")
+	tf.fs.DurationVar(&tf.idle, "idle-timeout", 2*time.Minute, "")
+	tf.fs.String("config", "", "")
+	return tf
+}
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	file := writeConfigFile(t, `# settings
+repos-root-path = "/srv/git # not a comment"
+root = ["/public=/srv/public", "/private=/srv/private",]
+port = 8080 # a comment
+git-receive-pack = false
+
+idle-timeout = "5m"
+`)
+
+	for _, tc := range []struct {
+		args        []string
+		root        string
+		port        int
+		receivePack bool
+		idle        time.Duration
+	}{
+		{nil, "/srv/git # not a comment", 8080, false, 5 * time.Minute},
+		// Flags on the command line win over the file.
+		{[]string{"-port", "9090", "-git-receive-pack"}, "/srv/git # not a comment", 9090, true, 5 * time.Minute},
+		// Even when given their default value.
+		{[]string{"-repos-root-path=/etc/git-http-backend", "-idle-timeout=2m"}, "/etc/git-http-backend", 8080, false, 2 * time.Minute},
+	} {
+		tf := newTestFlags()
+		if err := tf.fs.Parse(append(tc.args, "-config", file)); err != nil {
+			t.Fatal(err)
+		}
+		if err := loadConfigFile(tf.fs, file); err != nil {
+			t.Fatalf("%v: %s", tc.args, err)
+		}
+		got := []any{tf.root, tf.port, tf.receivePack, tf.idle}
+		if want := []any{tc.root, tc.port, tc.receivePack, tc.idle}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: %v, want %v", tc.args, got, want)
+		}
+		if want := []string{"/public=/srv/public", "/private=/srv/private"}; !reflect.DeepEqual(tf.roots, want) {
+			t.Errorf("%v: roots %q, want %q", tc.args, tf.roots, want)
+		}
+	}
+
+	// A repeatable flag given on the command line replaces the array.
+	tf := newTestFlags()
+	if err := tf.fs.Parse([]string{"-root", "/only=/srv/only"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfigFile(tf.fs, file); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/only=/srv/only"}; !reflect.DeepEqual(tf.roots, want) {
+		t.Errorf("roots %q, want %q", tf.roots, want)
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	for _, tc := range []struct{ content, want string }{
+		{"prot = 8080\n", `config.toml:1: unknown setting "prot"`},
+		{"config = \"other.toml\"\n", `unknown setting "config"`},
+		{"port = 80\nport = 8080\n", `config.toml:2: "port" is set twice`},
+		{"port = eighty\n", `port: invalid value "eighty"`},
+		{"port\n", "expected name = value"},
+		{"port =\n", "missing value"},
+		{"root = [\"/a=/srv/a\"\n", "unterminated array"},
+		{"root = [\"/a=/srv/a\" \"/b=/srv/b\"]\n", "expected , between array elements"},
+		{"repos-root-path = \"/srv\n", "invalid string"},
+	} {
+		file := writeConfigFile(t, tc.content)
+		err := loadConfigFile(newTestFlags().fs, file)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%q: error %v, want %q", tc.content, err, tc.want)
+		}
+	}
+
+	if err := loadConfigFile(newTestFlags().fs, filepath.Join(t.TempDir(), "missing.toml")); !os.IsNotExist(err) {
+		t.Errorf("missing file: %v", err)
+	}
+}
@@ -0,0 +1,74 @@
+package githttp
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clfTimeFormat is the timestamp layout of the Common Log Format.
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// isAccessLogFormat reports whether format is one of the supported
+// AccessLogFormat values, empty for the default structured log line.
+func isAccessLogFormat(format string) bool {
+	return format == "" || format == "common" || format == "combined"
+}
+
+// writeAccessLog writes the Common Log Format line, or for "combined" the
+// Combined Log Format line, of the request to AccessLog:
+//
+//	127.0.0.1 - alice [16/Oct/2026:10:00:00 +0000] "GET /r.git/info/refs HTTP/1.1" 200 512
+func (gsh GitSmartHTTP) writeAccessLog(rw *responseWriter, r *http.Request, start time.Time) {
+	// Only a user the credentials were checked for, a client can send any
+	// name.
+	user := orDash(verifiedUser(r))
+	size := "-"
+	if rw.bytes > 0 {
+		size = strconv.FormatInt(rw.bytes, 10)
+	}
+
+	line := fmt.Sprintf("%s - %s [%s] %s %d %s",
+		gsh.clientIP(r),
+		clfEscape(user),
+		start.Format(clfTimeFormat),
+		clfQuote(r.Method+" "+gsh.redactURL(r.URL)+" "+r.Proto),
+		rw.status,
+		size,
+	)
+	if gsh.AccessLogFormat == "combined" {
+		line += " " + clfQuote(orDash(r.Referer())) + " " + clfQuote(orDash(r.UserAgent()))
+	}
+	fmt.Fprintln(gsh.AccessLog, line)
+}
+
+// clfQuote quotes s as a log field, escaping quotes and control
+// characters so a client can't forge lines.
+func clfQuote(s string) string {
+	return `"` + clfEscape(s) + `"`
+}
+
+func clfEscape(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
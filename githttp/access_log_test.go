@@ -0,0 +1,106 @@
+package githttp
+
+import (
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// combinedLogFormat matches a Combined Log Format line; the referer and
+// user agent are optional for the Common Log Format.
+var combinedLogFormat = regexp.MustCompile(`^(\S+) (\S+) (\S+) \[([^\]]+)\] "((?:[^"\\]|\\.)*)" (\d{3}) (\d+|-)(?: "((?:[^"\\]|\\.)*)" "((?:[^"\\]|\\.)*)")?\n$`)
+
+func TestAccessLogFormat(t *testing.T) {
+	root := t.TempDir()
+	runGit(t, "", "init", "-q", "--bare", filepath.Join(root, "repo.git"))
+
+	for _, format := range []string{"common", "combined"} {
+		log := &syncBuffer{}
+		h, err := New(Config{
+			ReposRootPath:   root,
+			UploadPack:      true,
+			AccessLogFormat: format,
+			AccessLog:       log,
+			Logger:          slog.New(slog.NewTextHandler(io.Discard, nil)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, tc := range []struct{ path, status string }{
+			{"/repo.git/HEAD", "200"},
+			{"/missing.git/HEAD", "404"},
+		} {
+			before := len(log.String())
+			req := httptest.NewRequest("GET", tc.path, nil)
+			req.Header.Set("Referer", "https://example.com/")
+			req.Header.Set("User-Agent", `git/2.39 "quoted"`)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			line := log.String()[before:]
+			m := combinedLogFormat.FindStringSubmatch(line)
+			if m == nil {
+				t.Errorf("%s, %s: %q isn't a log format line", format, tc.path, line)
+				continue
+			}
+			if _, err := time.Parse(clfTimeFormat, m[4]); err != nil {
+				t.Errorf("%s, %s: timestamp: %s", format, tc.path, err)
+			}
+			if m[5] != "GET "+tc.path+" HTTP/1.1" || m[6] != tc.status {
+				t.Errorf("%s, %s: request %q, status %s", format, tc.path, m[5], m[6])
+			}
+			if m[7] != strconv.Itoa(rec.Body.Len()) {
+				t.Errorf("%s, %s: size %s, body of %d bytes", format, tc.path, m[7], rec.Body.Len())
+			}
+			wantExtra := []string{"", ""}
+			if format == "combined" {
+				wantExtra = []string{"https://example.com/", `git/2.39 \"quoted\"`}
+			}
+			if m[8] != wantExtra[0] || m[9] != wantExtra[1] {
+				t.Errorf("%s, %s: referer %q, user agent %q", format, tc.path, m[8], m[9])
+			}
+		}
+	}
+}
+
+func TestAccessLogUser(t *testing.T) {
+	log := &syncBuffer{}
+	h, err := New(Config{
+		ReposRootPath:   t.TempDir(),
+		UploadPack:      true,
+		Authenticator:   StaticAuthenticator{"alice": hashPassword("secret", []byte("salt"), 10)},
+		AccessLogFormat: "common",
+		AccessLog:       log,
+		Logger:          slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		user, pass string
+		want       string
+	}{
+		{"", "", " - - "},
+		{"mallory", "secret", " - - "},
+		{"alice", "wrong", " - - "},
+		{"alice", "secret", " - alice "},
+	} {
+		before := len(log.String())
+		req := httptest.NewRequest("GET", "/repo.git/info/refs?service=git-upload-pack", nil)
+		if tc.user != "" {
+			req.SetBasicAuth(tc.user, tc.pass)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		if line := log.String()[before:]; !strings.Contains(line, tc.want) {
+			t.Errorf("%s:%s logged %q, want %q", tc.user, tc.pass, line, tc.want)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package githttp
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxAlternateDepth is how many alternates deep objects are looked for,
+// the limit git itself applies.
+const maxAlternateDepth = 5
+
+// isObjectService reports whether s serves a file below objects/ that may
+// live in an alternate object directory instead.
+func isObjectService(s Service) bool {
+	switch s.Name {
+	case "loose-object", "pack-file", "idx-file":
+		return true
+	}
+	return false
+}
+
+// locateObjectFile returns fullPath, the requested file below the objects
+// directory of repoPath, or when it doesn't exist the same file in one of
+// the repository's alternates, e.g. the shared object pool of a fork.
+// Alternates outside of the roots are ignored.
+func (gsh GitSmartHTTP) locateObjectFile(repoPath, fullPath string) string {
+	if _, err := os.Stat(fullPath); err == nil {
+		return fullPath
+	}
+
+	objectsDir := filepath.Join(repoPath, "objects")
+	rel, err := filepath.Rel(objectsDir, fullPath)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return fullPath
+	}
+
+	if p, ok := gsh.findInAlternates(objectsDir, rel, maxAlternateDepth); ok {
+		return p
+	}
+	return fullPath
+}
+
+func (gsh GitSmartHTTP) findInAlternates(objectsDir, rel string, depth int) (string, bool) {
+	if depth == 0 {
+		return "", false
+	}
+
+	for _, alt := range readAlternates(objectsDir) {
+		if !gsh.withinRoots(alt) {
+			continue
+		}
+
+		p := filepath.Join(alt, rel)
+		if fi, err := os.Stat(p); err == nil && fi.Mode().IsRegular() {
+			return p, true
+		}
+		if p, ok := gsh.findInAlternates(alt, rel, depth-1); ok {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// readAlternates returns the object directories listed in
+// objects/info/alternates, relative ones resolved against objectsDir.
+func readAlternates(objectsDir string) []string {
+	f, err := os.Open(filepath.Join(objectsDir, "info", "alternates"))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var alts []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !filepath.IsAbs(line) {
+			line = filepath.Join(objectsDir, line)
+		}
+		alts = append(alts, filepath.Clean(line))
+	}
+	return alts
+}
+
+// withinRoots reports whether dir, symlinks resolved, is below one of the
+// roots.
+func (gsh GitSmartHTTP) withinRoots(dir string) bool {
+	real, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return false
+	}
+
+	for _, root := range gsh.roots() {
+		if isBelow(root.Path, real) {
+			return true
+		}
+	}
+	return false
+}
+
+// alternatePacks returns the names of the packs in the alternates of
+// repoPath that are inside the roots.
+func (gsh GitSmartHTTP) alternatePacks(repoPath string) []string {
+	var packs []string
+	seen := make(map[string]bool)
+
+	var walk func(objectsDir string, depth int)
+	walk = func(objectsDir string, depth int) {
+		if depth == 0 {
+			return
+		}
+		for _, alt := range readAlternates(objectsDir) {
+			if seen[alt] || !gsh.withinRoots(alt) {
+				continue
+			}
+			seen[alt] = true
+
+			names, _ := filepath.Glob(filepath.Join(alt, "pack", "pack-*.pack"))
+			for _, name := range names {
+				packs = append(packs, filepath.Base(name))
+			}
+			walk(alt, depth-1)
+		}
+	}
+	walk(filepath.Join(repoPath, "objects"), maxAlternateDepth)
+	return packs
+}
+
+// mergePackLists adds the packs not listed yet to the objects/info/packs
+// content local.
+func mergePackLists(local []byte, packs []string) []byte {
+	var buf bytes.Buffer
+	listed := make(map[string]bool)
+	for _, line := range strings.Split(string(local), "\n") {
+		if name, ok := strings.CutPrefix(line, "P "); ok {
+			listed[name] = true
+		}
+		if line != "" {
+			buf.WriteString(line + "\n")
+		}
+	}
+	for _, name := range packs {
+		if !listed[name] {
+			listed[name] = true
+			buf.WriteString("P " + name + "\n")
+		}
+	}
+	buf.WriteString("\n")
+	return buf.Bytes()
+}
@@ -0,0 +1,332 @@
+package githttp
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Authenticator validates the username and password sent with a request.
+type Authenticator interface {
+	Authenticate(user, pass string) bool
+}
+
+// Password hashes in auth files are "pbkdf2-sha256$<iterations>$<salt>$<key>",
+// salt and key base64 encoded without padding.
+const (
+	passwordHashScheme     = "pbkdf2-sha256"
+	passwordHashIterations = 600000
+	passwordSaltSize       = 16
+)
+
+// dummyPasswordHash is checked for unknown users, so they take as long to
+// refuse as known ones and timing doesn't tell which users exist.
+var dummyPasswordHash = fmt.Sprintf("%s$%d$%s$%s", passwordHashScheme, passwordHashIterations,
+	base64.RawStdEncoding.EncodeToString(make([]byte, passwordSaltSize)),
+	base64.RawStdEncoding.EncodeToString(make([]byte, sha256.Size)))
+
+// StaticAuthenticator maps usernames to the salted hash of their password,
+// see HashPassword.
+type StaticAuthenticator map[string]string
+
+// Authenticate implements Authenticator.
+func (sa StaticAuthenticator) Authenticate(user, pass string) bool {
+	want, ok := sa[user]
+	if !ok {
+		want = dummyPasswordHash
+	}
+
+	iter, salt, key, err := parsePasswordHash(want)
+	if err != nil {
+		return false
+	}
+	got, err := pbkdf2.Key(sha256.New, pass, salt, iter, len(key))
+	return err == nil && subtle.ConstantTimeCompare(got, key) == 1 && ok
+}
+
+// HashPassword returns the salted hash of pass StaticAuthenticator expects.
+func HashPassword(pass string) (string, error) {
+	salt := make([]byte, passwordSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	return hashPassword(pass, salt, passwordHashIterations), nil
+}
+
+func hashPassword(pass string, salt []byte, iter int) string {
+	// pbkdf2.Key only fails for keys longer than SHA-256 can derive.
+	key, _ := pbkdf2.Key(sha256.New, pass, salt, iter, sha256.Size)
+	enc := base64.RawStdEncoding
+	return fmt.Sprintf("%s$%d$%s$%s", passwordHashScheme, iter, enc.EncodeToString(salt), enc.EncodeToString(key))
+}
+
+// parsePasswordHash splits a hash made by HashPassword.
+func parsePasswordHash(hash string) (iter int, salt, key []byte, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != passwordHashScheme {
+		return 0, nil, nil, fmt.Errorf("expected %s$iterations$salt$key", passwordHashScheme)
+	}
+	if iter, err = strconv.Atoi(parts[1]); err != nil || iter < 1 {
+		return 0, nil, nil, fmt.Errorf("invalid iteration count %q", parts[1])
+	}
+	enc := base64.RawStdEncoding
+	if salt, err = enc.DecodeString(parts[2]); err != nil || len(salt) == 0 {
+		return 0, nil, nil, errors.New("invalid salt")
+	}
+	if key, err = enc.DecodeString(parts[3]); err != nil || len(key) == 0 {
+		return 0, nil, nil, errors.New("invalid key")
+	}
+	return iter, salt, key, nil
+}
+
+// LoadStaticAuthenticator reads a file of "user:hash" lines, hashes made by
+// HashPassword. Blank lines and lines starting with # are ignored.
+func LoadStaticAuthenticator(file string) (StaticAuthenticator, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sa := make(StaticAuthenticator)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("%s:%d: expected user:hash", file, n)
+		}
+		if _, _, _, err := parsePasswordHash(hash); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", file, n, err)
+		}
+		sa[user] = hash
+	}
+	return sa, scanner.Err()
+}
+
+// authCache remembers credentials the Authenticator accepted for ttl, so
+// the password isn't hashed again for every request of a clone. Only a MAC
+// of the credentials under a random key is kept.
+type authCache struct {
+	mu      sync.Mutex
+	key     []byte
+	ttl     time.Duration
+	expires map[string]time.Time
+	sweepAt int
+}
+
+func newAuthCache(ttl time.Duration) (*authCache, error) {
+	key := make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return &authCache{key: key, ttl: ttl, expires: make(map[string]time.Time), sweepAt: 1024}, nil
+}
+
+func (c *authCache) mac(user, pass string) string {
+	m := hmac.New(sha256.New, c.key)
+	m.Write([]byte(user))
+	m.Write([]byte{0})
+	m.Write([]byte(pass))
+	return string(m.Sum(nil))
+}
+
+// valid reports whether user and pass were accepted less than ttl ago.
+func (c *authCache) valid(user, pass string) bool {
+	mac := c.mac(user, pass)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Now().Before(c.expires[mac])
+}
+
+// add records that user and pass were accepted.
+func (c *authCache) add(user, pass string) {
+	mac := c.mac(user, pass)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if len(c.expires) >= c.sweepAt {
+		for k, t := range c.expires {
+			if !now.Before(t) {
+				delete(c.expires, k)
+			}
+		}
+		c.sweepAt = max(1024, 2*len(c.expires))
+	}
+	c.expires[mac] = now.Add(c.ttl)
+}
+
+// checkCredentials asks the Authenticator about user and pass, unless it
+// accepted them a moment ago.
+func (gsh GitSmartHTTP) checkCredentials(user, pass string) bool {
+	if gsh.authCache != nil && gsh.authCache.valid(user, pass) {
+		return true
+	}
+	if !gsh.Authenticator.Authenticate(user, pass) {
+		return false
+	}
+	if gsh.authCache != nil {
+		gsh.authCache.add(user, pass)
+	}
+	return true
+}
+
+// isWrite reports whether the request pushes to a repository.
+func isWrite(s Service, r *http.Request) bool {
+	return s.Name == "receive-pack" || s.Name == "lfs-upload" ||
+		(s.Name == "info-refs" && r.FormValue("service") == receivePack)
+}
+
+// authenticate checks the request credentials. It only looks at headers so
+// a rejected push is turned away before its body is read.
+func (gsh GitSmartHTTP) authenticate(s Service, r *http.Request) bool {
+	if gsh.Authenticator == nil {
+		return true
+	}
+
+	// Credentials we cannot check are refused rather than ignored, the
+	// client would otherwise silently act as anonymous.
+	if !supportedAuthScheme(r) {
+		return false
+	}
+
+	if gsh.AnonymousRead && !isWrite(s, r) {
+		return true
+	}
+
+	return gsh.authenticatedUser(r) != ""
+}
+
+func (gsh GitSmartHTTP) challenge(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", gsh.AuthRealm))
+	w.WriteHeader(http.StatusUnauthorized)
+
+	if !supportedAuthScheme(r) {
+		scheme := authScheme(r)
+		requestLog(r).Info("Unsupported authorization scheme", "scheme", scheme)
+		fmt.Fprintf(w, "Authorization scheme %q is not supported, use Basic\n", scheme)
+		return
+	}
+	fmt.Fprintln(w, "Authentication required")
+}
+
+// authScheme returns the scheme of the Authorization header of r, or the
+// empty string when there is none.
+func authScheme(r *http.Request) string {
+	scheme, _, _ := strings.Cut(strings.TrimSpace(r.Header.Get("Authorization")), " ")
+	return scheme
+}
+
+// supportedAuthScheme reports whether r has no Authorization header or
+// one using the Basic scheme, the only one Authenticator handles.
+func supportedAuthScheme(r *http.Request) bool {
+	scheme := authScheme(r)
+	return scheme == "" || strings.EqualFold(scheme, "Basic")
+}
+
+// pusherEnv returns the environment identifying the pushing user to
+// receive-pack hooks, as git http-backend does. REMOTE_USER is empty for
+// anonymous pushes, which keep git's default committer.
+func (gsh GitSmartHTTP) pusherEnv(r *http.Request) []string {
+	user := gsh.authenticatedUser(r)
+	env := []string{"REMOTE_USER=" + user, "REMOTE_ADDR=" + gsh.clientIP(r)}
+	if user == "" {
+		return env
+	}
+
+	domain := gsh.CommitterEmailDomain
+	if domain == "" {
+		domain = "http." + gsh.clientIP(r)
+	}
+	return append(env,
+		"GIT_COMMITTER_NAME="+user,
+		"GIT_COMMITTER_EMAIL="+user+"@"+domain,
+	)
+}
+
+// AuthorizeFunc decides whether user may run serviceType, git-upload-pack
+// or git-receive-pack, on the repository at repoPath. repoPath is relative
+// to the repositories root and slash separated. user is empty for
+// anonymous requests.
+type AuthorizeFunc func(user, repoPath, serviceType string) bool
+
+// authorize runs AuthorizeFunc for the repository at fullPath, answering
+// 403 when it denies the request.
+func (gsh GitSmartHTTP) authorize(w http.ResponseWriter, r *http.Request, fullPath, serviceType string) bool {
+	if gsh.Authorize == nil {
+		return true
+	}
+
+	repoPath := gsh.repoName(fullPath)
+	user := gsh.authenticatedUser(r)
+	if gsh.Authorize(user, repoPath, serviceType) {
+		return true
+	}
+
+	requestLog(r).Info("Access denied", "service", serviceType, "repo", repoPath, "user", user)
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusForbidden)
+	return false
+}
+
+// authKey is the context key of the *authResult of a request.
+type authKey struct{}
+
+// authResult records who a request authenticated as, the Authenticator is
+// asked once per request.
+type authResult struct {
+	checked bool
+	user    string
+}
+
+// withAuthResult returns r with room to record who it authenticated as.
+func withAuthResult(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), authKey{}, &authResult{}))
+}
+
+// authenticatedUser returns the user whose credentials came with r, or the
+// empty string when there are none or they are wrong, as may happen with
+// AnonymousRead.
+func (gsh GitSmartHTTP) authenticatedUser(r *http.Request) string {
+	res, _ := r.Context().Value(authKey{}).(*authResult)
+	if res != nil && res.checked {
+		return res.user
+	}
+
+	user, pass, ok := r.BasicAuth()
+	if !ok || gsh.Authenticator == nil || !gsh.checkCredentials(user, pass) {
+		user = ""
+	}
+	if res != nil {
+		res.checked, res.user = true, user
+	}
+	return user
+}
+
+// verifiedUser returns the user r authenticated as so far, without
+// checking credentials that weren't checked yet.
+func verifiedUser(r *http.Request) string {
+	if res, ok := r.Context().Value(authKey{}).(*authResult); ok {
+		return res.user
+	}
+	return ""
+}
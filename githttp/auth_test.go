@@ -0,0 +1,135 @@
+package githttp
+
+import (
+	"encoding/hex"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHashPassword(t *testing.T) {
+	// The PBKDF2-HMAC-SHA256 variant of RFC 6070.
+	hash := hashPassword("password", []byte("salt"), 4096)
+	_, _, key, err := parsePasswordHash(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := hex.EncodeToString(key), "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"; got != want {
+		t.Errorf("key %s, want %s", got, want)
+	}
+
+	// Unknown users are checked against a hash as costly as a real one.
+	iter, _, _, err := parsePasswordHash(dummyPasswordHash)
+	if err != nil || iter != passwordHashIterations {
+		t.Errorf("dummy hash %s: %d iterations, %v", dummyPasswordHash, iter, err)
+	}
+}
+
+func TestStaticAuthenticator(t *testing.T) {
+	hash := hashPassword("secret", []byte("0123456789abcdef"), 1000)
+	sa := StaticAuthenticator{"alice": hash}
+
+	if !sa.Authenticate("alice", "secret") {
+		t.Error("right password refused")
+	}
+	if sa.Authenticate("alice", "Secret") || sa.Authenticate("bob", "secret") {
+		t.Error("wrong credentials accepted")
+	}
+
+	// Salted: the same password hashes differently every time.
+	h1, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, _ := HashPassword("secret")
+	if h1 == h2 || !strings.HasPrefix(h1, passwordHashScheme+"$") {
+		t.Errorf("HashPassword = %q and %q", h1, h2)
+	}
+	if !(StaticAuthenticator{"alice": h1}).Authenticate("alice", "secret") {
+		t.Error("HashPassword result refused")
+	}
+}
+
+func TestLoadStaticAuthenticator(t *testing.T) {
+	hash := hashPassword("secret", []byte("salt"), 10)
+	for name, tc := range map[string]struct {
+		content string
+		ok      bool
+	}{
+		"valid":        {"# users\n\nalice:" + hash + "\n", true},
+		"no hash":      {"alice\n", false},
+		"no user":      {":" + hash + "\n", false},
+		"bad scheme":   {"alice:md5$10$c2FsdA$a2V5\n", false},
+		"bad iter":     {"alice:pbkdf2-sha256$0$c2FsdA$a2V5\n", false},
+		"bad salt":     {"alice:pbkdf2-sha256$10$!!$a2V5\n", false},
+		"missing part": {"alice:pbkdf2-sha256$10$c2FsdA\n", false},
+	} {
+		file := filepath.Join(t.TempDir(), "users")
+		if err := os.WriteFile(file, []byte(tc.content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		sa, err := LoadStaticAuthenticator(file)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: err = %v", name, err)
+			continue
+		}
+		if tc.ok && !sa.Authenticate("alice", "secret") {
+			t.Errorf("%s: password refused", name)
+		}
+	}
+}
+
+// countingAuthenticator accepts alice:secret and counts the calls.
+type countingAuthenticator struct{ calls atomic.Int64 }
+
+func (a *countingAuthenticator) Authenticate(user, pass string) bool {
+	a.calls.Add(1)
+	return user == "alice" && pass == "secret"
+}
+
+func TestAuthCache(t *testing.T) {
+	auth := &countingAuthenticator{}
+	gsh, err := NewGitSmartHTTP(&GitSmartHTTPConfig{
+		ReposRootPath: t.TempDir(),
+		Authenticator: auth,
+		AuthCacheTTL:  200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(user, pass string) bool {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.SetBasicAuth(user, pass)
+		return gsh.authenticatedUser(r) == user
+	}
+
+	for range 3 {
+		if !check("alice", "secret") {
+			t.Fatal("right password refused")
+		}
+	}
+	if n := auth.calls.Load(); n != 1 {
+		t.Errorf("Authenticate called %d times for the same credentials, want 1", n)
+	}
+
+	// Refused credentials are never remembered.
+	for range 2 {
+		if check("alice", "wrong") {
+			t.Error("wrong password accepted")
+		}
+	}
+	if n := auth.calls.Load(); n != 3 {
+		t.Errorf("Authenticate called %d times, want 3", n)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	check("alice", "secret")
+	if n := auth.calls.Load(); n != 4 {
+		t.Errorf("expired credentials not checked again, %d calls", n)
+	}
+}
@@ -0,0 +1,51 @@
+package githttp
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// stripBasePath returns a copy of r with BasePath cut from the front of its
+// URL path, the way http.StripPrefix does. Requests outside of BasePath are
+// answered with 404.
+func (gsh GitSmartHTTP) stripBasePath(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	base := strings.TrimSuffix(gsh.BasePath, "/")
+	if base == "" {
+		return r, true
+	}
+
+	p, ok := cutBasePath(r.URL.Path, base)
+	rp, rawOK := cutBasePath(r.URL.RawPath, base)
+	if !ok || (r.URL.RawPath != "" && !rawOK) {
+		w.Header().Set("Content-Type", "text/plain")
+		http.NotFound(w, r)
+		return nil, false
+	}
+
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+	r2.URL.Path = p
+	if r.URL.RawPath != "" {
+		r2.URL.RawPath = rp
+	}
+	return r2, true
+}
+
+// cutBasePath returns p without base, "/" for base itself. Paths merely
+// starting with the same characters, e.g. /gitlab for /git, aren't below
+// base.
+func cutBasePath(p, base string) (string, bool) {
+	rest, ok := strings.CutPrefix(p, base)
+	switch {
+	case !ok:
+		return "", false
+	case rest == "":
+		return "/", true
+	case !strings.HasPrefix(rest, "/"):
+		return "", false
+	}
+	return rest, true
+}
@@ -0,0 +1,20 @@
+package githttp
+
+// CgroupConfig places every git process in a cgroup v2 of its own, below
+// Parent, so the kernel enforces its limits. Linux only.
+type CgroupConfig struct {
+	// Parent is a cgroup v2 directory delegated to the server, e.g.
+	// /sys/fs/cgroup/git-http-backend. Empty disables cgroups.
+	Parent string
+	// CPUMax is written to cpu.max, e.g. "50000 100000" for half a CPU.
+	// Empty leaves the CPU unlimited.
+	CPUMax string
+	// MemoryMax is written to memory.max, in bytes. Zero leaves the memory
+	// unlimited.
+	MemoryMax int64
+}
+
+// Enabled reports whether git processes are placed in cgroups.
+func (cc CgroupConfig) Enabled() bool {
+	return cc.Parent != ""
+}
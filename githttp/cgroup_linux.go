@@ -0,0 +1,95 @@
+//go:build linux
+
+package githttp
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+var cgroupSeq atomic.Int64
+
+// cgroup is the cgroup a single git process runs in.
+type cgroup struct {
+	path string
+	fd   int
+}
+
+// PrepareCgroupParent checks that cc.Parent is a cgroup v2 directory and
+// enables the controllers the limits need for its children.
+func PrepareCgroupParent(cc CgroupConfig) error {
+	if _, err := os.Stat(filepath.Join(cc.Parent, "cgroup.controllers")); err != nil {
+		return fmt.Errorf("%s is not a cgroup v2 directory: %s", cc.Parent, err)
+	}
+
+	var controllers []string
+	if cc.CPUMax != "" {
+		controllers = append(controllers, "+cpu")
+	}
+	if cc.MemoryMax > 0 {
+		controllers = append(controllers, "+memory")
+	}
+	if len(controllers) == 0 {
+		return nil
+	}
+
+	return os.WriteFile(filepath.Join(cc.Parent, "cgroup.subtree_control"), []byte(strings.Join(controllers, " ")), 0)
+}
+
+// newCgroup creates a uniquely named cgroup below cc.Parent with the
+// configured limits.
+func newCgroup(cc CgroupConfig) (*cgroup, error) {
+	dir := filepath.Join(cc.Parent, fmt.Sprintf("git-%d-%d", os.Getpid(), cgroupSeq.Add(1)))
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return nil, err
+	}
+	cg := &cgroup{path: dir, fd: -1}
+
+	limits := map[string]string{}
+	if cc.CPUMax != "" {
+		limits["cpu.max"] = cc.CPUMax
+	}
+	if cc.MemoryMax > 0 {
+		limits["memory.max"] = strconv.FormatInt(cc.MemoryMax, 10)
+	}
+	for file, value := range limits {
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(value), 0); err != nil {
+			cg.remove()
+			return nil, err
+		}
+	}
+
+	fd, err := syscall.Open(dir, syscall.O_DIRECTORY|syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		cg.remove()
+		return nil, err
+	}
+	cg.fd = fd
+	return cg, nil
+}
+
+// apply makes cmd start directly inside the cgroup, so no part of it runs
+// unconstrained.
+func (cg *cgroup) apply(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = cg.fd
+}
+
+// remove deletes the cgroup, which only succeeds once every process in it
+// has exited.
+func (cg *cgroup) remove() error {
+	if cg.fd >= 0 {
+		syscall.Close(cg.fd)
+		cg.fd = -1
+	}
+	return os.Remove(cg.path)
+}
@@ -0,0 +1,91 @@
+package githttp
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// cgroup2Mount returns where the cgroup v2 hierarchy is mounted, empty
+// when it isn't.
+func cgroup2Mount() string {
+	f, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if fields := strings.Fields(sc.Text()); len(fields) > 2 && fields[2] == "cgroup2" {
+			return fields[1]
+		}
+	}
+	return ""
+}
+
+// TestCgroup runs a stand-in for git that reports the cgroup it runs in,
+// and its memory limit when the memory controller is available.
+func TestCgroup(t *testing.T) {
+	mount := cgroup2Mount()
+	if mount == "" {
+		t.Skip("no cgroup v2 hierarchy")
+	}
+	parent, err := os.MkdirTemp(mount, "git-http-backend-test-")
+	if err != nil {
+		t.Skipf("cannot create a cgroup: %s", err)
+	}
+	t.Cleanup(func() { os.Remove(parent) })
+
+	cc := CgroupConfig{Parent: parent}
+	controllers, _ := os.ReadFile(filepath.Join(parent, "cgroup.controllers"))
+	memory := slices.Contains(strings.Fields(string(controllers)), "memory")
+	if memory {
+		cc.MemoryMax = 64 << 20
+	}
+	if err := PrepareCgroupParent(cc); err != nil {
+		t.Fatal(err)
+	}
+
+	wrapper := filepath.Join(t.TempDir(), "git")
+	script := "#!/bin/sh\ncg=$(sed -n 's/^0:://p' /proc/$$/cgroup)\necho \"$CGROUP_MOUNT$cg\"\n" +
+		"if [ -f \"$CGROUP_MOUNT$cg/memory.max\" ]; then cat \"$CGROUP_MOUNT$cg/memory.max\"; fi\n"
+	if err := os.WriteFile(wrapper, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	gs := NewGitRPCClient(&GitRPCClientConfig{
+		GitBinary: wrapper,
+		Env:       []string{"CGROUP_MOUNT=" + mount},
+		Cgroup:    cc,
+	})
+	gs.Version(context.Background())
+	out, err := gs.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if dir := lines[0]; filepath.Dir(dir) != parent || !strings.HasPrefix(filepath.Base(dir), fmt.Sprintf("git-%d-", os.Getpid())) {
+		t.Errorf("git ran in %s, want a cgroup of its own below %s", dir, parent)
+	}
+	if memory && (len(lines) < 2 || lines[1] != fmt.Sprint(cc.MemoryMax)) {
+		t.Errorf("memory.max %q, want %d", lines[1:], cc.MemoryMax)
+	}
+
+	// The cgroup is removed once git exited.
+	entries, err := os.ReadDir(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			t.Errorf("cgroup %s left behind", e.Name())
+		}
+	}
+}
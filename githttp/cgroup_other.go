@@ -0,0 +1,26 @@
+//go:build !linux
+
+package githttp
+
+import (
+	"errors"
+	"os/exec"
+)
+
+var errCgroupsUnsupported = errors.New("cgroups are only supported on Linux")
+
+type cgroup struct{}
+
+func PrepareCgroupParent(cc CgroupConfig) error {
+	return errCgroupsUnsupported
+}
+
+func newCgroup(cc CgroupConfig) (*cgroup, error) {
+	return nil, errCgroupsUnsupported
+}
+
+func (cg *cgroup) apply(cmd *exec.Cmd) {}
+
+func (cg *cgroup) remove() error {
+	return nil
+}
@@ -0,0 +1,130 @@
+package githttp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// checkTimeout bounds how long -check waits for git to answer.
+const checkTimeout = 10 * time.Second
+
+// checker collects the results of -check.
+type checker struct {
+	w      io.Writer
+	failed bool
+}
+
+func (c *checker) ok(format string, args ...any) {
+	fmt.Fprintf(c.w, "ok    "+format+"\n", args...)
+}
+
+func (c *checker) fail(format string, args ...any) {
+	c.failed = true
+	fmt.Fprintf(c.w, "FAIL  "+format+"\n", args...)
+}
+
+// RunChecks validates the configuration without serving: git runs, the
+// roots and the repositories in them are usable, the TLS key pair and the
+// auth file load. It writes a report to w and returns the exit status, 1
+// if anything failed.
+func RunChecks(w io.Writer, cfg *GitSmartHTTPConfig, authFile string) int {
+	c := &checker{w: w}
+	gsh, err := NewGitSmartHTTP(cfg)
+	if err != nil {
+		c.fail("%s", err)
+		return 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+	gs := gsh.newGitRPCClient(false)
+	gs.Version(ctx)
+	if out, err := gs.Output(); err != nil {
+		c.fail("git %q: %s", cfg.GitBinary, strings.TrimSpace(fmt.Sprint(err, " ", exitStderr(err))))
+	} else {
+		c.ok("git: %s", strings.TrimSpace(string(out)))
+	}
+
+	for _, root := range gsh.roots() {
+		c.checkRoot(root)
+	}
+
+	switch {
+	case (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == ""):
+		c.fail("tls: both -tls-cert and -tls-key are required")
+	case cfg.TLSCertFile != "" && cfg.UnixSocket != "":
+		c.fail("tls: -unix-socket can't be combined with TLS")
+	case cfg.TLSCertFile != "":
+		if _, err := gsh.TLSConfig(); err != nil {
+			c.fail("tls: %s", err)
+		} else {
+			c.ok("tls: %s", cfg.TLSCertFile)
+		}
+	}
+
+	if authFile != "" {
+		if auth, err := LoadStaticAuthenticator(authFile); err != nil {
+			c.fail("auth file %s: %s", authFile, err)
+		} else {
+			c.ok("auth file %s: %d users", authFile, len(auth))
+		}
+	}
+
+	if c.failed {
+		return 1
+	}
+	return 0
+}
+
+// checkRoot checks that root is a readable directory and reports the
+// repositories below it. Directories named like a bare repository that
+// aren't one are failures, they would answer 404.
+func (c *checker) checkRoot(root RepoRoot) {
+	fi, err := os.Stat(root.Path)
+	if err != nil {
+		c.fail("root %s: %s", root.Path, err)
+		return
+	}
+	if !fi.IsDir() {
+		c.fail("root %s: not a directory", root.Path)
+		return
+	}
+
+	repos := 0
+	err = filepath.WalkDir(root.Path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == root.Path {
+				return err
+			}
+			c.fail("directory %s: %s", p, err)
+			return fs.SkipDir
+		}
+		if !d.IsDir() || p == root.Path {
+			return nil
+		}
+
+		name := d.Name()
+		switch {
+		case strings.HasPrefix(name, "."):
+			return fs.SkipDir
+		case isGitRepo(p):
+			repos++
+			return fs.SkipDir
+		case strings.HasSuffix(name, ".git"):
+			c.fail("repository %s: not a git repository", p)
+			return fs.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		c.fail("root %s: %s", root.Path, err)
+		return
+	}
+	c.ok("root %s (%s): %d repositories", root.Path, root.Prefix, repos)
+}
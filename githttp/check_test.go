@@ -0,0 +1,54 @@
+package githttp
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunChecks(t *testing.T) {
+	gitBinary := gitEnv(t)
+	root := t.TempDir()
+	runGit(t, "", "init", "-q", "--bare", filepath.Join(root, "a.git"))
+	runGit(t, "", "init", "-q", "--bare", filepath.Join(root, "team", "b.git"))
+	authFile := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(authFile, []byte("# users\nalice:"+hashPassword("secret", []byte("salt"), 10)+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(cfg Config, authFile string) (int, string) {
+		t.Helper()
+		cfg.GitBinary = gitBinary
+		cfg.UploadPack = true
+		cfg.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+		var out strings.Builder
+		return RunChecks(&out, &cfg, authFile), out.String()
+	}
+
+	status, out := check(Config{ReposRootPath: root}, authFile)
+	if status != 0 || strings.Contains(out, "FAIL") {
+		t.Errorf("good config: status %d\n%s", status, out)
+	}
+	for _, want := range []string{"ok    git: git version", "2 repositories", "auth file " + authFile + ": 1 users"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("good config: %q not reported\n%s", want, out)
+		}
+	}
+
+	missing := filepath.Join(t.TempDir(), "missing")
+	status, out = check(Config{ReposRootPath: missing}, "")
+	if status != 1 || !strings.Contains(out, "FAIL  root "+missing) {
+		t.Errorf("missing root: status %d\n%s", status, out)
+	}
+
+	if err := os.Mkdir(filepath.Join(root, "broken.git"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	status, out = check(Config{ReposRootPath: root}, filepath.Join(root, "no-users"))
+	if status != 1 || !strings.Contains(out, "FAIL  repository "+filepath.Join(root, "broken.git")) || !strings.Contains(out, "FAIL  auth file") {
+		t.Errorf("broken repository and missing auth file: status %d\n%s", status, out)
+	}
+}
@@ -0,0 +1,161 @@
+package githttp
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// compressible reports whether responses of s are worth compressing. Pack
+// and idx files are compressed already, and so are loose objects, which
+// git stores deflated. The results of upload-pack and receive-pack carry
+// pack data, and side-band progress that must not wait in a compressor's
+// buffer. LFS objects are mostly binaries that don't shrink.
+func compressible(s Service) bool {
+	switch s.Name {
+	case "pack-file", "idx-file", "loose-object", "upload-pack", "receive-pack", "lfs-download":
+		return false
+	}
+	return true
+}
+
+// acceptsGzip reports whether the client sent gzip in Accept-Encoding
+// without refusing it with q=0.
+func acceptsGzip(r *http.Request) bool {
+	for _, v := range r.Header.Values("Accept-Encoding") {
+		for _, enc := range strings.Split(v, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(enc), ";")
+			if !strings.EqualFold(strings.TrimSpace(name), "gzip") {
+				continue
+			}
+
+			q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+			if !ok {
+				return true
+			}
+			f, err := strconv.ParseFloat(q, 64)
+			return err == nil && f > 0
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter compresses successful responses. Other responses,
+// such as errors, are passed through unchanged.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func newGzipResponseWriter(w http.ResponseWriter) *gzipResponseWriter {
+	return &gzipResponseWriter{ResponseWriter: w}
+}
+
+func (gw *gzipResponseWriter) WriteHeader(status int) {
+	if !gw.wroteHeader {
+		gw.wroteHeader = true
+
+		if h := gw.Header(); status == http.StatusOK && h.Get("Content-Encoding") == "" {
+			// The length of the compressed body isn't known upfront.
+			h.Del("Content-Length")
+			h.Set("Content-Encoding", "gzip")
+			gw.gz = gzip.NewWriter(gw.ResponseWriter)
+		}
+	}
+	gw.ResponseWriter.WriteHeader(status)
+}
+
+func (gw *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !gw.wroteHeader {
+		gw.WriteHeader(http.StatusOK)
+	}
+	if gw.gz != nil {
+		return gw.gz.Write(b)
+	}
+	return gw.ResponseWriter.Write(b)
+}
+
+// Close flushes the end of the compressed body.
+func (gw *gzipResponseWriter) Close() error {
+	if gw.gz == nil {
+		return nil
+	}
+	return gw.gz.Close()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (gw *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return gw.ResponseWriter
+}
+
+var (
+	// errUnsupportedEncoding is returned for request bodies in a
+	// Content-Encoding that can't be decoded, such as br.
+	errUnsupportedEncoding = errors.New("unsupported content encoding")
+	// errBadEncoding marks a request body that isn't valid in its declared
+	// Content-Encoding.
+	errBadEncoding = errors.New("invalid encoded body")
+)
+
+// decodeRequestBody returns body, read from r, decoded according to the
+// Content-Encoding of r: gzip, deflate or none. Decoding errors, then or
+// while reading, wrap errBadEncoding; errors of body itself are passed on.
+func decodeRequestBody(r *http.Request, body io.Reader) (io.ReadCloser, error) {
+	switch enc := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); enc {
+	case "", "identity":
+		return io.NopCloser(body), nil
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, decodeError(err)
+		}
+		return &decodeErrReader{ReadCloser: zr}, nil
+	case "deflate":
+		// deflate means zlib, but some clients send raw deflate data.
+		br := bufio.NewReader(body)
+		if hdr, err := br.Peek(2); err == nil && isZlibHeader(hdr) {
+			zr, err := zlib.NewReader(br)
+			if err != nil {
+				return nil, decodeError(err)
+			}
+			return &decodeErrReader{ReadCloser: zr}, nil
+		}
+		return &decodeErrReader{ReadCloser: flate.NewReader(br)}, nil
+	default:
+		return nil, fmt.Errorf("%w: %q", errUnsupportedEncoding, enc)
+	}
+}
+
+// isZlibHeader reports whether hdr starts a zlib stream: deflate method and
+// a valid header checksum, see RFC 1950.
+func isZlibHeader(hdr []byte) bool {
+	return hdr[0]&0x0f == 8 && (uint16(hdr[0])<<8|uint16(hdr[1]))%31 == 0
+}
+
+// decodeError wraps err, returned by a decompressor, with errBadEncoding
+// unless it comes from reading the body itself.
+func decodeError(err error) error {
+	if err == nil || err == io.EOF || isTimeout(err) || isTooLarge(err) || isClientGone(err) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", errBadEncoding, err)
+}
+
+// decodeErrReader tells decoding errors of a decompressor apart, see
+// decodeError.
+type decodeErrReader struct {
+	io.ReadCloser
+}
+
+func (dr *decodeErrReader) Read(p []byte) (int, error) {
+	n, err := dr.ReadCloser.Read(p)
+	return n, decodeError(err)
+}
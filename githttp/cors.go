@@ -0,0 +1,58 @@
+package githttp
+
+import (
+	"net/http"
+	"strings"
+)
+
+// corsAllowedHeaders are the request headers browsers may send. git needs
+// Git-Protocol for protocol v2.
+const corsAllowedHeaders = "Authorization, Content-Type, Content-Encoding, Git-Protocol"
+
+// corsOrigin returns the value of Access-Control-Allow-Origin for the
+// request, or the empty string when its origin isn't allowed.
+func (gsh GitSmartHTTP) corsOrigin(r *http.Request) string {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return ""
+	}
+
+	for _, allowed := range gsh.CORSOrigins {
+		if allowed == "*" {
+			return "*"
+		}
+		if strings.EqualFold(strings.TrimSpace(allowed), origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// cors adds the CORS headers for an allowed origin and answers preflight
+// requests, returning false when it did.
+func (gsh GitSmartHTTP) cors(w http.ResponseWriter, r *http.Request) bool {
+	if len(gsh.CORSOrigins) == 0 {
+		return true
+	}
+
+	w.Header().Add("Vary", "Origin")
+	origin := gsh.corsOrigin(r)
+	if origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Expose-Headers", "Content-Type")
+	}
+
+	if r.Method != "OPTIONS" || r.Header.Get("Access-Control-Request-Method") == "" {
+		return true
+	}
+
+	// Preflight. Without the allow headers the browser refuses the actual
+	// request for a disallowed origin.
+	if origin != "" {
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+		w.Header().Set("Access-Control-Max-Age", "600")
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return false
+}
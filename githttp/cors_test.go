@@ -0,0 +1,92 @@
+package githttp
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCORS(t *testing.T) {
+	allowed, other := "https://app.example", "https://evil.example"
+	for _, origins := range [][]string{{"https://other.example", allowed}, {"*"}} {
+		h, err := New(Config{
+			ReposRootPath: t.TempDir(),
+			UploadPack:    true,
+			ReceivePack:   true,
+			CORSOrigins:   origins,
+			Logger:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		wildcard := origins[0] == "*"
+
+		for _, tc := range []struct {
+			method, path, origin string
+			preflight            bool
+		}{
+			{"OPTIONS", "/repo.git/git-upload-pack", allowed, true},
+			{"OPTIONS", "/repo.git/git-receive-pack", other, true},
+			{"GET", "/repo.git/info/refs?service=git-upload-pack", allowed, false},
+			{"GET", "/repo.git/info/refs?service=git-upload-pack", other, false},
+			{"POST", "/repo.git/git-upload-pack", allowed, false},
+			{"POST", "/repo.git/git-upload-pack", other, false},
+			{"GET", "/repo.git/HEAD", "", false},
+		} {
+			req := httptest.NewRequest(tc.method, tc.path, strings.NewReader("0000"))
+			if tc.origin != "" {
+				req.Header.Set("Origin", tc.origin)
+			}
+			if tc.preflight {
+				req.Header.Set("Access-Control-Request-Method", "POST")
+				req.Header.Set("Access-Control-Request-Headers", "content-type, git-protocol")
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			hdr := rec.Result().Header
+			name := tc.method + " " + tc.path + " from " + tc.origin
+
+			wantOrigin := ""
+			switch {
+			case tc.origin == "":
+			case wildcard:
+				wantOrigin = "*"
+			case tc.origin == allowed:
+				wantOrigin = allowed
+			}
+			if got := hdr.Get("Access-Control-Allow-Origin"); got != wantOrigin {
+				t.Errorf("%v, %s: Access-Control-Allow-Origin %q, want %q", origins, name, got, wantOrigin)
+			}
+			if !strings.Contains(hdr.Get("Vary"), "Origin") {
+				t.Errorf("%v, %s: Vary %q", origins, name, hdr.Get("Vary"))
+			}
+
+			if !tc.preflight {
+				if rec.Code == http.StatusNoContent {
+					t.Errorf("%v, %s: answered as a preflight", origins, name)
+				}
+				if got := hdr.Get("Access-Control-Expose-Headers"); (got == "Content-Type") != (wantOrigin != "") {
+					t.Errorf("%v, %s: Access-Control-Expose-Headers %q", origins, name, got)
+				}
+				continue
+			}
+
+			if rec.Code != http.StatusNoContent {
+				t.Errorf("%v, %s: %d, want 204", origins, name, rec.Code)
+			}
+			methods, headers := hdr.Get("Access-Control-Allow-Methods"), hdr.Get("Access-Control-Allow-Headers")
+			if wantOrigin == "" {
+				if methods != "" || headers != "" {
+					t.Errorf("%v, %s: preflight of a disallowed origin allowed %q, %q", origins, name, methods, headers)
+				}
+				continue
+			}
+			if !strings.Contains(methods, "POST") || !strings.Contains(headers, "Content-Type") || !strings.Contains(headers, "Git-Protocol") {
+				t.Errorf("%v, %s: allowed methods %q, headers %q", origins, name, methods, headers)
+			}
+		}
+	}
+}
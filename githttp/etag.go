@@ -0,0 +1,18 @@
+package githttp
+
+import (
+	"path"
+	"strings"
+)
+
+// objectETag returns the ETag of the loose object, pack or idx file at
+// urlPath. Their names are derived from their content, so the name is a
+// strong validator: "ab" "cdef..." of objects/ab/cdef... or the pack file
+// name.
+func objectETag(urlPath string) string {
+	dir, file := path.Split(urlPath)
+	if strings.HasPrefix(file, "pack-") {
+		return `"` + file + `"`
+	}
+	return `"` + path.Base(dir) + file + `"`
+}
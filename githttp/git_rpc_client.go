@@ -0,0 +1,304 @@
+package githttp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// gitBackend is the git binary used when GitRPCClientConfig.GitBinary is
+// empty.
+const gitBackend = "git"
+
+// WaitDelay bounds how long Wait blocks on the stdio pipes once a cancelled
+// git process has been killed.
+const WaitDelay = 5 * time.Second
+
+// GitRPCClientConfig is the configuration for the Git RPC Service
+type GitRPCClientConfig struct {
+	Stream bool
+	// Config holds "key=value" pairs passed to git with -c.
+	Config []string
+	// GitBinary is the name or path of the git executable, "git" when
+	// empty.
+	GitBinary string
+	// Env holds "KEY=VALUE" variables added to the environment git inherits.
+	Env []string
+	// Protocol is passed to git as GIT_PROTOCOL, e.g. "version=2". Empty
+	// leaves git on protocol v0.
+	Protocol string
+	// Cgroup, when enabled, runs the git process in a cgroup of its own.
+	Cgroup CgroupConfig
+}
+
+// errClientUsed is returned when a GitRPCClient is started twice.
+var errClientUsed = errors.New("git rpc client already used")
+
+// GitRPCClient runs a single git command. It holds the command and its
+// pipes, so a new client is needed for every call: preparing a second
+// command panics and starting it twice returns errClientUsed. "Stateless"
+// refers to git's --stateless-rpc mode, not to the client.
+type GitRPCClient struct {
+	RPCConfig    gitRPCConfig
+	StdinWriter  io.WriteCloser
+	StdoutReader io.ReadCloser
+	StderrReader io.ReadCloser
+	cmd          *exec.Cmd
+	started      bool
+	cgroup       *cgroup
+	*GitRPCClientConfig
+}
+
+type gitRPCConfig map[string]string
+
+// NewGitRPCClient returns a new GitRPCClient that works as a RPC client that
+// talks to Git.
+func NewGitRPCClient(config *GitRPCClientConfig) *GitRPCClient {
+	cfg := make(gitRPCConfig)
+	cfg["advertise_refs"] = "--advertise-refs"
+
+	gs := &GitRPCClient{
+		RPCConfig:          cfg,
+		GitRPCClientConfig: config,
+	}
+	return gs
+}
+
+// Output is a block call that returns the RPC result back as a byte sequence
+// It will return an error when the RPC call is not successful.
+func (gs *GitRPCClient) Output() ([]byte, error) {
+	if err := gs.markStarted(); err != nil {
+		return nil, err
+	}
+	if err := gs.enterCgroup(); err != nil {
+		return nil, err
+	}
+	defer gs.leaveCgroup()
+
+	return gs.cmd.Output()
+}
+
+// Wait happens after the Start call, which is a block call that will only finish
+// when the RPC has been finished.
+// Error will be raised when unexpected happens.
+func (gs *GitRPCClient) Wait() error {
+	defer gs.leaveCgroup()
+	return gs.cmd.Wait()
+}
+
+// Start begins a RPC call. It will expose the stdin/stdout/stderr pipe when
+// streaming is allowed.
+func (gs *GitRPCClient) Start() error {
+	if err := gs.markStarted(); err != nil {
+		return err
+	}
+
+	if gs.Stream {
+		err := gs.ioPrepare()
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := gs.enterCgroup(); err != nil {
+		return err
+	}
+	if err := gs.cmd.Start(); err != nil {
+		gs.leaveCgroup()
+		return err
+	}
+	return nil
+}
+
+// UploadPack serves git fetch-pack and git ls-remote clients, which are
+// invoked from git fetch, git pull, and git clone. The git process is
+// killed when ctx is done.
+func (gs *GitRPCClient) UploadPack(ctx context.Context, repoPath string, cfg map[string]struct{}) {
+	args := []string{"upload-pack"}
+
+	for k := range cfg {
+		args = append(args, gs.RPCConfig[k])
+	}
+	args = append(args, "--stateless-rpc", repoPath)
+
+	gs.setCommand(gs.command(ctx, args))
+}
+
+// ReceivePack serves git send-pack clients, which is invoked from git push.
+// The git process is killed when ctx is done.
+func (gs *GitRPCClient) ReceivePack(ctx context.Context, repoPath string, cfg map[string]struct{}) {
+	args := []string{"receive-pack"}
+
+	for k := range cfg {
+		args = append(args, gs.RPCConfig[k])
+	}
+	args = append(args, "--stateless-rpc", repoPath)
+
+	gs.setCommand(gs.command(ctx, args))
+}
+
+// GC runs git gc on the repository, pruning loose objects and stale
+// temporary files older than pruneExpire.
+func (gs *GitRPCClient) GC(ctx context.Context, repoPath string, pruneExpire string) {
+	args := []string{"-C", repoPath, "gc", "--quiet", "--prune=" + pruneExpire}
+
+	gs.setCommand(gs.command(ctx, args))
+}
+
+// Repack packs the loose objects of the repository and updates the info
+// files dumb clients read. The loose objects are kept, dumb clients that
+// listed the packs before may still fetch them.
+func (gs *GitRPCClient) Repack(ctx context.Context, repoPath string) {
+	gs.setCommand(gs.command(ctx, []string{"-C", repoPath, "repack", "-q"}))
+}
+
+// PrunePacked removes the loose objects of the repository that are in a
+// pack as well.
+func (gs *GitRPCClient) PrunePacked(ctx context.Context, repoPath string) {
+	gs.setCommand(gs.command(ctx, []string{"-C", repoPath, "prune-packed", "-q"}))
+}
+
+// ForEachRef lists the names of the refs of the repository, one per line.
+func (gs *GitRPCClient) ForEachRef(ctx context.Context, repoPath string) {
+	gs.setCommand(gs.command(ctx, []string{"-C", repoPath, "for-each-ref", "--format=%(refname)"}))
+}
+
+// ConfigBool prints the value of the boolean config key of the repository,
+// "true" or "false". git exits with status 1 when it isn't set.
+func (gs *GitRPCClient) ConfigBool(ctx context.Context, repoPath, key string) {
+	gs.setCommand(gs.command(ctx, []string{"-C", repoPath, "config", "--bool", "--get", key}))
+}
+
+// GitPath prints the path of name inside the repository's git directory,
+// honouring settings such as core.hooksPath. Relative paths are relative to
+// repoPath.
+func (gs *GitRPCClient) GitPath(ctx context.Context, repoPath, name string) {
+	gs.setCommand(gs.command(ctx, []string{"-C", repoPath, "rev-parse", "--git-path", name}))
+}
+
+// InitBare creates an empty bare repository at repoPath, including missing
+// parent directories, from the template directory when one is given.
+func (gs *GitRPCClient) InitBare(ctx context.Context, repoPath, template string) {
+	args := []string{"init", "--bare", "--quiet"}
+	if template != "" {
+		args = append(args, "--template="+template)
+	}
+	gs.setCommand(gs.command(ctx, append(args, repoPath)))
+}
+
+// Version prints the version of git.
+func (gs *GitRPCClient) Version(ctx context.Context) {
+	gs.setCommand(gs.command(ctx, []string{"--version"}))
+}
+
+// UpdateServerInfo updates auxiliary info file to help dumb servers.
+// It will update objects/info/packs and info/refs.
+// See https://git-scm.com/docs/gitrepository-layout to understand what they are for
+func (gs *GitRPCClient) UpdateServerInfo(ctx context.Context, repoPath string, cfg map[string]struct{}) {
+	args := []string{"-C", repoPath, "update-server-info"}
+
+	for k := range cfg {
+		args = append(args, gs.RPCConfig[k])
+	}
+
+	gs.setCommand(gs.command(ctx, args))
+}
+
+// setCommand records the command the client runs. Preparing a second one
+// is a programming error, the pipes of the first would be lost.
+func (gs *GitRPCClient) setCommand(cmd *exec.Cmd) {
+	if gs.cmd != nil {
+		panic("git rpc client reused, create one per command")
+	}
+	gs.cmd = cmd
+}
+
+// markStarted fails when there is no command to run or it already ran.
+func (gs *GitRPCClient) markStarted() error {
+	if gs.cmd == nil {
+		return errors.New("no git command prepared")
+	}
+	if gs.started {
+		return errClientUsed
+	}
+	gs.started = true
+	return nil
+}
+
+func (gs *GitRPCClient) command(ctx context.Context, args []string) *exec.Cmd {
+	bin := gs.GitBinary
+	if bin == "" {
+		bin = gitBackend
+	}
+
+	cmd := exec.CommandContext(ctx, bin, gs.withConfig(args)...)
+	cmd.WaitDelay = WaitDelay
+	if len(gs.Env) > 0 || gs.Protocol != "" {
+		cmd.Env = append(os.Environ(), gs.Env...)
+		// The protocol the client asked for wins over a configured one.
+		if gs.Protocol != "" {
+			cmd.Env = append(cmd.Env, "GIT_PROTOCOL="+gs.Protocol)
+		}
+	}
+	return cmd
+}
+
+// withConfig prefixes the git sub-command args with the configured -c
+// options.
+func (gs *GitRPCClient) withConfig(args []string) []string {
+	var cfgArgs []string
+	for _, kv := range gs.Config {
+		cfgArgs = append(cfgArgs, "-c", kv)
+	}
+	return append(cfgArgs, args...)
+}
+
+// enterCgroup creates the cgroup the git process is started in, if cgroups
+// are enabled.
+func (gs *GitRPCClient) enterCgroup() error {
+	if !gs.Cgroup.Enabled() {
+		return nil
+	}
+
+	cg, err := newCgroup(gs.Cgroup)
+	if err != nil {
+		return fmt.Errorf("cannot create cgroup: %s", err)
+	}
+	cg.apply(gs.cmd)
+	gs.cgroup = cg
+	return nil
+}
+
+// leaveCgroup removes the cgroup of the exited git process.
+func (gs *GitRPCClient) leaveCgroup() {
+	if gs.cgroup == nil {
+		return
+	}
+
+	if err := gs.cgroup.remove(); err != nil {
+		slog.Error("Cannot remove cgroup", "err", err)
+	}
+	gs.cgroup = nil
+}
+
+func (gs *GitRPCClient) ioPrepare() error {
+	var err error
+	if gs.StdinWriter, err = gs.cmd.StdinPipe(); err != nil {
+		return err
+	}
+
+	if gs.StdoutReader, err = gs.cmd.StdoutPipe(); err != nil {
+		return err
+	}
+
+	if gs.StderrReader, err = gs.cmd.StderrPipe(); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,115 @@
+package githttp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestGitRPCClientSingleUse(t *testing.T) {
+	gitBinary := gitEnv(t)
+	gs := NewGitRPCClient(&GitRPCClientConfig{GitBinary: gitBinary})
+
+	if _, err := gs.Output(); err == nil {
+		t.Error("Output without a command succeeded")
+	}
+
+	gs.Version(context.Background())
+	if _, err := gs.Output(); err != nil {
+		t.Fatalf("Output: %s", err)
+	}
+	if _, err := gs.Output(); !errors.Is(err, errClientUsed) {
+		t.Errorf("second Output = %v, want errClientUsed", err)
+	}
+	if err := gs.Start(); !errors.Is(err, errClientUsed) {
+		t.Errorf("Start after Output = %v, want errClientUsed", err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("preparing a second command didn't panic")
+		}
+	}()
+	gs.Version(context.Background())
+}
+
+// TestGitRPCClientConcurrent runs many commands at once through fresh
+// clients sharing a config, and many requests through the handler, for the
+// race detector to prove no state is shared between them.
+func TestGitRPCClientConcurrent(t *testing.T) {
+	gitBinary := gitEnv(t)
+	cfg := &GitRPCClientConfig{
+		GitBinary: gitBinary,
+		Config:    []string{"core.bigFileThreshold=1m"},
+		Env:       []string{"GIT_TEST=1"},
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			gs := NewGitRPCClient(cfg)
+			gs.Version(context.Background())
+			out, err := gs.Output()
+			if err != nil || !strings.HasPrefix(string(out), "git version") {
+				t.Errorf("git --version = %q, %v", out, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	url, _ := newIntegrationServer(t, Config{})
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			service := uploadPack
+			if i%2 == 1 {
+				service = receivePack
+			}
+			resp, err := http.Get(fmt.Sprintf("%s/info/refs?service=%s", url, service))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("info/refs for %s: %s", service, resp.Status)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// TestIntegrationGitEnv pushes to a repository whose pre-receive hook
+// records the environment git runs it with.
+func TestIntegrationGitEnv(t *testing.T) {
+	url, repo := newIntegrationServer(t, Config{GitEnv: []string{"GIT_HTTP_BACKEND_TEST=from config"}})
+	env := filepath.Join(t.TempDir(), "env")
+	hook := fmt.Sprintf("#!/bin/sh\nenv > %s\n", env)
+	if err := os.WriteFile(filepath.Join(repo, "hooks", "pre-receive"), []byte(hook), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	a := filepath.Join(t.TempDir(), "a")
+	runGit(t, "", "clone", "-q", url, a)
+	commitFile(t, a, "1")
+	runGit(t, a, "push", "-q", "origin", "main")
+
+	b, err := os.ReadFile(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"GIT_HTTP_BACKEND_TEST=from config\n", "REMOTE_ADDR=127.0.0.1\n"} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("hook environment lacks %q:\n%s", want, b)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package githttp
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// gitVersionTimeout bounds a single git --version call.
+const gitVersionTimeout = 10 * time.Second
+
+// gitVersion returns the cached output of git --version, empty until it
+// was first checked.
+func (gsh GitSmartHTTP) gitVersion() string {
+	v, _ := gsh.cachedGitVersion.Load().(string)
+	return v
+}
+
+// RefreshGitVersion runs git --version and updates the cached version,
+// logging when it changed. Git may be upgraded under a running server, new
+// git processes pick that up but the cache would not.
+func (gsh GitSmartHTTP) RefreshGitVersion() {
+	ctx, cancel := context.WithTimeout(context.Background(), gitVersionTimeout)
+	defer cancel()
+
+	gs := gsh.newGitRPCClient(false)
+	gs.Version(ctx)
+	out, err := gs.Output()
+	if err != nil {
+		gsh.Logger.Error("Cannot check the git version", "err", err, "stderr", exitStderr(err))
+		return
+	}
+
+	version := strings.TrimSpace(string(out))
+	switch old := gsh.gitVersion(); {
+	case old == "":
+		gsh.Logger.Info("Using git", "version", version)
+	case old != version:
+		gsh.Logger.Info("Git version changed", "old", old, "version", version)
+	}
+	gsh.cachedGitVersion.Store(version)
+}
+
+// WatchGitVersion refreshes the git version on SIGHUP and, if
+// GitVersionInterval is set, periodically.
+func (gsh GitSmartHTTP) WatchGitVersion() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if gsh.GitVersionInterval > 0 {
+		ticker := time.NewTicker(gsh.GitVersionInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-hup:
+		case <-tick:
+		}
+		gsh.RefreshGitVersion()
+	}
+}
@@ -0,0 +1,1669 @@
+package githttp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	uploadPack  = "git-upload-pack"
+	receivePack = "git-receive-pack"
+)
+
+// Service defines the Git Smart HTTP request by the given method and pattern
+type Service struct {
+	Name    string
+	Method  string
+	Pattern *regexp.Regexp
+	Handler func(s Service, w http.ResponseWriter, r *http.Request)
+}
+
+// ParseURLNamedParams parse the request into named parameters
+func (s *Service) ParseURLNamedParams(r *http.Request) map[string]string {
+	namedParams := make(map[string]string)
+
+	subexpNames := s.Pattern.SubexpNames()
+	matches := s.Pattern.FindAllStringSubmatch(r.URL.Path, -1)[0]
+
+	for i, match := range matches {
+		if name := subexpNames[i]; name != "" {
+			namedParams[name] = match
+		}
+	}
+	return namedParams
+}
+
+// GitSmartHTTPConfig is the configuration for GitSmartHTTP
+type GitSmartHTTPConfig struct {
+	ReposRootPath string
+	ReceivePack   bool
+	UploadPack    bool
+	Port          int
+	// GitBinary is the git executable to run, "git" from PATH by default.
+	GitBinary string
+	// TLSCertFile and TLSKeyFile enable HTTPS on TLSPort when both are set.
+	TLSCertFile string
+	TLSKeyFile  string
+	TLSPort     int
+	// TLSRedirect keeps a plain HTTP listener on Port that redirects to
+	// HTTPS.
+	TLSRedirect bool
+	// TLSSessionTickets enables TLS session resumption with tickets.
+	TLSSessionTickets bool
+	// TLSTicketRotation replaces the session ticket key at this interval.
+	// Zero leaves rotation to crypto/tls.
+	TLSTicketRotation time.Duration
+	// AllowEarlyData accepts GET requests a proxy forwarded from TLS 1.3
+	// early data. POSTs sent as early data are always refused.
+	AllowEarlyData bool
+	// ListenBacklog sets the accept queue length of the listener where the
+	// OS supports it. Zero keeps the OS default.
+	ListenBacklog int
+	// AcceptRate caps the number of connections accepted per second. Zero
+	// means unlimited.
+	AcceptRate float64
+	// Authenticator enables HTTP Basic authentication when set.
+	Authenticator Authenticator
+	// AuthCacheTTL is how long credentials Authenticator accepted are
+	// accepted again without asking it. Zero asks on every request.
+	AuthCacheTTL time.Duration
+	// AuthRealm is the realm sent in the WWW-Authenticate challenge.
+	AuthRealm string
+	// AnonymousRead lets unauthenticated clients fetch while pushes still
+	// require credentials.
+	AnonymousRead bool
+	// Authorize, when set, is asked before a repository is read from or
+	// pushed to. Denied requests get 403.
+	Authorize AuthorizeFunc
+	// MaxBodyBytes rejects RPC requests whose body, compressed or not, is
+	// larger than this with 413. Zero means unlimited.
+	MaxBodyBytes int64
+	// BodyIdleTimeout aborts a request when the client sends no body bytes
+	// for this long. Zero disables it.
+	BodyIdleTimeout time.Duration
+	// HideRefs lists ref prefixes hidden from fetching clients, for both
+	// the v0 advertisement and the protocol v2 ls-refs command, and from
+	// the refs served to dumb clients.
+	HideRefs []string
+	// DenySymrefUpdates rejects pushes that try to update a symbolic ref
+	// such as HEAD.
+	DenySymrefUpdates bool
+	// RedactQueryParams lists query parameters whose values are masked in
+	// the logs.
+	RedactQueryParams []string
+	// FollowSymlinks serves repositories reached through symlinks that
+	// lead out of their root. When false they are refused with 403.
+	FollowSymlinks bool
+	// LogHeaders logs the request headers, with credentials masked.
+	LogHeaders bool
+	// LogTLS adds the TLS version, cipher suite and client certificate
+	// subject of HTTPS requests to the access log.
+	LogTLS bool
+	// BasePath is the URL path the server is mounted at, e.g. "/git",
+	// stripped before routing. Requests outside of it are not found.
+	BasePath string
+	// Middlewares wrap the handler, the first one outermost. They see
+	// every request before it is logged, authenticated or routed.
+	Middlewares []Middleware
+	// AccessLogFormat replaces the structured request log line with a line
+	// in the "common" or "combined" Apache log format written to
+	// AccessLog. Empty keeps the structured line.
+	AccessLogFormat string
+	// AccessLog receives the access log lines when AccessLogFormat is set,
+	// stdout if nil.
+	AccessLog io.Writer
+	// PackCacheSize is the number of bytes of pack and idx files kept in
+	// memory to serve hot packs without hitting the disk. Zero disables it.
+	PackCacheSize int64
+	// ShedGitProcesses rejects new fetches with 503 once this many git
+	// subprocesses are running. Zero disables it.
+	ShedGitProcesses int
+	// ShedRequests rejects new fetches with 503 once this many requests
+	// are being served. Zero disables it.
+	ShedRequests int
+	// ShedRetryAfter is sent as Retry-After with requests rejected due to
+	// load.
+	ShedRetryAfter time.Duration
+	// MaxAdvertisements caps the number of ref advertisements generated at
+	// once, further info/refs requests get 503. Zero means unlimited.
+	MaxAdvertisements int
+	// RequireSignedPush rejects pushes unless they carry a push certificate
+	// (git push --signed) with a good signature by a known signer and a
+	// nonce of this server. SSH keys are known through
+	// gpg.ssh.allowedSignersFile. The http.requireSignedPush git config of a
+	// repository overrides it.
+	RequireSignedPush bool
+	// PushCertNonceSeed seeds the nonces of push certificates. Servers
+	// sharing repositories must use the same seed, a random one is used
+	// when empty.
+	PushCertNonceSeed string
+	// RepoReadRate and RepoWriteRate limit fetches and pushes to each
+	// repository, in requests per second. Zero disables the limit.
+	RepoReadRate   float64
+	RepoReadBurst  int
+	RepoWriteRate  float64
+	RepoWriteBurst int
+	// GCAfterFailedPush runs git gc in the background on a repository after
+	// a push to it was killed, to reclaim the objects it left behind.
+	GCAfterFailedPush bool
+	// GCPruneExpire is passed to git gc --prune. Objects of pushes still in
+	// progress must not be older than this.
+	GCPruneExpire string
+	// Logger receives the log messages, every request is logged once it is
+	// done. Defaults to slog.Default().
+	Logger Logger
+	// Metrics receives request and subprocess measurements. Defaults to a
+	// no-op implementation, or to Prometheus metrics when MetricsEnabled.
+	Metrics Metrics
+	// MetricsEnabled serves Metrics on /metrics if it implements
+	// http.Handler, which the default Prometheus metrics do.
+	MetricsEnabled bool
+	// HealthPath is where the health check is served, without
+	// authentication. Empty disables it.
+	HealthPath string
+	// HealthCanary is a repository the health check runs upload-pack
+	// --advertise-refs against, failing when that fails or takes longer
+	// than HealthCanaryTimeout, 2 seconds when zero. Empty skips it.
+	HealthCanary        string
+	HealthCanaryTimeout time.Duration
+	// Compress gzips responses other than pack data for clients accepting
+	// it.
+	Compress bool
+	// PushLock serializes pushes to a repository with a file lock, which
+	// servers sharing the repositories over NFS respect too. Pushes waiting
+	// longer than PushLockTimeout get 503.
+	PushLock        bool
+	PushLockTimeout time.Duration
+	// RepackLooseObjects repacks a repository served to dumb clients once
+	// it has more loose objects than this, at most every RepackInterval.
+	// Zero disables it.
+	RepackLooseObjects int
+	RepackInterval     time.Duration
+	// DenyDeleteAll rejects pushes that delete every ref of a repository,
+	// unless they come with the allow-delete-all push option.
+	DenyDeleteAll bool
+	// EnableListing serves the repositories the user may fetch from as
+	// JSON on /_repos, looking at most ListingDepth directories deep below
+	// each root.
+	EnableListing bool
+	ListingDepth  int
+	// LFS serves the Git LFS batch API, storing objects below lfs/ in each
+	// repository.
+	LFS bool
+	// ObjectInfo advertises the protocol v2 object-info command, which
+	// tells clients the size of objects without sending them. git before
+	// 2.41 advertises it regardless.
+	ObjectInfo bool
+	// Promisor lets clients make partial clones with --filter and fetch
+	// the objects they left out on demand. Any object may then be fetched
+	// by name, so it can't be combined with HideRefs.
+	Promisor bool
+	// Mirror serves repositories read-only: receive-pack is disabled and
+	// its route is not registered at all.
+	Mirror bool
+	// AutoCreate creates missing bare repositories when they are pushed
+	// to.
+	AutoCreate bool
+	// InitTemplate is the template directory repositories created by
+	// AutoCreate are initialised from, see git init --template. Empty uses
+	// git's default.
+	InitTemplate string
+	// Cgroup runs every git process in a cgroup v2 of its own with the
+	// given limits. Linux only.
+	Cgroup CgroupConfig
+	// GitVersionInterval is how often the git version is checked again,
+	// besides on SIGHUP. Zero only checks on SIGHUP.
+	GitVersionInterval time.Duration
+	// MaxPathLength and MaxPathDepth bound the length of request paths and
+	// the number of segments in them. Zero disables the limit.
+	MaxPathLength int
+	MaxPathDepth  int
+	// CORSOrigins lists the origins browsers may call the server from, "*"
+	// for any. Empty disables CORS.
+	CORSOrigins []string
+	// ReadTimeout, WriteTimeout and IdleTimeout are set on the
+	// http.Server. ReadTimeout and WriteTimeout bound a whole request, zero
+	// leaves them unlimited so large pushes and clones aren't cut off.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+	// GitTimeout bounds how long a single git process may run. Zero
+	// disables it.
+	GitTimeout time.Duration
+	// ShutdownTimeout is how long requests in flight may take to finish
+	// once a shutdown was requested.
+	ShutdownTimeout time.Duration
+	// Roots maps URL prefixes to repository directories, the first
+	// matching prefix wins and paths matching none get 404. ReposRootPath
+	// serves every path when it is empty.
+	Roots []RepoRoot
+	// CommitterEmailDomain is the domain of the committer email given to
+	// receive-pack hooks for authenticated pushes, user@domain. Empty uses
+	// user@http.<client address> like git http-backend.
+	CommitterEmailDomain string
+	// RateLimit is the number of requests per second allowed per client
+	// IP, with bursts of RateBurst, on the git routes and the listing.
+	// Zero disables the limit.
+	RateLimit float64
+	RateBurst int
+	// TrustedProxies are the networks of the proxies whose
+	// X-Forwarded-For and X-Forwarded-Proto headers are believed.
+	TrustedProxies []*net.IPNet
+	// UnixSocket is the path of a Unix domain socket listened on instead
+	// of Port.
+	UnixSocket string
+	// GitEnv holds "KEY=VALUE" variables added to the environment of every
+	// git process.
+	GitEnv []string
+}
+
+// GitSmartHTTP acts as an Git Smart HTTP server's handler and deal
+// with all kinds of Git HTTP request
+type GitSmartHTTP struct {
+	Services []Service
+	*GitSmartHTTPConfig
+	inFlight         *atomic.Int64
+	inFlightRequests *atomic.Int64
+	packCache        *packCache
+	repoReadLimiter  *rateLimiter
+	repoWriteLimiter *rateLimiter
+	clientLimiter    *rateLimiter
+	authCache        *authCache
+	advertisements   chan struct{}
+	maintenance      *sync.Map
+	lastRepack       *sync.Map
+	metricsHandler   http.Handler
+	cachedGitVersion *atomic.Value
+	// handler is serveHTTP wrapped in the middlewares.
+	handler http.Handler
+}
+
+// Config is the configuration of the handler returned by New.
+type Config = GitSmartHTTPConfig
+
+// New returns the git smart HTTP handler for cfg, for embedding in another
+// server. It neither parses flags nor listens, serving is up to the caller.
+func New(cfg Config) (http.Handler, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return NewGitSmartHTTP(&cfg)
+}
+
+// Validate reports the first setting of cfg that can't work.
+func (cfg *GitSmartHTTPConfig) Validate() error {
+	if cfg.ReposRootPath == "" && len(cfg.Roots) == 0 {
+		return errors.New("no repositories root configured")
+	}
+	for _, root := range cfg.Roots {
+		if !strings.HasPrefix(root.Prefix, "/") || root.Path == "" {
+			return fmt.Errorf("invalid root %q=%q, expected a /prefix and a directory", root.Prefix, root.Path)
+		}
+	}
+	if cfg.BasePath != "" && !strings.HasPrefix(cfg.BasePath, "/") {
+		return fmt.Errorf("base path %q must start with /", cfg.BasePath)
+	}
+	if !isAccessLogFormat(cfg.AccessLogFormat) {
+		return fmt.Errorf("unknown access log format %q, expected common or combined", cfg.AccessLogFormat)
+	}
+	if cfg.Promisor && len(cfg.HideRefs) > 0 {
+		// uploadpack.allowReachableSHA1InWant counts hidden refs as
+		// reachable too, there is no setting keeping them hidden.
+		return errors.New("promisor serves objects of hidden refs by name, it can't be combined with hidden refs")
+	}
+	if cfg.InitTemplate != "" {
+		if fi, err := os.Stat(cfg.InitTemplate); err != nil {
+			return fmt.Errorf("init template: %s", err)
+		} else if !fi.IsDir() {
+			return fmt.Errorf("init template %s is not a directory", cfg.InitTemplate)
+		}
+	}
+	return nil
+}
+
+// NewGitSmartHTTP returns a GitSmartHTTP. It fails only when no random
+// push certificate nonce seed or credential cache key can be generated.
+func NewGitSmartHTTP(cfg *GitSmartHTTPConfig) (GitSmartHTTP, error) {
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+
+	if cfg.Metrics == nil {
+		if cfg.MetricsEnabled {
+			cfg.Metrics = newPrometheusMetrics()
+		} else {
+			cfg.Metrics = noopMetrics{}
+		}
+	}
+
+	if cfg.Mirror {
+		cfg.ReceivePack = false
+	}
+
+	if cfg.AccessLog == nil {
+		cfg.AccessLog = os.Stdout
+	}
+
+	// Paths are checked against the roots lexically, so they must be
+	// the real directories for symlinks below them to be judged right.
+	cfg.ReposRootPath = realRoot(cfg.ReposRootPath)
+	roots := make([]RepoRoot, len(cfg.Roots))
+	for i, root := range cfg.Roots {
+		roots[i] = RepoRoot{Prefix: root.Prefix, Path: realRoot(root.Path)}
+	}
+	cfg.Roots = roots
+
+	gsh := GitSmartHTTP{
+		GitSmartHTTPConfig: cfg,
+		inFlight:           new(atomic.Int64),
+		inFlightRequests:   new(atomic.Int64),
+		maintenance:        new(sync.Map),
+		lastRepack:         new(sync.Map),
+		cachedGitVersion:   new(atomic.Value),
+	}
+
+	if h, ok := cfg.Metrics.(http.Handler); ok && cfg.MetricsEnabled {
+		gsh.metricsHandler = h
+	}
+
+	// Any repository may require signed pushes, see RequireSignedPush.
+	if cfg.PushCertNonceSeed == "" {
+		seed := make([]byte, 32)
+		if _, err := rand.Read(seed); err != nil {
+			return GitSmartHTTP{}, fmt.Errorf("cannot generate push certificate nonce seed: %s", err)
+		}
+		cfg.PushCertNonceSeed = hex.EncodeToString(seed)
+	}
+
+	if cfg.Authenticator != nil && cfg.AuthCacheTTL > 0 {
+		c, err := newAuthCache(cfg.AuthCacheTTL)
+		if err != nil {
+			return GitSmartHTTP{}, fmt.Errorf("cannot generate credential cache key: %s", err)
+		}
+		gsh.authCache = c
+	}
+
+	if cfg.PackCacheSize > 0 {
+		gsh.packCache = newPackCache(cfg.PackCacheSize)
+	}
+
+	if cfg.MaxAdvertisements > 0 {
+		gsh.advertisements = make(chan struct{}, cfg.MaxAdvertisements)
+	}
+
+	if cfg.RepoReadRate > 0 {
+		gsh.repoReadLimiter = newRateLimiter(cfg.RepoReadRate, cfg.RepoReadBurst)
+	}
+	if cfg.RepoWriteRate > 0 {
+		gsh.repoWriteLimiter = newRateLimiter(cfg.RepoWriteRate, cfg.RepoWriteBurst)
+	}
+	if cfg.RateLimit > 0 {
+		gsh.clientLimiter = newRateLimiter(cfg.RateLimit, cfg.RateBurst)
+	}
+
+	gsh.Services = []Service{
+		Service{
+			Name:    "head",
+			Method:  "GET",
+			Pattern: regexp.MustCompile("(?P<repoPath>.*)/HEAD$"),
+			Handler: gsh.handleTextFile,
+		},
+		Service{
+			Name:    "packed-refs",
+			Method:  "GET",
+			Pattern: regexp.MustCompile("(?P<repoPath>.*)/packed-refs$"),
+			Handler: gsh.handleTextFile,
+		},
+		Service{
+			Name:    "loose-ref",
+			Method:  "GET",
+			Pattern: regexp.MustCompile("(?P<repoPath>.*)/refs/.+$"),
+			Handler: gsh.handleLooseRef,
+		},
+		Service{
+			Name:    "info-packs",
+			Method:  "GET",
+			Pattern: regexp.MustCompile("(?P<repoPath>.*)/objects/info/packs$"),
+			Handler: gsh.handleInfoPacks,
+		},
+		Service{
+			Name:    "info-refs",
+			Method:  "GET",
+			Pattern: regexp.MustCompile("(?P<repoPath>.*)/info/refs$"),
+			Handler: gsh.handleInfoRefs,
+		},
+		Service{
+			Name:    "alternates",
+			Method:  "GET",
+			Pattern: regexp.MustCompile("(?P<repoPath>.*)/objects/info/alternates$"),
+			Handler: gsh.handleTextFile,
+		},
+		Service{
+			Name:    "http-alternates",
+			Method:  "GET",
+			Pattern: regexp.MustCompile("(?P<repoPath>.*)/objects/info/http-alternates$"),
+			Handler: gsh.handleTextFile,
+		},
+		Service{
+			Name:    "loose-object",
+			Method:  "GET",
+			Pattern: regexp.MustCompile("(?P<repoPath>.*)/objects/(?P<objectDir>[0-9a-f]{2})/(?P<objectFile>[0-9a-f]{38}|[0-9a-f]{62})$"),
+			Handler: gsh.handleLooseObject,
+		},
+		Service{
+			Name:    "pack-file",
+			Method:  "GET",
+			Pattern: regexp.MustCompile("(?P<repoPath>.*)/objects/pack/pack-[0-9a-f]{40}\\.pack$"),
+			Handler: gsh.handlePackFile,
+		},
+		Service{
+			Name:    "idx-file",
+			Method:  "GET",
+			Pattern: regexp.MustCompile("(?P<repoPath>.*)/objects/pack/pack-[0-9a-f]{40}\\.idx$"),
+			Handler: gsh.handleIdxFile,
+		},
+		Service{
+			Name:    "upload-pack",
+			Method:  "POST",
+			Pattern: regexp.MustCompile("(?P<repoPath>.*)/(?P<serviceType>git-upload-pack)$"),
+			Handler: gsh.handleServiceRPC,
+		},
+	}
+
+	if cfg.LFS {
+		gsh.Services = append(gsh.Services, gsh.lfsServices()...)
+	}
+
+	if !cfg.Mirror {
+		gsh.Services = append(gsh.Services, Service{
+			Name:    "receive-pack",
+			Method:  "POST",
+			Pattern: regexp.MustCompile("(?P<repoPath>.*)/(?P<serviceType>git-receive-pack)$"),
+			Handler: gsh.handleServiceRPC,
+		})
+	}
+
+	for _, warning := range overlappingServices(gsh.Services) {
+		cfg.Logger.Info("Overlapping routes", "warning", warning)
+	}
+
+	gsh.handler = chain(http.HandlerFunc(gsh.serveHTTP), cfg.Middlewares)
+	return gsh, nil
+}
+
+// ServerHttp implements the iServerHttp nterface of http.Handler. The
+// request goes through the middlewares first, see Middlewares.
+func (gsh GitSmartHTTP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	gsh.handler.ServeHTTP(w, r)
+}
+
+// serveHTTP is the handler inside the middlewares. The most specific
+// service matching the path handles the request, see route.
+func (gsh GitSmartHTTP) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	r, l := withRequestLogger(r, gsh.Logger)
+	r = withAuthResult(r)
+	rw := newResponseWriter(w)
+
+	// The request is logged with the path it was sent with, BasePath
+	// included.
+	logged := r
+	var routed *Service
+	defer func() {
+		if gsh.AccessLogFormat != "" {
+			gsh.writeAccessLog(rw, logged, start)
+			return
+		}
+		gsh.logRequest(l, rw, logged, routed, time.Since(start))
+	}()
+
+	var ok bool
+	if r, ok = gsh.stripBasePath(rw, r); !ok {
+		return
+	}
+
+	if !gsh.checkPathLimits(rw, r) || !gsh.cors(rw, r) {
+		return
+	}
+
+	if gsh.HealthPath != "" && r.URL.Path == gsh.HealthPath {
+		gsh.handleHealth(rw, r)
+		return
+	}
+
+	if gsh.metricsHandler != nil && r.URL.Path == MetricsPath {
+		gsh.metricsHandler.ServeHTTP(rw, r)
+		return
+	}
+
+	if ok, retryAfter := gsh.allowClient(r); !ok {
+		requestLog(r).Info("Client rate limited", "client", gsh.clientIP(r))
+		tooManyRequests(rw, r, retryAfter)
+		return
+	}
+
+	if gsh.EnableListing && r.URL.Path == ListingPath {
+		gsh.handleListing(rw, r)
+		return
+	}
+
+	// HEAD is answered by the GET routes, with the same headers and no
+	// body.
+	method := r.Method
+	if method == "HEAD" {
+		method = "GET"
+	}
+
+	service, ok := gsh.route(r.URL.Path, method)
+	switch {
+	case !ok:
+		rw.Header().Set("Content-Type", "text/plain")
+		http.NotFound(rw, r)
+	case method != service.Method:
+		methodNotAllowed(rw, r)
+	default:
+		routed = &service
+		gsh.serve(service, rw, r)
+	}
+}
+
+// remoteIP returns the IP address of the client without the port,
+// unbracketed for IPv6, e.g. "::1" for "[::1]:51234".
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return strings.Trim(r.RemoteAddr, "[]")
+	}
+	return host
+}
+
+// logRequest writes the single line logged for every request once it is
+// done.
+func (gsh GitSmartHTTP) logRequest(l Logger, rw *responseWriter, r *http.Request, s *Service, d time.Duration) {
+	args := []any{
+		"remote", gsh.clientIP(r),
+		"method", r.Method,
+		"path", gsh.redactURL(r.URL),
+		"proto", r.Proto,
+		"status", rw.status,
+		"bytes", rw.bytes,
+		"duration", d,
+	}
+
+	if s != nil {
+		params := s.ParseURLNamedParams(r)
+		args = append(args, "route", s.Name, "repo", params["repoPath"])
+
+		serviceType := params["serviceType"]
+		if s.Name == "info-refs" {
+			serviceType = r.URL.Query().Get("service")
+		}
+		if serviceType != "" {
+			args = append(args, "service", serviceType)
+		}
+	}
+
+	if proto := gsh.forwardedProto(r); proto != "" {
+		args = append(args, "scheme", proto)
+	}
+	if gsh.LogTLS && r.TLS != nil {
+		args = append(args, tlsLogAttrs(r.TLS)...)
+	}
+	if gsh.LogHeaders {
+		args = append(args, "headers", redactHeader(r.Header))
+	}
+	l.Info("Request", args...)
+}
+
+func (gsh GitSmartHTTP) serve(s Service, rw *responseWriter, r *http.Request) {
+	start := time.Now()
+
+	gsh.inFlightRequests.Add(1)
+	defer gsh.inFlightRequests.Add(-1)
+
+	if gsh.admit(s, rw, r) {
+		if gsh.Compress && compressible(s) {
+			rw.Header().Add("Vary", "Accept-Encoding")
+		}
+
+		if gsh.Compress && compressible(s) && acceptsGzip(r) {
+			gw := newGzipResponseWriter(rw)
+			s.Handler(s, gw, r)
+			gw.Close()
+		} else {
+			s.Handler(s, rw, r)
+		}
+	}
+
+	gsh.Metrics.IncRequest(s.Name, rw.status)
+	gsh.Metrics.ObserveDuration(s.Name, time.Since(start))
+	gsh.Metrics.AddBytes(s.Name, rw.bytes)
+}
+
+// admit runs the checks a request has to pass before its handler is
+// called. When one fails the rejection is written to w and false returned.
+func (gsh GitSmartHTTP) admit(s Service, w http.ResponseWriter, r *http.Request) bool {
+	if gsh.isTooEarly(r) {
+		tooEarly(w)
+		return false
+	}
+
+	if !gsh.authenticate(s, r) {
+		gsh.challenge(w, r)
+		return false
+	}
+
+	if ok, retryAfter := gsh.allowRepo(s, r); !ok {
+		requestLog(r).Info("Rate limited")
+		tooManyRequests(w, r, retryAfter)
+		return false
+	}
+
+	if isNewFetch(s, r) && gsh.overloaded() {
+		requestLog(r).Info("Shedding request, server is overloaded")
+		gsh.shed(w)
+		return false
+	}
+	return true
+}
+
+// gitStarted and gitFinished keep track of the running git subprocesses.
+// Metrics is told the change rather than the count, reports of two
+// processes starting at once could arrive out of order.
+func (gsh GitSmartHTTP) gitStarted() {
+	gsh.inFlight.Add(1)
+	gsh.Metrics.AddInFlight(1)
+}
+
+func (gsh GitSmartHTTP) gitFinished() {
+	gsh.inFlight.Add(-1)
+	gsh.Metrics.AddInFlight(-1)
+}
+
+func (gsh GitSmartHTTP) handleTextFile(s Service, w http.ResponseWriter, r *http.Request) {
+	gsh.sendFile(s, w, r, "text/plain", hdrNoCache())
+}
+
+// handleLooseRef serves a file below refs/. Directories and anything that
+// resolves outside of refs/, such as a symlink, are not found.
+func (gsh GitSmartHTTP) handleLooseRef(s Service, w http.ResponseWriter, r *http.Request) {
+	repoPath, ok := gsh.resolveRepo(w, r, s.ParseURLNamedParams(r)["repoPath"])
+	if !ok {
+		return
+	}
+
+	fullPath, ok := gsh.resolve(w, r, r.URL.Path)
+	if !ok {
+		return
+	}
+
+	refsDir, err := filepath.EvalSymlinks(filepath.Join(repoPath, "refs"))
+	if err == nil {
+		fullPath, err = filepath.EvalSymlinks(fullPath)
+	}
+	if err != nil || !strings.HasPrefix(fullPath, refsDir+string(filepath.Separator)) {
+		w.Header().Set("Content-Type", "text/plain")
+		http.NotFound(w, r)
+		return
+	}
+
+	// Hidden refs aren't found, whether asked for by name or through a
+	// symlink.
+	requestedRef := "refs/" + strings.TrimPrefix(r.URL.Path, s.ParseURLNamedParams(r)["repoPath"]+"/refs/")
+	ref := "refs/" + filepath.ToSlash(strings.TrimPrefix(fullPath, refsDir+string(filepath.Separator)))
+	if gsh.isHiddenRef(requestedRef) || gsh.isHiddenRef(ref) {
+		w.Header().Set("Content-Type", "text/plain")
+		http.NotFound(w, r)
+		return
+	}
+
+	gsh.sendFile(s, w, r, "text/plain", hdrNoCache())
+}
+
+// handleInfoPacks serves objects/info/packs, extended with the packs of the
+// repository's alternates, which are served as if they were its own.
+func (gsh GitSmartHTTP) handleInfoPacks(s Service, w http.ResponseWriter, r *http.Request) {
+	repoPath, ok := gsh.resolveRepo(w, r, s.ParseURLNamedParams(r)["repoPath"])
+	if !ok {
+		return
+	}
+
+	altPacks := gsh.alternatePacks(repoPath)
+	if len(altPacks) == 0 {
+		gsh.sendFile(s, w, r, "text/plain; charset=utf-8", hdrNoCache())
+		return
+	}
+	if !gsh.authorize(w, r, repoPath, uploadPack) {
+		return
+	}
+
+	local, _ := os.ReadFile(filepath.Join(repoPath, "objects", "info", "packs"))
+	packs := mergePackLists(local, altPacks)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(packs)))
+	setHeaders(w, hdrNoCache())
+	w.Write(packs)
+}
+
+func (gsh GitSmartHTTP) handleLooseObject(s Service, w http.ResponseWriter, r *http.Request) {
+	namedURLParams := s.ParseURLNamedParams(r)
+	repoPath, ok := gsh.resolveRepo(w, r, namedURLParams["repoPath"])
+	if !ok {
+		return
+	}
+
+	// A SHA-1 name can't exist in a SHA-256 repository and vice versa.
+	id := namedURLParams["objectDir"] + namedURLParams["objectFile"]
+	if len(id) != objectIDLength(repoPath) {
+		w.Header().Set("Content-Type", "text/plain")
+		http.NotFound(w, r)
+		return
+	}
+
+	gsh.sendFile(s, w, r, "application/x-git-loose-object", hdrCacheForever())
+}
+
+func (gsh GitSmartHTTP) handlePackFile(s Service, w http.ResponseWriter, r *http.Request) {
+	gsh.sendPackFile(s, w, r, "application/x-git-packed-objects", hdrCacheForever())
+}
+
+func (gsh GitSmartHTTP) handleIdxFile(s Service, w http.ResponseWriter, r *http.Request) {
+	gsh.sendPackFile(s, w, r, "application/x-git-packed-objects-toc", hdrCacheForever())
+}
+
+func (gsh GitSmartHTTP) handleInfoRefs(s Service, w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	serviceType := r.FormValue("service")
+	if serviceType != "" && !isService(serviceType) {
+		unknownService(w, r, serviceType)
+		return
+	}
+	if gsh.Mirror && serviceType == receivePack {
+		requestLog(r).Info("Push refused by mirror")
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintln(w, "This server is a read-only mirror")
+		return
+	}
+
+	namedURLParams := s.ParseURLNamedParams(r)
+	if !gsh.autoCreateRepo(w, r, namedURLParams["repoPath"], serviceType) {
+		return
+	}
+
+	repoPath, ok := gsh.resolveRepo(w, r, namedURLParams["repoPath"])
+	if !ok {
+		return
+	}
+
+	access := uploadPack
+	if serviceType == receivePack {
+		access = receivePack
+	}
+	if !gsh.authorize(w, r, repoPath, access) {
+		return
+	}
+
+	gs := gsh.newGitRPCClient(false)
+	gs.Protocol = gitProtocol(r)
+
+	if gsh.serviceAccess(serviceType) {
+		if !gsh.acquireAdvertisement() {
+			requestLog(r).Info("Too many ref advertisements in progress")
+			gsh.shed(w)
+			return
+		}
+		defer gsh.releaseAdvertisement()
+
+		rpcCfg := map[string]struct{}{
+			"advertise_refs": struct{}{},
+		}
+
+		ctx, cancel := gsh.gitContext(r.Context())
+		defer cancel()
+
+		if serviceType == uploadPack {
+			gs.UploadPack(ctx, repoPath, rpcCfg)
+		} else {
+			if gsh.requiresSignedPush(ctx, repoPath) {
+				gs.Config = append(gs.Config, gsh.pushCertConfig()...)
+			}
+			gs.ReceivePack(ctx, repoPath, rpcCfg)
+		}
+		gsh.gitStarted()
+		refs, err := gs.Output()
+		gsh.gitFinished()
+
+		if err != nil {
+			if gsh.gitTimedOut(ctx, w, r, serviceType) {
+				return
+			}
+			requestLog(r).Error("Git cannot advertise refs", "service", serviceType, "err", err, "stderr", exitStderr(err))
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if state := headState(repoPath); serviceType == uploadPack && state != headAttached {
+			requestLog(r).Debug("Advertising repository without a HEAD branch", "repo", repoPath, "head", state)
+		}
+
+		w.Header().Add("Content-Type", fmt.Sprintf("application/x-%s-advertisement", serviceType))
+		setHeaders(w, hdrNoCache())
+		w.WriteHeader(http.StatusOK)
+
+		// Protocol v2 starts straight with the capability advertisement.
+		if gs.Protocol != "version=2" {
+			fmt.Fprint(w, pktWrite(fmt.Sprintf("# service=%s\n", serviceType)))
+			fmt.Fprint(w, pktFlush())
+		}
+		w.Write(refs)
+	} else {
+		gs.UploadPack(r.Context(), repoPath, map[string]struct{}{})
+		gsh.gitStarted()
+		gs.Output()
+		gsh.gitFinished()
+
+		gsh.maybeRepack(repoPath)
+		gsh.sendFile(s, w, r, "text/plain; charset=utf-8", hdrNoCache())
+	}
+}
+
+func (gsh GitSmartHTTP) handleServiceRPC(s Service, w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	namedURLParams := s.ParseURLNamedParams(r)
+	serviceType := namedURLParams["serviceType"]
+	if !isService(serviceType) {
+		unknownService(w, r, serviceType)
+		return
+	}
+
+	if !gsh.autoCreateRepo(w, r, namedURLParams["repoPath"], serviceType) {
+		return
+	}
+
+	repoPath, ok := gsh.resolveRepo(w, r, namedURLParams["repoPath"])
+	if !ok {
+		return
+	}
+
+	if !gsh.authorize(w, r, repoPath, serviceType) {
+		return
+	}
+
+	if !gsh.serviceAccess(serviceType) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	// Errors reading the HTTP body itself, before any decoding, tell a
+	// client going away from a malformed body.
+	raw := &readErrRecorder{r: r.Body}
+	var body io.Reader = raw
+	if gsh.MaxBodyBytes > 0 {
+		body = http.MaxBytesReader(w, io.NopCloser(raw), gsh.MaxBodyBytes)
+	}
+	body = newIdleTimeoutReader(w, body, gsh.BodyIdleTimeout)
+
+	decoded, err := decodeRequestBody(r, body)
+	if err != nil {
+		gsh.bodyError(w, r, serviceType, repoPath, err)
+		return
+	}
+	defer decoded.Close()
+	body = newInflateLimitReader(decoded, gsh.MaxBodyBytes)
+
+	signed := serviceType == receivePack && gsh.requiresSignedPush(r.Context(), repoPath)
+	if serviceType == receivePack && (gsh.DenySymrefUpdates || signed || gsh.DenyDeleteAll) {
+		br := bufio.NewReader(body)
+		rp, err := readReceivePackRequest(br)
+		if err != nil {
+			if isTimeout(err) || isTooLarge(err) {
+				gsh.bodyError(w, r, serviceType, repoPath, err)
+				return
+			}
+			requestLog(r).Info("Cannot parse receive-pack commands", "err", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if reasons := gsh.vetReceivePack(r.Context(), repoPath, rp, signed); len(reasons) > 0 {
+			requestLog(r).Info("Rejected push", "repo", repoPath, "reasons", reasons)
+			rejectReceivePack(w, rp, reasons)
+			return
+		}
+
+		// Hand git the commands that were consumed, then the rest.
+		body = io.MultiReader(bytes.NewReader(rp.Raw), br)
+	}
+
+	if serviceType == receivePack && gsh.PushLock {
+		unlock, err := lockRepoForPush(r.Context(), repoPath, gsh.PushLockTimeout)
+		if err != nil {
+			requestLog(r).Error("Cannot lock repository for push", "repo", repoPath, "err", err)
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, "Another push to this repository is in progress, please try again later")
+			return
+		}
+		defer unlock()
+	}
+
+	// A proxy dropping Git-Protocol leaves git reading a v2 request as v0,
+	// which fails with an obscure protocol error.
+	protocol := gitProtocol(r)
+	if serviceType == uploadPack && protocol != "version=2" {
+		br := bufio.NewReader(body)
+		if isV2Request(br) {
+			requestLog(r).Info("Protocol v2 request without a Git-Protocol: version=2 header, serving it as v2", "warning", "the header may be stripped by a proxy")
+			protocol = "version=2"
+		}
+		body = br
+	}
+
+	ctx, cancel := gsh.gitContext(r.Context())
+	defer cancel()
+
+	gs := gsh.newGitRPCClient(true)
+	gs.Protocol = protocol
+
+	if serviceType == uploadPack {
+		gs.UploadPack(ctx, repoPath, map[string]struct{}{})
+	} else {
+		gs.Env = append(append([]string{}, gs.Env...), gsh.pusherEnv(r)...)
+		if signed {
+			hooks, cleanup, err := gsh.signedPushHooks(ctx, repoPath)
+			if err != nil {
+				requestLog(r).Error("Cannot set up signed push check", "repo", repoPath, "err", err, "stderr", exitStderr(err))
+				w.Header().Set("Content-Type", "text/plain")
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			defer cleanup()
+			gs.Config = append(gs.Config, gsh.pushCertConfig()...)
+			gs.Config = append(gs.Config, "core.hooksPath="+hooks)
+		}
+		gs.ReceivePack(ctx, repoPath, map[string]struct{}{})
+	}
+
+	// Start also sets up the pipes, nothing has been sent yet when it
+	// fails.
+	if err := gs.Start(); err != nil {
+		requestLog(r).Error("Git cannot be started", "service", serviceType, "err", err)
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "Git cannot be started")
+		return
+	}
+	gsh.gitStarted()
+	defer gsh.gitFinished()
+
+	w.Header().Set("Content-Type", fmt.Sprintf("application/x-%s-result", serviceType))
+
+	// Headers are sent along with the first bytes of stdout, so git's
+	// stderr can't change the response any more. It is only logged.
+	stderr := drainStderr(gs.StderrReader)
+
+	// The body is streamed into git while its output is streamed back, git
+	// may write before it has read everything. A body that can't be read
+	// to the end kills git, the request can't succeed anyway.
+	bodyErr := make(chan error, 1)
+	go func() {
+		src := &readErrRecorder{r: body}
+		io.Copy(gs.StdinWriter, src)
+		gs.StdinWriter.Close()
+
+		err := src.err
+		if errors.Is(raw.err, io.ErrUnexpectedEOF) || isClientGone(raw.err) {
+			err = fmt.Errorf("%w: %w", errClientAborted, err)
+		}
+		bodyErr <- err
+		if err != nil {
+			cancel()
+		}
+	}()
+
+	// A client hanging up is routine, git is killed and reaped quietly.
+	// The server may notice first and cancel the request, or, while
+	// negotiating, the body may end early.
+	_, err = io.Copy(w, gs.StdoutReader)
+	// A stalled body cancels the request context too, but is answered 408.
+	// The body read fails along with the context, its error follows.
+	stalled := r.Context().Err() != nil && isTimeout(awaitBodyErr(bodyErr, time.Second))
+	clientGone := isClientGone(err) || (r.Context().Err() != nil && !stalled) || clientAborted(bodyErr)
+	switch {
+	case clientGone:
+		phase := "transfer"
+		if !headerWritten(w) {
+			phase = "negotiation"
+			// nginx's "client closed request", for the access log only.
+			w.WriteHeader(statusClientClosedRequest)
+		}
+		requestLog(r).Info("Client aborted", "service", serviceType, "repo", repoPath, "phase", phase)
+		cancel()
+	case err != nil:
+		requestLog(r).Error("Cannot stream git output", "service", serviceType, "repo", repoPath, "err", err)
+		cancel()
+	}
+
+	msg := stderr()
+	waitErr := gs.Wait()
+
+	// Git may exit without reading the whole body, don't wait for it then,
+	// unless git wrote nothing: git exits once stdin is closed, maybe
+	// before a decoding error of the body is sent, and that error can still
+	// be answered.
+	readErr := peekBodyErr(bodyErr)
+	if !headerWritten(w) {
+		readErr = awaitBodyErr(bodyErr, time.Second)
+	}
+	if readErr != nil && !clientGone {
+		gsh.bodyError(w, r, serviceType, repoPath, readErr)
+		return
+	}
+
+	if waitErr == nil && serviceType == receivePack {
+		gsh.updateServerInfo(r, repoPath)
+	}
+
+	// A push killed half way, because the client went away or git timed
+	// out, leaves its quarantined objects behind.
+	killed := clientGone || ctx.Err() != nil
+	if waitErr != nil && killed && serviceType == receivePack && gsh.GCAfterFailedPush {
+		gsh.scheduleGC(repoPath)
+	}
+
+	if waitErr != nil && gsh.gitTimedOut(ctx, w, r, serviceType) {
+		return
+	}
+
+	if waitErr != nil {
+		switch reason := policyRejection(msg); {
+		case clientGone:
+		case reason != "":
+			// git has already told the client why, in an ERR packet.
+			requestLog(r).Info("Git refused request", "service", serviceType, "repo", repoPath, "reason", reason)
+		default:
+			requestLog(r).Error("Git failed", "service", serviceType, "repo", repoPath, "err", waitErr, "stderr", msg)
+		}
+	}
+}
+
+// statusClientClosedRequest is logged for requests the client abandoned
+// before any response was sent.
+const statusClientClosedRequest = 499
+
+var errClientAborted = errors.New("client aborted")
+
+// clientAborted reports whether the request body, whose read error is sent
+// on bodyErr, ended because the client went away.
+func clientAborted(bodyErr chan error) bool {
+	return errors.Is(peekBodyErr(bodyErr), errClientAborted)
+}
+
+// awaitBodyErr is peekBodyErr waiting up to timeout for the body to end.
+func awaitBodyErr(bodyErr chan error, timeout time.Duration) error {
+	select {
+	case err := <-bodyErr:
+		bodyErr <- err
+		return err
+	case <-time.After(timeout):
+		return nil
+	}
+}
+
+// peekBodyErr returns the read error of the request body sent on bodyErr,
+// nil when there is none yet. The error is put back for the caller.
+func peekBodyErr(bodyErr chan error) error {
+	select {
+	case err := <-bodyErr:
+		bodyErr <- err
+		return err
+	default:
+		return nil
+	}
+}
+
+// gitContext returns the context git processes of a request run with,
+// bounded by GitTimeout.
+func (gsh GitSmartHTTP) gitContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if gsh.GitTimeout > 0 {
+		return context.WithTimeout(ctx, gsh.GitTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// gitTimedOut reports whether the git process was killed because ctx hit
+// GitTimeout, answering 504 if the response hasn't started yet.
+func (gsh GitSmartHTTP) gitTimedOut(ctx context.Context, w http.ResponseWriter, r *http.Request, serviceType string) bool {
+	if ctx.Err() != context.DeadlineExceeded {
+		return false
+	}
+
+	requestLog(r).Error("Git timed out", "service", serviceType, "timeout", gsh.GitTimeout)
+	if !headerWritten(w) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusGatewayTimeout)
+	}
+	return true
+}
+
+// updateServerInfo refreshes info/refs and objects/info/packs after a push,
+// dumb HTTP clients rely on them.
+func (gsh GitSmartHTTP) updateServerInfo(r *http.Request, repoPath string) {
+	gs := gsh.newGitRPCClient(false)
+	gs.UpdateServerInfo(r.Context(), repoPath, map[string]struct{}{})
+
+	gsh.gitStarted()
+	_, err := gs.Output()
+	gsh.gitFinished()
+
+	if err != nil {
+		requestLog(r).Error("Cannot update server info", "repo", repoPath, "err", err, "stderr", exitStderr(err))
+	}
+}
+
+// bodyError logs a request body that couldn't be read and answers with the
+// matching status, unless the response has already started.
+func (gsh GitSmartHTTP) bodyError(w http.ResponseWriter, r *http.Request, serviceType, repoPath string, err error) {
+	status := http.StatusBadRequest
+	switch {
+	case isTimeout(err):
+		requestLog(r).Info("Request body stalled", "timeout", gsh.BodyIdleTimeout)
+		status = http.StatusRequestTimeout
+	case isTooLarge(err):
+		requestLog(r).Info("Request body too large", "service", serviceType, "repo", repoPath, "limit", gsh.MaxBodyBytes)
+		status = http.StatusRequestEntityTooLarge
+	case errors.Is(err, errUnsupportedEncoding):
+		requestLog(r).Info("Unsupported request encoding", "service", serviceType, "repo", repoPath, "encoding", r.Header.Get("Content-Encoding"))
+		status = http.StatusUnsupportedMediaType
+	case errors.Is(err, errBadEncoding):
+		requestLog(r).Info("Cannot decode request body", "service", serviceType, "repo", repoPath, "err", err)
+	default:
+		requestLog(r).Info("Cannot read request body", "service", serviceType, "repo", repoPath, "err", err)
+	}
+
+	if headerWritten(w) {
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(status)
+	switch {
+	case errors.Is(err, errUnsupportedEncoding):
+		fmt.Fprintln(w, "Unsupported Content-Encoding, use gzip or deflate")
+	case errors.Is(err, errBadEncoding):
+		fmt.Fprintf(w, "The request body is not valid %s\n", r.Header.Get("Content-Encoding"))
+	}
+}
+
+// readErrRecorder remembers the first error other than io.EOF returned by
+// r, so it can be told apart from errors writing to the other side of an
+// io.Copy.
+type readErrRecorder struct {
+	r   io.Reader
+	err error
+}
+
+func (rr *readErrRecorder) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	if err != nil && err != io.EOF && rr.err == nil {
+		rr.err = err
+	}
+	return n, err
+}
+
+// inflateLimitReader fails with an *http.MaxBytesError once more than
+// limit bytes came out of r. It guards against compressed bodies that
+// inflate far beyond MaxBodyBytes.
+type inflateLimitReader struct {
+	r     io.Reader
+	limit int64
+	n     int64
+}
+
+func newInflateLimitReader(r io.Reader, limit int64) io.Reader {
+	if limit <= 0 {
+		return r
+	}
+	return &inflateLimitReader{r: r, limit: limit}
+}
+
+func (lr *inflateLimitReader) Read(p []byte) (int, error) {
+	if lr.n > lr.limit {
+		return 0, &http.MaxBytesError{Limit: lr.limit}
+	}
+	if rest := lr.limit + 1 - lr.n; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+
+	n, err := lr.r.Read(p)
+	lr.n += int64(n)
+	if lr.n > lr.limit {
+		return n, &http.MaxBytesError{Limit: lr.limit}
+	}
+	return n, err
+}
+
+// isClientGone reports whether err comes from writing to a client that
+// closed the connection.
+func isClientGone(err error) bool {
+	return errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET)
+}
+
+func isTooLarge(err error) bool {
+	var maxErr *http.MaxBytesError
+	return errors.As(err, &maxErr)
+}
+
+// maxStderrBytes caps how much of a git process' stderr is kept for the
+// logs.
+const maxStderrBytes = 64 << 10
+
+// drainStderr reads r in the background so git never blocks on a full
+// stderr pipe. The returned function waits for r to be exhausted and
+// returns what was captured.
+func drainStderr(r io.Reader) func() string {
+	var buf bytes.Buffer
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		io.Copy(&buf, io.LimitReader(r, maxStderrBytes))
+		io.Copy(ioutil.Discard, r)
+	}()
+
+	return func() string {
+		<-done
+		return strings.TrimSpace(buf.String())
+	}
+}
+
+// gitPolicyErrors are the messages git dies with when the repository's
+// configuration forbids what the client asked for, as opposed to failing.
+var gitPolicyErrors = []string{
+	"not our ref",
+	"is not allowed",
+	"not allowed to request",
+}
+
+// policyRejection returns the line of git's stderr explaining why it
+// refused the request for policy reasons, or the empty string.
+func policyRejection(stderr string) string {
+	for _, line := range strings.Split(stderr, "\n") {
+		for _, e := range gitPolicyErrors {
+			if strings.Contains(line, e) {
+				return strings.TrimPrefix(strings.TrimSpace(line), "fatal: ")
+			}
+		}
+	}
+	return ""
+}
+
+// exitStderr returns the stderr captured by exec.Cmd.Output for logging.
+func exitStderr(err error) string {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+		return ": " + strings.TrimSpace(string(exitErr.Stderr))
+	}
+	return ""
+}
+
+func (gsh GitSmartHTTP) newGitRPCClient(stream bool) *GitRPCClient {
+	return NewGitRPCClient(&GitRPCClientConfig{
+		Stream:    stream,
+		Config:    gsh.gitConfig(),
+		GitBinary: gsh.GitBinary,
+		Env:       gsh.GitEnv,
+		Cgroup:    gsh.Cgroup,
+	})
+}
+
+// gitConfig returns the -c options every git invocation is run with.
+func (gsh GitSmartHTTP) gitConfig() []string {
+	var cfg []string
+	for _, ref := range gsh.HideRefs {
+		cfg = append(cfg, "uploadpack.hideRefs="+ref)
+	}
+
+	if gsh.Promisor {
+		// Partial clones ask for missing objects by name later on, which
+		// need not be reachable from an advertised ref any more.
+		cfg = append(cfg,
+			"uploadpack.allowFilter=true",
+			"uploadpack.allowAnySHA1InWant=true",
+		)
+	}
+
+	if gsh.DenyDeleteAll {
+		cfg = append(cfg, "receive.advertisePushOptions=true")
+	}
+
+	if gsh.ObjectInfo {
+		cfg = append(cfg, "transfer.advertiseObjectInfo=true")
+	}
+	return cfg
+}
+
+// vetReceivePack checks the commands of a push against the configured
+// policies and returns the refs to reject along with the reason. signed
+// tells whether the repository requires signed pushes.
+func (gsh GitSmartHTTP) vetReceivePack(ctx context.Context, repoPath string, rp *receivePackRequest, signed bool) map[string]string {
+	reasons := make(map[string]string)
+
+	if gsh.DenyDeleteAll && !rp.hasOption(AllowDeleteAll) && gsh.deletesAllRefs(ctx, repoPath, rp) {
+		for _, cmd := range rp.Commands {
+			reasons[cmd.Ref] = "deleting every ref is not allowed, push with -o " + AllowDeleteAll + " if you mean it"
+		}
+		return reasons
+	}
+
+	for _, cmd := range rp.Commands {
+		switch {
+		case signed && !rp.Signed:
+			reasons[cmd.Ref] = "signed push required, use git push --signed"
+		case gsh.DenySymrefUpdates && isSymbolicRef(repoPath, cmd.Ref):
+			reasons[cmd.Ref] = "updating symbolic refs is not allowed"
+		}
+	}
+	return reasons
+}
+
+// AllowDeleteAll is the push option overriding DenyDeleteAll.
+const AllowDeleteAll = "allow-delete-all"
+
+// deletesAllRefs reports whether the push only deletes refs and leaves the
+// repository without any.
+func (gsh GitSmartHTTP) deletesAllRefs(ctx context.Context, repoPath string, rp *receivePackRequest) bool {
+	deleted := make(map[string]bool)
+	for _, cmd := range rp.Commands {
+		if !cmd.isDeletion() {
+			return false
+		}
+		deleted[cmd.Ref] = true
+	}
+	if len(deleted) == 0 {
+		return false
+	}
+
+	gs := gsh.newGitRPCClient(false)
+	gs.ForEachRef(ctx, repoPath)
+	out, err := gs.Output()
+	if err != nil {
+		// Let git decide, the push is refused if the repository is broken.
+		return false
+	}
+
+	for _, ref := range strings.Fields(string(out)) {
+		if !deleted[ref] {
+			return false
+		}
+	}
+	return true
+}
+
+// gitProtocolVersions are the protocol versions passed on to git.
+var gitProtocolVersions = map[string]int{"version=0": 0, "version=1": 1, "version=2": 2}
+
+// gitProtocol picks the highest known version among the Git-Protocol
+// headers of r, which may be repeated or joined by proxies. Anything else
+// in them is dropped rather than handed to git. The empty string is
+// returned when no known version was asked for.
+func gitProtocol(r *http.Request) string {
+	best, version := "", -1
+	for _, v := range r.Header.Values("Git-Protocol") {
+		for _, param := range strings.FieldsFunc(v, func(c rune) bool { return c == ':' || c == ',' }) {
+			param = strings.TrimSpace(param)
+			if n, ok := gitProtocolVersions[param]; ok && n > version {
+				best, version = param, n
+			}
+		}
+	}
+	return best
+}
+
+// isV2Request reports whether the upload-pack request buffered in br starts
+// with a protocol v2 command, which v0 requests never do.
+func isV2Request(br *bufio.Reader) bool {
+	b, _ := br.Peek(4 + len("command="))
+	return len(b) == 4+len("command=") && string(b[4:]) == "command="
+}
+
+// maxPktLen is the longest pkt-line git accepts, length prefix included.
+const maxPktLen = 65520
+
+// pktWrite frames s as a single pkt-line. s can't be split without
+// changing its meaning, a payload longer than maxPktLen-4 is a bug.
+func pktWrite(s string) string {
+	if len(s)+4 > maxPktLen {
+		panic(fmt.Sprintf("pkt-line payload of %d bytes exceeds %d", len(s), maxPktLen-4))
+	}
+	return fmt.Sprintf("%04x", len(s)+4) + s
+}
+
+// pktWriteBand frames s as side-band data on band, split into as many
+// pkt-lines of at most maxLen bytes as needed: 1000 with side-band,
+// maxPktLen with side-band-64k.
+func pktWriteBand(band byte, s string, maxLen int) string {
+	chunk := maxLen - 5
+	var b strings.Builder
+	for {
+		n := min(len(s), chunk)
+		b.WriteString(pktWrite(string(band) + s[:n]))
+		s = s[n:]
+		if s == "" {
+			return b.String()
+		}
+	}
+}
+
+func pktFlush() string {
+	return "0000"
+}
+
+// sendFile serves the file at the request path. Only files inside the
+// repository matched by s are served.
+func (gsh GitSmartHTTP) sendFile(s Service, w http.ResponseWriter, r *http.Request, contentType string, hdr map[string]string) {
+	repoPath, ok := gsh.resolveRepo(w, r, s.ParseURLNamedParams(r)["repoPath"])
+	if !ok || !gsh.authorize(w, r, repoPath, uploadPack) {
+		return
+	}
+
+	fullPath, ok := gsh.resolve(w, r, r.URL.Path)
+	if !ok {
+		return
+	}
+	if isObjectService(s) {
+		fullPath = gsh.locateObjectFile(repoPath, fullPath)
+	}
+	gsh.serveFile(s, w, r, fullPath, contentType, hdr)
+}
+
+// serveFile serves the file at fullPath, which was resolved and authorized
+// already.
+func (gsh GitSmartHTTP) serveFile(s Service, w http.ResponseWriter, r *http.Request, fullPath, contentType string, hdr map[string]string) {
+	f, err := os.Open(fullPath)
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain")
+		http.NotFound(w, r)
+		return
+	}
+
+	defer f.Close()
+
+	fInfo, err := f.Stat()
+	if err != nil {
+		fmt.Fprintf(w, "Cannot fetch file %v", err)
+		return
+	}
+	if fInfo.IsDir() {
+		w.Header().Set("Content-Type", "text/plain")
+		http.NotFound(w, r)
+		return
+	}
+
+	if len(gsh.HideRefs) > 0 && isRefListService(s) {
+		data, err := io.ReadAll(f)
+		if err != nil {
+			fmt.Fprintf(w, "Cannot fetch file %v", err)
+			return
+		}
+		serveContent(s, w, r, fInfo, contentType, hdr, bytes.NewReader(gsh.filterHiddenRefs(data)))
+		return
+	}
+
+	serveContent(s, w, r, fInfo, contentType, hdr, f)
+}
+
+// sendPackFile behaves like sendFile but serves pack and idx files through
+// the pack cache when it is enabled.
+func (gsh GitSmartHTTP) sendPackFile(s Service, w http.ResponseWriter, r *http.Request, contentType string, hdr map[string]string) {
+	repoPath, ok := gsh.resolveRepo(w, r, s.ParseURLNamedParams(r)["repoPath"])
+	if !ok || !gsh.authorize(w, r, repoPath, uploadPack) {
+		return
+	}
+
+	fullPath, ok := gsh.resolve(w, r, r.URL.Path)
+	if !ok {
+		return
+	}
+	fullPath = gsh.locateObjectFile(repoPath, fullPath)
+
+	fInfo, err := os.Stat(fullPath)
+	if err != nil || !fInfo.Mode().IsRegular() {
+		if _, dirErr := os.Stat(filepath.Dir(fullPath)); os.IsNotExist(err) && dirErr == nil {
+			packVanished(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		http.NotFound(w, r)
+		return
+	}
+
+	// Packs too large to be cached are streamed instead of read whole.
+	if gsh.packCache == nil || r.Method == "HEAD" || !gsh.packCache.fits(fInfo.Size()) {
+		gsh.serveFile(s, w, r, fullPath, contentType, hdr)
+		return
+	}
+
+	key := fmt.Sprintf("%s:%d:%d", fullPath, fInfo.Size(), fInfo.ModTime().UnixNano())
+	data, err := gsh.packCache.get(key, func() ([]byte, error) {
+		return os.ReadFile(fullPath)
+	})
+	if err != nil {
+		fmt.Fprintf(w, "Cannot fetch file %v", err)
+		return
+	}
+
+	serveContent(s, w, r, fInfo, contentType, hdr, bytes.NewReader(data))
+}
+
+// packVanished answers a request for a pack that is gone from an existing
+// pack directory. That happens when a repack replaced it while a dumb client
+// was still working from the old objects/info/packs, fetching again picks
+// up the new pack names.
+func packVanished(w http.ResponseWriter, r *http.Request) {
+	requestLog(r).Info("Pack vanished, the repository was probably repacked", "pack", r.URL.Path)
+
+	w.Header().Set("Content-Type", "text/plain")
+	setHeaders(w, hdrNoCache())
+	w.WriteHeader(http.StatusNotFound)
+	fmt.Fprintf(w, "%s no longer exists, the repository was probably repacked. Please retry the fetch.\n", path.Base(r.URL.Path))
+}
+
+// serveContent answers r with the file content through http.ServeContent,
+// which takes care of HEAD, Range and conditional requests. The content
+// type is set upfront so it is never sniffed.
+func serveContent(s Service, w http.ResponseWriter, r *http.Request, fInfo os.FileInfo, contentType string, hdr map[string]string, content io.ReadSeeker) {
+	setHeaders(w, hdr)
+	w.Header().Set("Content-Type", contentType)
+	if isObjectService(s) {
+		w.Header().Set("ETag", objectETag(r.URL.Path))
+	}
+
+	http.ServeContent(w, r, "", fInfo.ModTime(), content)
+}
+
+// isService reports whether service names one of the two git services
+// this server runs.
+func isService(service string) bool {
+	return service == uploadPack || service == receivePack
+}
+
+func unknownService(w http.ResponseWriter, r *http.Request, service string) {
+	requestLog(r).Info("Unknown service", "service", service)
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusBadRequest)
+	fmt.Fprintln(w, "Unknown service")
+}
+
+func (gsh GitSmartHTTP) serviceAccess(service string) bool {
+	if service == uploadPack {
+		return gsh.UploadPack
+	}
+
+	if service == receivePack {
+		return gsh.ReceivePack
+	}
+
+	return false
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	if r.Proto == "HTTP/1.1" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	} else {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func hdrNoCache() map[string]string {
+	return map[string]string{
+		"Expires":       "Fri, 01 Jan 1980 00:00:00 GMT",
+		"Pragma":        "no-cache",
+		"Cache-Control": "no-cache, max-age=0, must-revalidate",
+	}
+}
+
+func hdrCacheForever() map[string]string {
+	now := time.Now()
+	expires := now.Add(31536000 * time.Second)
+
+	return map[string]string{
+		"Date":          now.Format(time.RFC850),
+		"Expires":       expires.Format(time.RFC850),
+		"Cache-Control": "public, max-age=31536000",
+	}
+}
+
+func setHeaders(w http.ResponseWriter, hdr map[string]string) {
+	for key, value := range hdr {
+		w.Header().Set(key, value)
+	}
+}
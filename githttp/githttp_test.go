@@ -0,0 +1,362 @@
+package githttp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+)
+
+// TestPackFileAuthorizedOnce fetches a pack through the pack cache and
+// past it, Authorize must be asked once per request.
+func TestPackFileAuthorizedOnce(t *testing.T) {
+	for _, cacheSize := range []int64{0, 1 << 20, 1} {
+		var calls atomic.Int64
+		url, repo := newIntegrationServer(t, Config{
+			PackCacheSize: cacheSize,
+			Authorize: func(user, repoPath, serviceType string) bool {
+				calls.Add(1)
+				return true
+			},
+		})
+
+		work := filepath.Join(t.TempDir(), "work")
+		runGit(t, "", "init", "-q", "-b", "main", work)
+		commitFile(t, work, "1")
+		runGit(t, work, "push", "-q", url, "main")
+		runGit(t, repo, "repack", "-a", "-d", "-q")
+		packs, _ := filepath.Glob(filepath.Join(repo, "objects", "pack", "*.pack"))
+		if len(packs) != 1 {
+			t.Fatalf("packs %v", packs)
+		}
+
+		for _, method := range []string{"GET", "HEAD"} {
+			calls.Store(0)
+			req, _ := http.NewRequest(method, url+"/objects/pack/"+filepath.Base(packs[0]), nil)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("cache %d, %s: %s", cacheSize, method, resp.Status)
+			}
+			if n := calls.Load(); n != 1 {
+				t.Errorf("cache %d, %s: Authorize called %d times, want 1", cacheSize, method, n)
+			}
+		}
+	}
+}
+
+func TestServiceDisabledContentType(t *testing.T) {
+	root := t.TempDir()
+	repo := filepath.Join(root, "repo.git")
+	if err := os.MkdirAll(filepath.Join(repo, "objects"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(repo, "HEAD"), []byte("ref: refs/heads/main\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pushes are disabled.
+	h, err := New(Config{
+		ReposRootPath: root,
+		UploadPack:    true,
+		Logger:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/repo.git/git-receive-pack", strings.NewReader("0000")))
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("%d, want 403", rec.Code)
+	}
+	if ct := rec.Result().Header.Get("Content-Type"); ct != "text/plain" {
+		t.Errorf("Content-Type %q, want text/plain", ct)
+	}
+}
+
+// TestHeadObjectFiles asks for the headers of pack, idx and loose object
+// files without their content.
+func TestHeadObjectFiles(t *testing.T) {
+	url, repo := newIntegrationServer(t, Config{})
+	work := filepath.Join(t.TempDir(), "work")
+	runGit(t, "", "init", "-q", "-b", "main", work)
+	head := commitFile(t, work, "1")
+	runGit(t, work, "push", "-q", url, "main")
+	// Pack the pushed objects, keeping them loose too.
+	runGit(t, repo, "repack", "-a", "-q")
+
+	packs, _ := filepath.Glob(filepath.Join(repo, "objects", "pack", "*.pack"))
+	if len(packs) != 1 {
+		t.Fatalf("packs %v", packs)
+	}
+	pack := strings.TrimPrefix(packs[0], repo)
+	for _, tc := range []struct{ path, contentType string }{
+		{pack, "application/x-git-packed-objects"},
+		{strings.TrimSuffix(pack, ".pack") + ".idx", "application/x-git-packed-objects-toc"},
+		{"/objects/" + head[:2] + "/" + head[2:], "application/x-git-loose-object"},
+	} {
+		fi, err := os.Stat(filepath.Join(repo, tc.path))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := http.Head(url + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK || len(b) != 0 {
+			t.Errorf("HEAD %s: %s, %d bytes of body", tc.path, resp.Status, len(b))
+		}
+		for header, want := range map[string]string{
+			"Content-Length": fmt.Sprint(fi.Size()),
+			"Content-Type":   tc.contentType,
+			"Last-Modified":  fi.ModTime().UTC().Format(http.TimeFormat),
+			"Cache-Control":  "public, max-age=31536000",
+		} {
+			if got := resp.Header.Get(header); got != want {
+				t.Errorf("HEAD %s: %s %q, want %q", tc.path, header, got, want)
+			}
+		}
+	}
+}
+
+var benchPushMB = flag.Int("bench-push-mb", 256, "size of the file pushed by BenchmarkPush in MiB")
+
+// BenchmarkPush pushes a single incompressible file. The request body is
+// streamed into receive-pack, so B/op stays far below the size of the push:
+//
+//	go test -run '^$' -bench Push ./githttp -args -bench-push-mb 512
+func BenchmarkPush(b *testing.B) {
+	gitEnv(b)
+	root := b.TempDir()
+	work := filepath.Join(b.TempDir(), "work")
+	runGit(b, "", "init", "-q", work)
+
+	data := make([]byte, *benchPushMB<<20)
+	rand.Read(data)
+	if err := os.WriteFile(filepath.Join(work, "file"), data, 0o644); err != nil {
+		b.Fatal(err)
+	}
+	runGit(b, work, "-c", "core.compression=0", "add", "file")
+	runGit(b, work, "commit", "-q", "-m", "big")
+	head := runGit(b, work, "rev-parse", "HEAD")
+
+	cmd := exec.Command("git", "-c", "pack.compression=0", "pack-objects", "--revs", "--stdout", "-q")
+	cmd.Dir = work
+	cmd.Stdin = strings.NewReader(head + "\n")
+	pack, err := cmd.Output()
+	if err != nil {
+		b.Fatal(err)
+	}
+	body := pktWrite(strings.Repeat("0", 40)+" "+head+" refs/heads/main\x00report-status\n") + pktFlush() + string(pack)
+
+	h, err := New(Config{
+		ReposRootPath: root,
+		ReceivePack:   true,
+		Logger:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		repo := fmt.Sprintf("repo%d.git", i)
+		runGit(b, "", "init", "-q", "--bare", filepath.Join(root, repo))
+		req := httptest.NewRequest("POST", "/"+repo+"/git-receive-pack", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-git-receive-pack-request")
+		rec := httptest.NewRecorder()
+		b.StartTimer()
+
+		h.ServeHTTP(rec, req)
+		if !bytes.Contains(rec.Body.Bytes(), []byte("ok refs/heads/main")) {
+			b.Fatalf("push failed: %d %q", rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestIsClientGone(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{&net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.EPIPE)}, true},
+		{&net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.ECONNRESET)}, true},
+		{fmt.Errorf("copy: %w", syscall.EPIPE), true},
+		{&net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.ENOSPC)}, false},
+		{io.ErrShortWrite, false},
+		{nil, false},
+	} {
+		if got := isClientGone(tc.err); got != tc.want {
+			t.Errorf("isClientGone(%v) = %t, want %t", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestGitProtocol(t *testing.T) {
+	for _, tc := range []struct {
+		values []string
+		want   string
+	}{
+		{nil, ""},
+		{[]string{"version=2"}, "version=2"},
+		{[]string{"version=1"}, "version=1"},
+		{[]string{"version=0"}, "version=0"},
+		// Multiple values, in one header or several: the highest wins.
+		{[]string{"version=1:version=2"}, "version=2"},
+		{[]string{"version=2, version=1"}, "version=2"},
+		{[]string{"version=1", "version=2"}, "version=2"},
+		// Unknown and malformed values are ignored.
+		{[]string{"version=9"}, ""},
+		{[]string{"version=9:version=1"}, "version=1"},
+		{[]string{"version=2;rm -rf /"}, ""},
+		{[]string{"version=2\x00object-format=sha256"}, ""},
+		{[]string{"version"}, ""},
+		{[]string{" version=2 "}, "version=2"},
+	} {
+		r := httptest.NewRequest("GET", "/repo.git/info/refs", nil)
+		for _, v := range tc.values {
+			r.Header.Add("Git-Protocol", v)
+		}
+		if got := gitProtocol(r); got != tc.want {
+			t.Errorf("Git-Protocol %q: %q, want %q", tc.values, got, tc.want)
+		}
+	}
+}
+
+// TestLooseObjectFormat requests loose objects named for the other object
+// format: they answer 404, even when a file of that name exists.
+func TestLooseObjectFormat(t *testing.T) {
+	gitEnv(t)
+	root := t.TempDir()
+	for _, format := range []string{"sha1", "sha256"} {
+		repo := filepath.Join(root, format+".git")
+		runGit(t, "", "init", "-q", "--bare", "--object-format="+format, repo)
+		oid := runGit(t, repo, "hash-object", "-w", "--stdin")
+
+		// A stray file named like an object of the other format.
+		other := strings.Repeat("c", 62)
+		if format == "sha256" {
+			other = strings.Repeat("c", 38)
+		}
+		if err := os.WriteFile(filepath.Join(repo, "objects", oid[:2], other), []byte("stray"), 0o444); err != nil {
+			t.Fatal(err)
+		}
+
+		h, err := New(Config{
+			ReposRootPath: root,
+			UploadPack:    true,
+			Logger:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for path, want := range map[string]int{
+			"/" + format + ".git/objects/" + oid[:2] + "/" + oid[2:]: http.StatusOK,
+			"/" + format + ".git/objects/" + oid[:2] + "/" + other:   http.StatusNotFound,
+		} {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+			if rec.Code != want {
+				t.Errorf("%s: %d, want %d", path, rec.Code, want)
+			}
+		}
+	}
+}
+
+// TestPackFileRange requests parts of a pack, from disk and through the
+// pack cache.
+func TestPackFileRange(t *testing.T) {
+	for _, cacheSize := range []int64{0, 1 << 20} {
+		url, repo := newIntegrationServer(t, Config{PackCacheSize: cacheSize})
+		work := filepath.Join(t.TempDir(), "work")
+		runGit(t, "", "init", "-q", "-b", "main", work)
+		commitFile(t, work, "1")
+		runGit(t, work, "push", "-q", url, "main")
+		runGit(t, repo, "repack", "-a", "-d", "-q")
+		packs, _ := filepath.Glob(filepath.Join(repo, "objects", "pack", "*.pack"))
+		if len(packs) != 1 {
+			t.Fatalf("packs %v", packs)
+		}
+		pack, err := os.ReadFile(packs[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		packURL := url + "/objects/pack/" + filepath.Base(packs[0])
+
+		get := func(hdr ...string) (*http.Response, []byte) {
+			t.Helper()
+			req, _ := http.NewRequest("GET", packURL, nil)
+			for i := 0; i < len(hdr); i += 2 {
+				req.Header.Set(hdr[i], hdr[i+1])
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			b, _ := io.ReadAll(resp.Body)
+			return resp, b
+		}
+
+		full, _ := get()
+		etag, lastModified := full.Header.Get("ETag"), full.Header.Get("Last-Modified")
+		if etag == "" || lastModified == "" {
+			t.Errorf("cache %d: ETag %q, Last-Modified %q", cacheSize, etag, lastModified)
+		}
+
+		resp, b := get("Range", "bytes=0-3")
+		if resp.StatusCode != http.StatusPartialContent || string(b) != "PACK" {
+			t.Errorf("cache %d, first bytes: %s %q", cacheSize, resp.Status, b)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "application/x-git-packed-objects" {
+			t.Errorf("cache %d: Content-Type %s", cacheSize, ct)
+		}
+		if cr, want := resp.Header.Get("Content-Range"), fmt.Sprintf("bytes 0-3/%d", len(pack)); cr != want {
+			t.Errorf("cache %d: Content-Range %s, want %s", cacheSize, cr, want)
+		}
+
+		// Resuming after the first 100 bytes.
+		resp, b = get("Range", "bytes=100-", "If-Range", etag)
+		if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(b, pack[100:]) {
+			t.Errorf("cache %d, resume: %s, %d bytes", cacheSize, resp.Status, len(b))
+		}
+		// The pack changed since: all of it is sent again.
+		resp, b = get("Range", "bytes=100-", "If-Range", `"other"`)
+		if resp.StatusCode != http.StatusOK || !bytes.Equal(b, pack) {
+			t.Errorf("cache %d, stale If-Range: %s, %d bytes", cacheSize, resp.Status, len(b))
+		}
+
+		if resp, _ = get("Range", fmt.Sprintf("bytes=%d-", len(pack))); resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+			t.Errorf("cache %d, range past the end: %s", cacheSize, resp.Status)
+		}
+		if resp, _ = get("If-None-Match", etag); resp.StatusCode != http.StatusNotModified {
+			t.Errorf("cache %d, If-None-Match: %s", cacheSize, resp.Status)
+		}
+		if resp, _ = get("If-Modified-Since", lastModified); resp.StatusCode != http.StatusNotModified {
+			t.Errorf("cache %d, If-Modified-Since: %s", cacheSize, resp.Status)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package githttp
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// HEAD states reported by headState.
+const (
+	headAttached = "attached"
+	headUnborn   = "unborn"
+	headDetached = "detached"
+)
+
+// headState tells whether HEAD of the repository at repoPath points to an
+// existing branch, to a branch without commits yet, or directly to a
+// commit. Both of the latter advertise without a HEAD symref, which some
+// clients handle poorly.
+func headState(repoPath string) string {
+	b, err := os.ReadFile(filepath.Join(repoPath, "HEAD"))
+	if err != nil {
+		return headAttached
+	}
+
+	ref, ok := strings.CutPrefix(strings.TrimSpace(string(b)), "ref: ")
+	if !ok {
+		return headDetached
+	}
+	if refExists(repoPath, ref) {
+		return headAttached
+	}
+	return headUnborn
+}
+
+// refExists looks for ref as a loose ref and in packed-refs.
+func refExists(repoPath, ref string) bool {
+	if _, err := os.Stat(filepath.Join(repoPath, filepath.FromSlash(ref))); err == nil {
+		return true
+	}
+
+	f, err := os.Open(filepath.Join(repoPath, "packed-refs"))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if strings.HasSuffix(scanner.Text(), " "+ref) {
+			return true
+		}
+	}
+	return false
+}
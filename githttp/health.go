@@ -0,0 +1,96 @@
+package githttp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// defaultHealthCanaryTimeout bounds the canary check when
+// HealthCanaryTimeout is zero.
+const defaultHealthCanaryTimeout = 2 * time.Second
+
+// handleHealth answers 200 when git can be run, the repositories root can
+// be read and the canary repository, if any, can be served, 503 with the
+// reason otherwise.
+func (gsh GitSmartHTTP) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		methodNotAllowed(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	setHeaders(w, hdrNoCache())
+
+	if err := gsh.checkHealth(r.Context()); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, err)
+		return
+	}
+	fmt.Fprintln(w, "ok", gsh.gitVersion())
+}
+
+func (gsh GitSmartHTTP) checkHealth(ctx context.Context) error {
+	bin := gsh.GitBinary
+	if bin == "" {
+		bin = gitBackend
+	}
+	if _, err := exec.LookPath(bin); err != nil {
+		return fmt.Errorf("git not found: %s", err)
+	}
+
+	for _, root := range gsh.roots() {
+		if err := checkReadable(root.Path); err != nil {
+			return fmt.Errorf("repositories root not readable: %s", err)
+		}
+	}
+
+	if gsh.HealthCanary != "" {
+		if err := gsh.checkCanary(ctx); err != nil {
+			return fmt.Errorf("canary repository %s: %s", gsh.HealthCanary, err)
+		}
+	}
+	return nil
+}
+
+// checkCanary advertises the refs of the canary repository the way a fetch
+// does, run with the same configuration.
+func (gsh GitSmartHTTP) checkCanary(ctx context.Context) error {
+	timeout := gsh.HealthCanaryTimeout
+	if timeout == 0 {
+		timeout = defaultHealthCanaryTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	gs := gsh.newGitRPCClient(false)
+	gs.UploadPack(ctx, gsh.HealthCanary, map[string]struct{}{"advertise_refs": {}})
+	out, err := gs.Output()
+	switch {
+	case ctx.Err() != nil:
+		return fmt.Errorf("no refs advertised within %s", timeout)
+	case err != nil:
+		return fmt.Errorf("%s%s", err, exitStderr(err))
+	case len(out) == 0:
+		return errors.New("no refs advertised")
+	}
+	return nil
+}
+
+func checkReadable(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Readdirnames(1); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
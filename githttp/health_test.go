@@ -0,0 +1,67 @@
+package githttp
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealthCanary(t *testing.T) {
+	gitEnv(t)
+	dir := t.TempDir()
+	healthy := filepath.Join(dir, "healthy.git")
+	runGit(t, "", "init", "-q", "--bare", healthy)
+
+	notRepo := filepath.Join(dir, "not-a-repo")
+	if err := os.Mkdir(notRepo, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	// A git that hangs, like one stuck on a slow disk.
+	slowGit := filepath.Join(dir, "slow-git")
+	if err := os.WriteFile(slowGit, []byte("#!/bin/sh\nexec sleep 10\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name, canary, gitBinary string
+		want                    int
+	}{
+		{"healthy", healthy, "", http.StatusOK},
+		{"missing", filepath.Join(dir, "missing.git"), "", http.StatusServiceUnavailable},
+		{"not a repository", notRepo, "", http.StatusServiceUnavailable},
+		{"too slow", healthy, slowGit, http.StatusServiceUnavailable},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h, err := New(Config{
+				ReposRootPath:       dir,
+				HealthPath:          "/healthz",
+				HealthCanary:        tc.canary,
+				HealthCanaryTimeout: 500 * time.Millisecond,
+				GitBinary:           tc.gitBinary,
+				Logger:              slog.New(slog.NewTextHandler(io.Discard, nil)),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			start := time.Now()
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+			if rec.Code != tc.want {
+				t.Errorf("%d %q, want %d", rec.Code, rec.Body, tc.want)
+			}
+			if rec.Code != http.StatusOK && !strings.Contains(rec.Body.String(), "canary repository") {
+				t.Errorf("body %q doesn't name the canary", rec.Body)
+			}
+			if d := time.Since(start); d > 5*time.Second {
+				t.Errorf("health check took %s", d)
+			}
+		})
+	}
+}
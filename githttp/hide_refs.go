@@ -0,0 +1,54 @@
+package githttp
+
+import (
+	"bytes"
+	"strings"
+)
+
+// isRefListService reports whether s serves a file listing refs, which
+// HideRefs applies to like it does to the advertisement.
+func isRefListService(s Service) bool {
+	return s.Name == "packed-refs" || s.Name == "info-refs"
+}
+
+// isHiddenRef reports whether ref is hidden by HideRefs. As with git's
+// transfer.hideRefs, an entry matches the ref itself and the refs below
+// it, the last matching entry wins and entries starting with ! unhide.
+func (gsh GitSmartHTTP) isHiddenRef(ref string) bool {
+	for i := len(gsh.HideRefs) - 1; i >= 0; i-- {
+		prefix, unhide := strings.CutPrefix(gsh.HideRefs[i], "!")
+		prefix = strings.TrimRight(prefix, "/")
+		if rest, ok := strings.CutPrefix(ref, prefix); ok && (rest == "" || rest[0] == '/') {
+			return !unhide
+		}
+	}
+	return false
+}
+
+// filterHiddenRefs drops the hidden refs from the contents of packed-refs
+// or info/refs, along with their peeled lines.
+func (gsh GitSmartHTTP) filterHiddenRefs(data []byte) []byte {
+	var out bytes.Buffer
+	hidden := false
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		switch {
+		case len(line) == 0:
+			continue
+		case line[0] == '#':
+		case line[0] == '^':
+			// packed-refs peels the ref of the line before.
+			if hidden {
+				continue
+			}
+		default:
+			// "<id> <ref>" in packed-refs, "<id>\t<ref>" in info/refs.
+			fields := strings.Fields(string(line))
+			hidden = len(fields) > 1 && gsh.isHiddenRef(strings.TrimSuffix(fields[1], "^{}"))
+			if hidden {
+				continue
+			}
+		}
+		out.Write(line)
+	}
+	return out.Bytes()
+}
@@ -0,0 +1,70 @@
+package githttp
+
+import "testing"
+
+func TestIsHiddenRef(t *testing.T) {
+	gsh := GitSmartHTTP{GitSmartHTTPConfig: &GitSmartHTTPConfig{
+		HideRefs: []string{"refs/internal/", "!refs/internal/public", "refs/heads/secret"},
+	}}
+	for ref, want := range map[string]bool{
+		"refs/internal/a":         true,
+		"refs/internal/a/b":       true,
+		"refs/internal/public":    false,
+		"refs/internal/public/x":  false,
+		"refs/internal/publicity": true,
+		"refs/internalize":        false,
+		"refs/heads/secret":       true,
+		"refs/heads/secrets":      false,
+		"refs/heads/main":         false,
+	} {
+		if got := gsh.isHiddenRef(ref); got != want {
+			t.Errorf("isHiddenRef(%s) = %t, want %t", ref, got, want)
+		}
+	}
+}
+
+func TestFilterHiddenRefs(t *testing.T) {
+	gsh := GitSmartHTTP{GitSmartHTTPConfig: &GitSmartHTTPConfig{
+		HideRefs: []string{"refs/internal"},
+	}}
+
+	packed := "# pack-refs with: peeled fully-peeled sorted \n" +
+		oidA + " refs/heads/main\n" +
+		oidA + " refs/internal/tag\n" +
+		"^" + oidB + "\n" +
+		oidB + " refs/tags/v1\n" +
+		"^" + oidA + "\n"
+	want := "# pack-refs with: peeled fully-peeled sorted \n" +
+		oidA + " refs/heads/main\n" +
+		oidB + " refs/tags/v1\n" +
+		"^" + oidA + "\n"
+	if got := string(gsh.filterHiddenRefs([]byte(packed))); got != want {
+		t.Errorf("packed-refs filtered to\n%s\nwant\n%s", got, want)
+	}
+
+	infoRefs := oidA + "\trefs/heads/main\n" +
+		oidA + "\trefs/internal/tag\n" +
+		oidB + "\trefs/internal/tag^{}\n" +
+		oidB + "\trefs/tags/v1\n" +
+		oidA + "\trefs/tags/v1^{}"
+	want = oidA + "\trefs/heads/main\n" +
+		oidB + "\trefs/tags/v1\n" +
+		oidA + "\trefs/tags/v1^{}"
+	if got := string(gsh.filterHiddenRefs([]byte(infoRefs))); got != want {
+		t.Errorf("info/refs filtered to\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestValidatePromisorHideRefs(t *testing.T) {
+	for _, cfg := range []Config{
+		{Promisor: true},
+		{HideRefs: []string{"refs/internal/"}},
+		{Promisor: true, HideRefs: []string{"refs/internal/"}},
+	} {
+		cfg.ReposRootPath = t.TempDir()
+		err := cfg.Validate()
+		if want := cfg.Promisor && len(cfg.HideRefs) > 0; (err != nil) != want {
+			t.Errorf("Promisor %t, HideRefs %v: err = %v", cfg.Promisor, cfg.HideRefs, err)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package githttp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// idleTimeoutReader wraps a request body and pushes the connection's read
+// deadline forward before every Read, so a client that stalls for longer
+// than timeout makes the Read fail instead of blocking forever.
+type idleTimeoutReader struct {
+	r       io.Reader
+	rc      *http.ResponseController
+	timeout time.Duration
+}
+
+// newIdleTimeoutReader returns r unchanged when timeout is not positive.
+func newIdleTimeoutReader(w http.ResponseWriter, r io.Reader, timeout time.Duration) io.Reader {
+	if timeout <= 0 {
+		return r
+	}
+
+	return &idleTimeoutReader{
+		r:       r,
+		rc:      http.NewResponseController(w),
+		timeout: timeout,
+	}
+}
+
+func (ir *idleTimeoutReader) Read(p []byte) (int, error) {
+	err := ir.rc.SetReadDeadline(time.Now().Add(ir.timeout))
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return 0, err
+	}
+
+	n, err := ir.r.Read(p)
+	if err == io.EOF {
+		// The body is done, clear the deadline so it doesn't fire while the
+		// response is still being written.
+		ir.rc.SetReadDeadline(time.Time{})
+	}
+	return n, err
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
@@ -0,0 +1,1033 @@
+package githttp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer safe to log to from the handler while the
+// test reads it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// gitEnv isolates the git clients and the server's git processes from the
+// user's configuration.
+func gitEnv(t testing.TB) string {
+	t.Helper()
+	gitBinary, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git is not installed")
+	}
+
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, ".config"))
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	t.Setenv("GIT_TERMINAL_PROMPT", "0")
+	for _, kv := range [][2]string{
+		{"user.name", "integration"},
+		{"user.email", "integration@example.com"},
+		{"init.defaultBranch", "main"},
+	} {
+		runGit(t, "", "config", "--global", kv[0], kv[1])
+	}
+	return gitBinary
+}
+
+// runGit runs git in dir and returns its trimmed output, failing the test
+// if it fails.
+func runGit(t testing.TB, dir string, args ...string) string {
+	t.Helper()
+	out, err := gitCmd(dir, args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %s\n%s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func gitCmd(dir string, args ...string) *exec.Cmd {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	return cmd
+}
+
+// newIntegrationServer serves an empty bare repository repo.git with cfg,
+// returning its URL and its path. The test fails if the server logged an
+// error, unless cfg brings a Logger of its own.
+func newIntegrationServer(t *testing.T, cfg Config) (string, string) {
+	t.Helper()
+	gitBinary := gitEnv(t)
+	if cfg.GitBinary == "" {
+		cfg.GitBinary = gitBinary
+	}
+
+	root := t.TempDir()
+	repo := filepath.Join(root, "repo.git")
+	runGit(t, "", "init", "-q", "--bare", repo)
+
+	logs := &syncBuffer{}
+	cfg.ReposRootPath = root
+	cfg.ReceivePack, cfg.UploadPack = true, true
+	if cfg.Logger == nil {
+		cfg.Logger = slog.New(slog.NewTextHandler(logs, nil))
+	}
+	h, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(h)
+	t.Cleanup(func() {
+		srv.Close()
+		if strings.Contains(logs.String(), "level=ERROR") {
+			t.Errorf("server logged errors:\n%s", logs)
+		}
+	})
+	return srv.URL + "/repo.git", repo
+}
+
+// commitFile commits content to file in the work tree dir.
+func commitFile(t *testing.T, dir, content string) string {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, "file"), []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, dir, "add", "file")
+	runGit(t, dir, "commit", "-q", "-m", "commit "+content)
+	return runGit(t, dir, "rev-parse", "HEAD")
+}
+
+func TestIntegration(t *testing.T) {
+	url, _ := newIntegrationServer(t, Config{})
+	work := t.TempDir()
+	a := filepath.Join(work, "a")
+
+	runGit(t, "", "clone", "-q", url, a)
+	for _, n := range []string{"1", "2", "3"} {
+		commitFile(t, a, n)
+	}
+	runGit(t, a, "push", "-q", "origin", "main")
+	head := runGit(t, a, "rev-parse", "HEAD")
+
+	for _, v := range []string{"0", "2"} {
+		clone := filepath.Join(work, "v"+v)
+		runGit(t, "", "-c", "protocol.version="+v, "clone", "-q", url, clone)
+		if got := runGit(t, clone, "rev-parse", "HEAD"); got != head {
+			t.Errorf("clone, protocol v%s: HEAD %s, want %s", v, got, head)
+		}
+		runGit(t, clone, "fsck", "--strict")
+
+		shallow := filepath.Join(work, "s"+v)
+		runGit(t, "", "-c", "protocol.version="+v, "clone", "-q", "--depth", "1", url, shallow)
+		if n := runGit(t, shallow, "rev-list", "--count", "HEAD"); n != "1" {
+			t.Errorf("shallow clone, protocol v%s: %s commits, want 1", v, n)
+		}
+		runGit(t, shallow, "-c", "protocol.version="+v, "fetch", "-q", "--unshallow")
+		if n := runGit(t, shallow, "rev-list", "--count", "HEAD"); n != "3" {
+			t.Errorf("unshallow, protocol v%s: %s commits, want 3", v, n)
+		}
+	}
+
+	head = commitFile(t, a, "4")
+	runGit(t, a, "push", "-q", "origin", "main")
+	for _, v := range []string{"0", "2"} {
+		clone := filepath.Join(work, "v"+v)
+		runGit(t, clone, "-c", "protocol.version="+v, "pull", "-q", "--ff-only")
+		if got := runGit(t, clone, "rev-parse", "HEAD"); got != head {
+			t.Errorf("fetch, protocol v%s: HEAD %s, want %s", v, got, head)
+		}
+	}
+
+	dumb := filepath.Join(work, "dumb")
+	cmd := gitCmd("", "clone", "-q", url, dumb)
+	cmd.Env = append(os.Environ(), "GIT_SMART_HTTP=0")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("dumb clone: %s\n%s", err, out)
+	}
+	if got := runGit(t, dumb, "rev-parse", "HEAD"); got != head {
+		t.Errorf("dumb clone: HEAD %s, want %s", got, head)
+	}
+
+	runGit(t, a, "push", "-q", "origin", "main:topic")
+	runGit(t, a, "push", "-q", "origin", ":topic")
+}
+
+// TestIntegrationShallowPush pushes from a shallow clone, which sends
+// shallow lines ahead of the commands, with every receive-pack check on.
+func TestIntegrationShallowPush(t *testing.T) {
+	url, _ := newIntegrationServer(t, Config{
+		DenySymrefUpdates: true,
+		DenyDeleteAll:     true,
+	})
+	work := t.TempDir()
+	a := filepath.Join(work, "a")
+
+	runGit(t, "", "clone", "-q", url, a)
+	commitFile(t, a, "1")
+	commitFile(t, a, "2")
+	runGit(t, a, "push", "-q", "origin", "main")
+
+	shallow := filepath.Join(work, "shallow")
+	runGit(t, "", "clone", "-q", "--depth", "1", url, shallow)
+	head := commitFile(t, shallow, "3")
+	runGit(t, shallow, "push", "-q", "origin", "main")
+
+	if got := runGit(t, a, "ls-remote", "origin", "refs/heads/main"); !strings.HasPrefix(got, head) {
+		t.Errorf("main is %q after the shallow push, want %s", got, head)
+	}
+}
+
+// TestIntegrationDenyDeleteAll deletes every branch, refused unless the
+// push carries the override option.
+func TestIntegrationDenyDeleteAll(t *testing.T) {
+	url, _ := newIntegrationServer(t, Config{DenyDeleteAll: true})
+	a := filepath.Join(t.TempDir(), "a")
+
+	runGit(t, "", "clone", "-q", url, a)
+	commitFile(t, a, "1")
+	// Not the current branch, which git refuses to delete by itself.
+	runGit(t, a, "push", "-q", "origin", "main:topic")
+
+	if out, err := gitCmd(a, "push", "-q", "origin", ":topic").CombinedOutput(); err == nil {
+		t.Fatalf("deleting every ref succeeded:\n%s", out)
+	}
+	if got := runGit(t, a, "ls-remote", "origin"); got == "" {
+		t.Fatal("refs were deleted")
+	}
+
+	runGit(t, a, "push", "-q", "-o", AllowDeleteAll, "origin", ":topic")
+	if got := runGit(t, a, "ls-remote", "--heads", "origin"); got != "" {
+		t.Errorf("refs left after the override: %s", got)
+	}
+}
+
+// signingKey makes an SSH key in dir for signing push certificates and
+// returns its path and the allowed signers line trusting it for email.
+func signingKey(t *testing.T, dir, name, email string) (string, string) {
+	t.Helper()
+	key := filepath.Join(dir, name)
+	if out, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", "", "-f", key).CombinedOutput(); err != nil {
+		t.Fatalf("ssh-keygen: %s\n%s", err, out)
+	}
+	pub, err := os.ReadFile(key + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, email + " " + strings.TrimSpace(string(pub)) + "\n"
+}
+
+// TestIntegrationSignedPush pushes without a push certificate, with one
+// signed by an untrusted key and with trusted ones under RequireSignedPush.
+// The nonces are handed out by the advertisement and checked by a separate
+// receive-pack process, concurrent pushes each get one of their own.
+func TestIntegrationSignedPush(t *testing.T) {
+	url, repo := newIntegrationServer(t, Config{RequireSignedPush: true})
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skip("ssh-keygen is not installed")
+	}
+
+	work := t.TempDir()
+	trusted, allowed := signingKey(t, work, "trusted", "integration@example.com")
+	untrusted, _ := signingKey(t, work, "untrusted", "integration@example.com")
+	allowedSigners := filepath.Join(work, "allowed_signers")
+	if err := os.WriteFile(allowedSigners, []byte(allowed), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// The server's git shares the test's global config.
+	runGit(t, "", "config", "--global", "gpg.ssh.allowedSignersFile", allowedSigners)
+
+	// The repository's own hook runs once the certificate is verified, it
+	// records what git made of the nonce.
+	statuses := filepath.Join(work, "nonce-status")
+	hook := "#!/bin/sh\necho \"$GIT_PUSH_CERT_NONCE_STATUS\" >>" + statuses + "\n"
+	if err := os.WriteFile(filepath.Join(repo, "hooks", "pre-receive"), []byte(hook), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	a := filepath.Join(work, "a")
+	runGit(t, "", "clone", "-q", url, a)
+	runGit(t, a, "config", "gpg.format", "ssh")
+	commitFile(t, a, "1")
+
+	if out, err := gitCmd(a, "push", "-q", "origin", "main").CombinedOutput(); err == nil {
+		t.Fatalf("unsigned push succeeded:\n%s", out)
+	} else if !strings.Contains(string(out), "signed") {
+		t.Errorf("unsigned push rejected without saying why:\n%s", out)
+	}
+
+	runGit(t, a, "config", "user.signingKey", untrusted)
+	if out, err := gitCmd(a, "push", "-q", "--signed", "origin", "main").CombinedOutput(); err == nil {
+		t.Fatalf("push signed by an untrusted key succeeded:\n%s", out)
+	} else if !strings.Contains(string(out), "push certificate rejected") {
+		t.Errorf("untrusted push rejected without saying why:\n%s", out)
+	}
+	if _, err := os.Stat(statuses); err == nil {
+		t.Error("the repository's hook ran for a rejected certificate")
+	}
+
+	runGit(t, a, "config", "user.signingKey", trusted)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if out, err := gitCmd(a, "push", "-q", "--signed", "origin", fmt.Sprintf("main:branch%d", i)).CombinedOutput(); err != nil {
+				t.Errorf("signed push %d: %s\n%s", i, err, out)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	b, err := os.ReadFile(statuses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Fields(string(b)); len(got) != 4 || strings.Count(string(b), "OK") != 4 {
+		t.Errorf("nonce statuses %q, want 4 OK", got)
+	}
+}
+
+// TestIntegrationSignedPushPerRepo overrides RequireSignedPush with the
+// http.requireSignedPush config of the repository.
+func TestIntegrationSignedPushPerRepo(t *testing.T) {
+	for _, tc := range []struct {
+		global bool
+		repo   string
+		signed bool
+	}{
+		{false, "", false},
+		{false, "true", true},
+		{true, "false", false},
+		{true, "", true},
+	} {
+		url, repo := newIntegrationServer(t, Config{RequireSignedPush: tc.global})
+		if tc.repo != "" {
+			runGit(t, repo, "config", "http.requireSignedPush", tc.repo)
+		}
+
+		a := filepath.Join(t.TempDir(), "a")
+		runGit(t, "", "clone", "-q", url, a)
+		commitFile(t, a, "1")
+		out, err := gitCmd(a, "push", "-q", "origin", "main").CombinedOutput()
+		if (err != nil) != tc.signed {
+			t.Errorf("flag %v, repository %q: unsigned push error %v\n%s", tc.global, tc.repo, err, out)
+		}
+	}
+}
+
+// TestIntegrationStrippedGitProtocol clones over protocol v2 through a
+// proxy dropping Git-Protocol from the RPC requests, but not from the
+// advertisement.
+func TestIntegrationStrippedGitProtocol(t *testing.T) {
+	gitBinary := gitEnv(t)
+	root := t.TempDir()
+	repo := filepath.Join(root, "repo.git")
+	runGit(t, "", "init", "-q", "--bare", repo)
+
+	logs := &syncBuffer{}
+	strip := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "POST" {
+				r.Header.Del("Git-Protocol")
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	h, err := New(Config{
+		ReposRootPath: root,
+		UploadPack:    true,
+		ReceivePack:   true,
+		GitBinary:     gitBinary,
+		Logger:        slog.New(slog.NewTextHandler(logs, nil)),
+		Middlewares:   []Middleware{strip},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	url := srv.URL + "/repo.git"
+
+	work := t.TempDir()
+	a := filepath.Join(work, "a")
+	runGit(t, "", "init", "-q", "-b", "main", a)
+	head := commitFile(t, a, "1")
+	runGit(t, a, "push", "-q", url, "main")
+
+	clone := filepath.Join(work, "v2")
+	runGit(t, "", "-c", "protocol.version=2", "clone", "-q", url, clone)
+	if got := runGit(t, clone, "rev-parse", "HEAD"); got != head {
+		t.Errorf("clone: HEAD %s, want %s", got, head)
+	}
+	if !strings.Contains(logs.String(), "without a Git-Protocol") {
+		t.Errorf("no warning logged:\n%s", logs)
+	}
+
+	// v0 requests are left alone.
+	before := strings.Count(logs.String(), "warning=")
+	runGit(t, "", "-c", "protocol.version=0", "clone", "-q", url, filepath.Join(work, "v0"))
+	if strings.Count(logs.String(), "warning=") != before {
+		t.Errorf("v0 clone logged a warning:\n%s", logs)
+	}
+}
+
+// TestIntegrationFailingPostReceive pushes to a repository whose
+// post-receive hook fails after the refs were updated: the push succeeds
+// and the client sees what the hook printed.
+func TestIntegrationFailingPostReceive(t *testing.T) {
+	url, repo := newIntegrationServer(t, Config{})
+	hook := "#!/bin/sh\necho post-receive failed on purpose >&2\nexit 1\n"
+	if err := os.WriteFile(filepath.Join(repo, "hooks", "post-receive"), []byte(hook), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	a := filepath.Join(t.TempDir(), "a")
+	runGit(t, "", "clone", "-q", url, a)
+	head := commitFile(t, a, "1")
+	out, err := gitCmd(a, "push", "origin", "main").CombinedOutput()
+	if err != nil {
+		t.Fatalf("push: %s\n%s", err, out)
+	}
+	if !strings.Contains(string(out), "remote: post-receive failed on purpose") {
+		t.Errorf("hook output missing:\n%s", out)
+	}
+	if got := runGit(t, a, "ls-remote", "origin", "refs/heads/main"); !strings.HasPrefix(got, head) {
+		t.Errorf("main is %q, want %s", got, head)
+	}
+}
+
+// TestIntegrationChunkedPush pushes packs larger than http.postBuffer,
+// which git sends chunked without a Content-Length. MaxBodyBytes is
+// enforced while the body streams in.
+func TestIntegrationChunkedPush(t *testing.T) {
+	var chunked sync.Map
+	record := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "POST" && r.ContentLength == -1 {
+				chunked.Store(r.URL.Path, true)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	url, _ := newIntegrationServer(t, Config{MaxBodyBytes: 512 << 10, Middlewares: []Middleware{record}})
+
+	a := filepath.Join(t.TempDir(), "a")
+	runGit(t, "", "clone", "-q", url, a)
+	push := func(size int) ([]byte, error) {
+		data := make([]byte, size)
+		rand.Read(data)
+		if err := os.WriteFile(filepath.Join(a, "blob"), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		runGit(t, a, "add", "blob")
+		runGit(t, a, "commit", "-q", "-m", fmt.Sprint(size))
+		return gitCmd(a, "-c", "http.postBuffer=65536", "push", "-q", "origin", "main").CombinedOutput()
+	}
+
+	if out, err := push(256 << 10); err != nil {
+		t.Fatalf("push: %s\n%s", err, out)
+	}
+	if _, ok := chunked.Load("/repo.git/git-receive-pack"); !ok {
+		t.Fatal("the push was not sent chunked")
+	}
+	head := runGit(t, a, "rev-parse", "HEAD")
+
+	if out, err := push(1 << 20); err == nil {
+		t.Fatalf("push over MaxBodyBytes succeeded:\n%s", out)
+	}
+	if got := runGit(t, a, "ls-remote", "origin", "refs/heads/main"); !strings.HasPrefix(got, head) {
+		t.Errorf("main is %q after the refused push, want %s", got, head)
+	}
+}
+
+// TestIntegrationReportStatusV2 pushes two refs, one of them refused by
+// the update hook, and checks the client negotiated report-status-v2 and
+// got a result for each ref.
+func TestIntegrationReportStatusV2(t *testing.T) {
+	url, repo := newIntegrationServer(t, Config{})
+	hook := "#!/bin/sh\n[ \"$1\" != refs/heads/blocked ]\n"
+	if err := os.WriteFile(filepath.Join(repo, "hooks", "update"), []byte(hook), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	a := filepath.Join(t.TempDir(), "a")
+	runGit(t, "", "clone", "-q", url, a)
+	commitFile(t, a, "1")
+	cmd := gitCmd(a, "push", "--porcelain", "origin", "main", "main:blocked")
+	cmd.Env = append(cmd.Environ(), "GIT_TRACE_PACKET=1")
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Fatalf("push to the blocked ref succeeded:\n%s", out)
+	}
+	if !regexp.MustCompile(`git> 0+ [0-9a-f]+ refs/heads/main\\0[^\n]* report-status-v2`).Match(out) {
+		t.Errorf("report-status-v2 not requested:\n%s", out)
+	}
+	for _, want := range []string{
+		"git< ok refs/heads/main",
+		"git< ng refs/heads/blocked hook declined",
+		"*\trefs/heads/main:refs/heads/main\t[new branch]",
+		"!\trefs/heads/main:refs/heads/blocked\t[remote rejected] (hook declined)",
+	} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("%q missing from:\n%s", want, out)
+		}
+	}
+}
+
+// TestIntegrationShallowSinceExclude makes shallow clones cut by date and
+// by ref, which send deepen-since and deepen-not.
+func TestIntegrationShallowSinceExclude(t *testing.T) {
+	url, _ := newIntegrationServer(t, Config{})
+	work := t.TempDir()
+	a := filepath.Join(work, "a")
+
+	runGit(t, "", "clone", "-q", url, a)
+	for _, year := range []string{"2020", "2021", "2022", "2023"} {
+		if err := os.WriteFile(filepath.Join(a, "file"), []byte(year), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		runGit(t, a, "add", "file")
+		cmd := gitCmd(a, "commit", "-q", "-m", year)
+		date := year + "-01-01T00:00:00Z"
+		cmd.Env = append(cmd.Environ(), "GIT_AUTHOR_DATE="+date, "GIT_COMMITTER_DATE="+date)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("commit: %s\n%s", err, out)
+		}
+		if year == "2021" {
+			runGit(t, a, "tag", "v1")
+		}
+	}
+	runGit(t, a, "push", "-q", "--tags", "origin", "main")
+
+	for _, v := range []string{"0", "2"} {
+		for _, opt := range []string{"--shallow-since=2021-06-01", "--shallow-exclude=v1"} {
+			clone := filepath.Join(work, "v"+v+opt)
+			runGit(t, "", "-c", "protocol.version="+v, "clone", "-q", opt, url, clone)
+			if got := runGit(t, clone, "log", "--format=%s"); got != "2023\n2022" {
+				t.Errorf("clone %s, protocol v%s: commits %q, want 2023 and 2022", opt, v, got)
+			}
+		}
+	}
+}
+
+// TestIntegrationRelativeSubmodule clones a repository whose submodule is
+// served next to it and referenced by a relative URL.
+func TestIntegrationRelativeSubmodule(t *testing.T) {
+	url, repo := newIntegrationServer(t, Config{})
+	subURL := strings.TrimSuffix(url, "/repo.git") + "/libs/sub.git"
+	runGit(t, "", "init", "-q", "--bare", filepath.Join(filepath.Dir(repo), "libs", "sub.git"))
+
+	work := t.TempDir()
+	sub := filepath.Join(work, "sub")
+	runGit(t, "", "clone", "-q", subURL, sub)
+	subHead := commitFile(t, sub, "sub")
+	runGit(t, sub, "push", "-q", "origin", "main")
+
+	a := filepath.Join(work, "a")
+	runGit(t, "", "clone", "-q", url, a)
+	runGit(t, a, "submodule", "add", "-q", "../libs/sub.git", "sub")
+	runGit(t, a, "commit", "-q", "-m", "add submodule")
+	runGit(t, a, "push", "-q", "origin", "main")
+
+	clone := filepath.Join(work, "clone")
+	runGit(t, "", "clone", "-q", "--recurse-submodules", url, clone)
+	if got := runGit(t, filepath.Join(clone, "sub"), "rev-parse", "HEAD"); got != subHead {
+		t.Errorf("submodule HEAD %s, want %s", got, subHead)
+	}
+	if got := runGit(t, clone, "config", "submodule.sub.url"); got != subURL {
+		t.Errorf("submodule URL %s, want %s", got, subURL)
+	}
+}
+
+// TestIntegrationConnectionReuse sends the requests of a fetch over one
+// keep-alive connection: the streamed RPC responses must leave it usable.
+func TestIntegrationConnectionReuse(t *testing.T) {
+	url, _ := newIntegrationServer(t, Config{})
+	a := filepath.Join(t.TempDir(), "a")
+	runGit(t, "", "clone", "-q", url, a)
+	head := commitFile(t, a, "1")
+	runGit(t, a, "push", "-q", "origin", "main")
+
+	client := &http.Client{Transport: &http.Transport{}}
+	defer client.CloseIdleConnections()
+
+	fetch := pktWrite("command=fetch\n") + "0001" + pktWrite("want "+head+"\n") + pktWrite("done\n") + pktFlush()
+	for i, req := range []struct{ method, path, body string }{
+		{"GET", "/info/refs?service=git-upload-pack", ""},
+		{"POST", "/git-upload-pack", pktWrite("command=ls-refs\n") + pktFlush()},
+		{"POST", "/git-upload-pack", fetch},
+		{"GET", "/info/refs?service=git-upload-pack", ""},
+	} {
+		r, _ := http.NewRequest(req.method, url+req.path, strings.NewReader(req.body))
+		r.Header.Set("Git-Protocol", "version=2")
+		if req.method == "POST" {
+			r.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+		}
+		var reused bool
+		r = r.WithContext(httptrace.WithClientTrace(r.Context(), &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) { reused = info.Reused },
+		}))
+
+		resp, err := client.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || len(b) == 0 {
+			t.Fatalf("%s %s: %s %q", req.method, req.path, resp.Status, b)
+		}
+		if resp.Close {
+			t.Errorf("%s %s: connection closed by the server", req.method, req.path)
+		}
+		if i > 0 && !reused {
+			t.Errorf("%s %s: new connection, want the previous one reused", req.method, req.path)
+		}
+	}
+}
+
+// TestIntegrationProgress clones with and without progress: the remote's
+// progress must come through on the sideband when asked for, and its
+// absence must not upset the server.
+func TestIntegrationProgress(t *testing.T) {
+	url, _ := newIntegrationServer(t, Config{})
+	work := t.TempDir()
+	a := filepath.Join(work, "a")
+	runGit(t, "", "clone", "-q", url, a)
+	commitFile(t, a, "1")
+	runGit(t, a, "push", "-q", "origin", "main")
+
+	for _, v := range []string{"0", "2"} {
+		for _, progress := range []string{"--progress", "--no-progress"} {
+			cmd := gitCmd("", "-c", "protocol.version="+v, "clone", progress, url, filepath.Join(work, v+progress))
+			cmd.Env = append(cmd.Environ(), "GIT_PROGRESS_DELAY=0")
+			out, err := cmd.CombinedOutput()
+			if err != nil {
+				t.Fatalf("clone %s, protocol v%s: %s\n%s", progress, v, err, out)
+			}
+			if got, want := strings.Contains(string(out), "remote: Enumerating objects"), progress == "--progress"; got != want {
+				t.Errorf("clone %s, protocol v%s: remote progress shown %t, want %t:\n%s", progress, v, got, want, out)
+			}
+		}
+	}
+}
+
+// TestIntegrationGitFileDescriptors runs git through a wrapper recording
+// the file descriptors it inherits: the listener and client connections
+// must not be among them.
+func TestIntegrationGitFileDescriptors(t *testing.T) {
+	if _, err := os.Stat("/proc/self/fd"); err != nil {
+		t.Skip("no /proc/self/fd")
+	}
+	gitBinary, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git is not installed")
+	}
+	dir := t.TempDir()
+	fds := filepath.Join(dir, "fds")
+	wrapper := filepath.Join(dir, "git")
+	script := fmt.Sprintf("#!/bin/sh\nfor fd in /proc/$$/fd/*; do echo \"$fd $(readlink $fd)\"; done >> %s\nexec %s \"$@\"\n", fds, gitBinary)
+	if err := os.WriteFile(wrapper, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	url, _ := newIntegrationServer(t, Config{GitBinary: wrapper})
+	a := filepath.Join(t.TempDir(), "a")
+	runGit(t, "", "clone", "-q", url, a)
+	commitFile(t, a, "1")
+	runGit(t, a, "push", "-q", "origin", "main")
+
+	b, err := os.ReadFile(fds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "pipe:") {
+		t.Fatalf("no pipes recorded, is the wrapper run?\n%s", b)
+	}
+	if strings.Contains(string(b), "socket:") {
+		t.Errorf("git inherited sockets:\n%s", b)
+	}
+}
+
+// TestIntegrationStalledPush sends part of a push body and stalls: the
+// request is aborted after BodyIdleTimeout instead of holding git forever.
+func TestIntegrationStalledPush(t *testing.T) {
+	url, _ := newIntegrationServer(t, Config{BodyIdleTimeout: 200 * time.Millisecond})
+	host := strings.TrimPrefix(strings.TrimSuffix(url, "/repo.git"), "http://")
+
+	conn, err := net.Dial("tcp", host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	command := pktWrite(strings.Repeat("0", 40) + " " + strings.Repeat("1", 40) + " refs/heads/main\x00report-status\n")
+	partial := command[:len(command)/2]
+	fmt.Fprintf(conn, "POST /repo.git/git-receive-pack HTTP/1.1\r\nHost: %s\r\n"+
+		"Content-Type: application/x-git-receive-pack-request\r\nTransfer-Encoding: chunked\r\n\r\n"+
+		"%x\r\n%s\r\n", host, len(partial), partial)
+
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("no response to the stalled push: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestTimeout {
+		t.Errorf("stalled push: %s, want 408", resp.Status)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("stalled push answered after %s", d)
+	}
+}
+
+// TestIntegrationDenySymrefUpdates pushes through a symbolic ref, which
+// DenySymrefUpdates rejects.
+func TestIntegrationDenySymrefUpdates(t *testing.T) {
+	for _, deny := range []bool{false, true} {
+		url, repo := newIntegrationServer(t, Config{DenySymrefUpdates: deny})
+		a := filepath.Join(t.TempDir(), "a")
+		runGit(t, "", "clone", "-q", url, a)
+		first := commitFile(t, a, "1")
+		runGit(t, a, "push", "-q", "origin", "main")
+		runGit(t, repo, "symbolic-ref", "refs/heads/alias", "refs/heads/main")
+
+		head := commitFile(t, a, "2")
+		out, err := gitCmd(a, "push", "origin", "main:alias").CombinedOutput()
+		want := head
+		if deny {
+			want = first
+			if err == nil || !strings.Contains(string(out), "symbolic ref") {
+				t.Errorf("push to a symbolic ref not rejected:\n%s", out)
+			}
+		} else if err != nil {
+			t.Errorf("push to a symbolic ref: %s\n%s", err, out)
+		}
+		if got := runGit(t, repo, "rev-parse", "refs/heads/main"); got != want {
+			t.Errorf("deny %t: main is %s, want %s", deny, got, want)
+		}
+	}
+}
+
+// TestIntegrationHideRefsV2 checks that protocol v2 ls-refs hides the same
+// refs as the v0 advertisement, also when the client asks for them by
+// prefix.
+func TestIntegrationHideRefsV2(t *testing.T) {
+	url, repo := newIntegrationServer(t, Config{HideRefs: []string{"refs/internal/", "!refs/internal/public"}})
+	a := filepath.Join(t.TempDir(), "a")
+	runGit(t, "", "clone", "-q", url, a)
+	head := commitFile(t, a, "1")
+	runGit(t, a, "push", "-q", "origin", "main")
+	runGit(t, repo, "update-ref", "refs/internal/secret", head)
+	runGit(t, repo, "update-ref", "refs/internal/public", head)
+
+	for _, version := range []string{"0", "2"} {
+		all := runGit(t, a, "-c", "protocol.version="+version, "ls-remote", "origin")
+		prefixed := runGit(t, a, "-c", "protocol.version="+version, "ls-remote", "origin", "refs/internal/*")
+		for _, out := range []string{all, prefixed} {
+			if strings.Contains(out, "refs/internal/secret") || !strings.Contains(out, "refs/internal/public") {
+				t.Errorf("protocol v%s advertised:\n%s", version, out)
+			}
+		}
+		if !strings.Contains(all, "refs/heads/main") {
+			t.Errorf("protocol v%s didn't advertise main:\n%s", version, all)
+		}
+
+		out, err := gitCmd(a, "-c", "protocol.version="+version, "fetch", "origin", "refs/internal/secret").CombinedOutput()
+		if err == nil {
+			t.Errorf("protocol v%s fetched a hidden ref by name:\n%s", version, out)
+		}
+	}
+}
+
+// TestIntegrationClientGoneMidClone resets the connection while a pack is
+// being sent: git is reaped and the abort logged as routine.
+func TestIntegrationClientGoneMidClone(t *testing.T) {
+	m := newFakeMetrics()
+	logs := &syncBuffer{}
+	url, _ := newIntegrationServer(t, Config{Metrics: m, Logger: slog.New(slog.NewTextHandler(logs, nil))})
+
+	a := filepath.Join(t.TempDir(), "a")
+	runGit(t, "", "clone", "-q", url, a)
+	data := make([]byte, 8<<20)
+	rand.Read(data)
+	if err := os.WriteFile(filepath.Join(a, "big"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, a, "add", "big")
+	runGit(t, a, "commit", "-q", "-m", "big")
+	head := runGit(t, a, "rev-parse", "HEAD")
+	runGit(t, a, "push", "-q", "origin", "main")
+
+	host := strings.TrimPrefix(strings.TrimSuffix(url, "/repo.git"), "http://")
+	conn, err := net.Dial("tcp", host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := pktWrite("want "+head+"\n") + pktFlush() + pktWrite("done\n")
+	fmt.Fprintf(conn, "POST /repo.git/git-upload-pack HTTP/1.1\r\nHost: %s\r\nContent-Type: application/x-git-upload-pack-request\r\nContent-Length: %d\r\n\r\n%s", host, len(body), body)
+
+	// Read the start of the pack, then reset the connection.
+	if _, err := io.ReadFull(conn, make([]byte, 64<<10)); err != nil {
+		t.Fatal(err)
+	}
+	conn.(*net.TCPConn).SetLinger(0)
+	conn.Close()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		m.mu.Lock()
+		inFlight := m.inFlight
+		m.mu.Unlock()
+		if inFlight == 0 && strings.Contains(logs.String(), "msg=Request") && strings.Contains(logs.String(), "Client aborted") {
+			break
+		}
+	}
+
+	out := logs.String()
+	if !strings.Contains(out, `msg="Client aborted" `) || !strings.Contains(out, "phase=transfer") {
+		t.Errorf("abort not logged:\n%s", out)
+	}
+	if strings.Contains(out, "level=ERROR") {
+		t.Errorf("abort logged as an error:\n%s", out)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.inFlight != 0 {
+		t.Errorf("%d git processes left running", m.inFlight)
+	}
+}
+
+// TestIntegrationReadYourWrites fetches right after every push: the smart
+// advertisements and the dumb info/refs show the pushed commit.
+func TestIntegrationReadYourWrites(t *testing.T) {
+	url, _ := newIntegrationServer(t, Config{})
+	a := filepath.Join(t.TempDir(), "a")
+	runGit(t, "", "clone", "-q", url, a)
+
+	for i := range 5 {
+		head := commitFile(t, a, fmt.Sprint(i))
+		runGit(t, a, "push", "-q", "origin", "main")
+
+		for _, version := range []string{"0", "2"} {
+			if out := runGit(t, a, "-c", "protocol.version="+version, "ls-remote", "origin", "refs/heads/main"); !strings.HasPrefix(out, head) {
+				t.Errorf("push %d, protocol v%s advertised %q, want %s", i, version, out, head)
+			}
+		}
+
+		resp, err := http.Get(url + "/info/refs")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if !strings.Contains(string(b), head+"\trefs/heads/main") {
+			t.Errorf("push %d, dumb info/refs:\n%s", i, b)
+		}
+	}
+}
+
+// TestIntegrationCloneUnbornDetachedHead clones repositories whose HEAD has
+// no commit or no branch: an empty clone, a clone without a checkout, and
+// a clone of the detached commit.
+func TestIntegrationCloneUnbornDetachedHead(t *testing.T) {
+	for _, version := range []string{"0", "2"} {
+		url, repo := newIntegrationServer(t, Config{})
+		work := t.TempDir()
+
+		empty := filepath.Join(work, "empty")
+		runGit(t, "", "-c", "protocol.version="+version, "clone", "-q", url, empty)
+		if out, err := gitCmd(empty, "rev-parse", "--verify", "-q", "HEAD").CombinedOutput(); err == nil {
+			t.Errorf("protocol v%s: clone of an empty repository has a HEAD: %s", version, out)
+		}
+
+		a := filepath.Join(work, "a")
+		runGit(t, "", "clone", "-q", url, a)
+		first := commitFile(t, a, "1")
+		second := commitFile(t, a, "2")
+		runGit(t, a, "push", "-q", "origin", "main")
+
+		// HEAD names a branch that doesn't exist.
+		runGit(t, repo, "symbolic-ref", "HEAD", "refs/heads/missing")
+		unborn := filepath.Join(work, "unborn")
+		runGit(t, "", "-c", "protocol.version="+version, "clone", "-q", url, unborn)
+		if got := runGit(t, unborn, "rev-parse", "origin/main"); got != second {
+			t.Errorf("protocol v%s, unborn HEAD: origin/main %s, want %s", version, got, second)
+		}
+
+		runGit(t, repo, "update-ref", "--no-deref", "HEAD", first)
+		detached := filepath.Join(work, "detached")
+		runGit(t, "", "-c", "protocol.version="+version, "clone", "-q", url, detached)
+		if got := runGit(t, detached, "rev-parse", "HEAD"); got != first {
+			t.Errorf("protocol v%s, detached HEAD: cloned %s, want %s", version, got, first)
+		}
+	}
+}
+
+// TestIntegrationPolicyRejection fetches a commit no ref reaches: the
+// client is told why, the server logs it as a refusal, not an error.
+func TestIntegrationPolicyRejection(t *testing.T) {
+	logs := &syncBuffer{}
+	url, repo := newIntegrationServer(t, Config{Logger: slog.New(slog.NewTextHandler(logs, nil))})
+	runGit(t, repo, "config", "uploadpack.allowReachableSHA1InWant", "true")
+
+	a := filepath.Join(t.TempDir(), "a")
+	runGit(t, "", "clone", "-q", url, a)
+	commitFile(t, a, "1")
+	runGit(t, a, "push", "-q", "origin", "main")
+	tree := runGit(t, repo, "rev-parse", "main^{tree}")
+	unreachable := runGit(t, repo, "commit-tree", "-m", "dangling", tree)
+
+	b := filepath.Join(t.TempDir(), "b")
+	runGit(t, "", "init", "-q", b)
+	out, err := gitCmd(b, "-c", "protocol.version=0", "fetch", url, unreachable).CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "not our ref "+unreachable) {
+		t.Errorf("fetch of an unreachable commit: %v\n%s", err, out)
+	}
+
+	got := logs.String()
+	if !strings.Contains(got, `msg="Git refused request"`) || !strings.Contains(got, "not our ref") {
+		t.Errorf("refusal not logged:\n%s", got)
+	}
+	if strings.Contains(got, "level=ERROR") {
+		t.Errorf("refusal logged as an error:\n%s", got)
+	}
+}
+
+// TestIntegrationObjectInfo asks for the size of a blob with the protocol
+// v2 object-info command, which is only served with ObjectInfo by git
+// 2.41 and later.
+func TestIntegrationObjectInfo(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		cfg := Config{ObjectInfo: enabled}
+		if !enabled {
+			// git dies on the command it doesn't offer.
+			cfg.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+		}
+		url, repo := newIntegrationServer(t, cfg)
+		a := filepath.Join(t.TempDir(), "a")
+		runGit(t, "", "clone", "-q", url, a)
+		commitFile(t, a, "twelve bytes")
+		runGit(t, a, "push", "-q", "origin", "main")
+		blob := runGit(t, repo, "rev-parse", "main:file")
+
+		req, _ := http.NewRequest("GET", url+"/info/refs?service=git-upload-pack", nil)
+		req.Header.Set("Git-Protocol", "version=2")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		caps, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		advertised := strings.Contains(string(caps), "object-info")
+		switch {
+		case enabled && !advertised:
+			t.Fatalf("object-info not advertised:\n%s", caps)
+		case !enabled && advertised:
+			// git before 2.41 advertises it regardless.
+			continue
+		}
+
+		body := pktWrite("command=object-info\n") + "0001" + pktWrite("size\n") + pktWrite("oid "+blob+"\n") + pktFlush()
+		req, _ = http.NewRequest("POST", url+"/git-upload-pack", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+		req.Header.Set("Git-Protocol", "version=2")
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		want := pktWrite("size") + pktWrite(blob+" 12") + pktFlush()
+		if got := string(info) == want; got != enabled {
+			t.Errorf("ObjectInfo %t: object-info answered %s %q", enabled, resp.Status, info)
+		}
+	}
+}
+
+// TestIntegrationDumbCloneFork clones a fork whose objects are all in the
+// shared pool its alternates point to, over the dumb protocol: loose,
+// then packed. A pool outside of the root isn't served.
+func TestIntegrationDumbCloneFork(t *testing.T) {
+	url, repo := newIntegrationServer(t, Config{})
+	root := filepath.Dir(repo)
+	base := strings.TrimSuffix(url, "/repo.git")
+
+	a := filepath.Join(t.TempDir(), "a")
+	runGit(t, "", "clone", "-q", url, a)
+	head := commitFile(t, a, "1")
+	runGit(t, a, "push", "-q", "origin", "main")
+
+	outside := filepath.Join(t.TempDir(), "pool.git")
+	for _, pool := range []string{filepath.Join(root, "pool.git"), outside} {
+		runGit(t, "", "init", "-q", "--bare", pool)
+		runGit(t, pool, "config", "receive.unpackLimit", "100000")
+		runGit(t, a, "push", "-q", pool, "main")
+	}
+	fork := filepath.Join(root, "fork.git")
+	runGit(t, "", "clone", "-q", "--bare", "--shared", filepath.Join(root, "pool.git"), fork)
+	escaped := filepath.Join(root, "escaped.git")
+	runGit(t, "", "clone", "-q", "--bare", "--shared", outside, escaped)
+	for _, r := range []string{fork, escaped} {
+		runGit(t, r, "update-server-info")
+	}
+
+	dumbClone := func(name string) (string, error) {
+		dir := filepath.Join(t.TempDir(), name)
+		cmd := gitCmd("", "clone", "-q", base+"/"+name+".git", dir)
+		cmd.Env = append(cmd.Environ(), "GIT_SMART_HTTP=0")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return string(out), err
+		}
+		return runGit(t, dir, "rev-parse", "HEAD"), nil
+	}
+
+	for _, layout := range []string{"loose", "packed"} {
+		if layout == "packed" {
+			runGit(t, filepath.Join(root, "pool.git"), "repack", "-q", "-a", "-d")
+			runGit(t, filepath.Join(root, "pool.git"), "update-server-info")
+		}
+		if entries, _ := os.ReadDir(filepath.Join(fork, "objects", "pack")); len(entries) > 0 {
+			t.Fatalf("the fork has packs of its own")
+		}
+		if got, err := dumbClone("fork"); err != nil || got != head {
+			t.Errorf("%s pool: dumb clone of the fork: %v %s", layout, err, got)
+		}
+	}
+
+	if out, err := dumbClone("escaped"); err == nil {
+		t.Errorf("dumb clone through a pool outside of the root succeeded: %s", out)
+	}
+}
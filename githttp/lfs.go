@@ -0,0 +1,348 @@
+package githttp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// lfsMediaType is the content type of Git LFS batch API requests and
+// responses.
+const lfsMediaType = "application/vnd.git-lfs+json"
+
+var lfsOIDPattern = regexp.MustCompile("^[0-9a-f]{64}$")
+
+// lfsServices are the routes of the Git LFS batch API and of the basic
+// transfer adapter, see
+// https://github.com/git-lfs/git-lfs/blob/main/docs/api/batch.md.
+func (gsh GitSmartHTTP) lfsServices() []Service {
+	return []Service{
+		Service{
+			Name:    "lfs-batch",
+			Method:  "POST",
+			Pattern: regexp.MustCompile("(?P<repoPath>.*)/info/lfs/objects/batch$"),
+			Handler: gsh.handleLFSBatch,
+		},
+		Service{
+			Name:    "lfs-download",
+			Method:  "GET",
+			Pattern: regexp.MustCompile("(?P<repoPath>.*)/info/lfs/objects/(?P<oid>[0-9a-f]{64})$"),
+			Handler: gsh.handleLFSDownload,
+		},
+		Service{
+			Name:    "lfs-upload",
+			Method:  "PUT",
+			Pattern: regexp.MustCompile("(?P<repoPath>.*)/info/lfs/objects/(?P<oid>[0-9a-f]{64})$"),
+			Handler: gsh.handleLFSUpload,
+		},
+	}
+}
+
+type lfsBatchRequest struct {
+	Operation string      `json:"operation"`
+	Transfers []string    `json:"transfers"`
+	Objects   []lfsObject `json:"objects"`
+	HashAlgo  string      `json:"hash_algo"`
+}
+
+type lfsObject struct {
+	OID           string               `json:"oid"`
+	Size          int64                `json:"size"`
+	Authenticated bool                 `json:"authenticated,omitempty"`
+	Actions       map[string]lfsAction `json:"actions,omitempty"`
+	Error         *lfsError            `json:"error,omitempty"`
+}
+
+type lfsAction struct {
+	Href   string            `json:"href"`
+	Header map[string]string `json:"header,omitempty"`
+}
+
+type lfsError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type lfsBatchResponse struct {
+	Transfer string      `json:"transfer"`
+	Objects  []lfsObject `json:"objects"`
+	HashAlgo string      `json:"hash_algo"`
+}
+
+// lfsObjectPath returns where the object oid of the repository is stored,
+// the layout git lfs uses in .git/lfs/objects.
+func lfsObjectPath(repoPath, oid string) string {
+	return filepath.Join(repoPath, "lfs", "objects", oid[0:2], oid[2:4], oid)
+}
+
+// lfsAccess checks that the request may run operation, "download" or
+// "upload", on the repository and answers it otherwise. Uploads need
+// credentials even with AnonymousRead.
+func (gsh GitSmartHTTP) lfsAccess(w http.ResponseWriter, r *http.Request, repoPath, operation string) bool {
+	service := uploadPack
+	if operation == "upload" {
+		service = receivePack
+		if gsh.Authenticator != nil && gsh.authenticatedUser(r) == "" {
+			gsh.challenge(w, r)
+			return false
+		}
+	}
+
+	if !gsh.authorize(w, r, repoPath, service) {
+		return false
+	}
+	if !gsh.serviceAccess(service) {
+		lfsErrorResponse(w, http.StatusForbidden, "Git LFS "+operation+" is disabled")
+		return false
+	}
+	return true
+}
+
+func (gsh GitSmartHTTP) handleLFSBatch(s Service, w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	repoPath, ok := gsh.resolveRepo(w, r, s.ParseURLNamedParams(r)["repoPath"])
+	if !ok {
+		return
+	}
+
+	body, err := decodeRequestBody(r, r.Body)
+	if err != nil {
+		lfsBodyError(w, err)
+		return
+	}
+	defer body.Close()
+
+	var req lfsBatchRequest
+	if err := json.NewDecoder(io.LimitReader(body, 10<<20)).Decode(&req); err != nil {
+		lfsErrorResponse(w, http.StatusBadRequest, "Cannot parse batch request")
+		return
+	}
+	if req.Operation != "download" && req.Operation != "upload" {
+		lfsErrorResponse(w, http.StatusUnprocessableEntity, fmt.Sprintf("Unknown operation %q", req.Operation))
+		return
+	}
+	if req.HashAlgo != "" && req.HashAlgo != "sha256" {
+		lfsErrorResponse(w, http.StatusConflict, fmt.Sprintf("Unsupported hash algorithm %q", req.HashAlgo))
+		return
+	}
+	if len(req.Transfers) > 0 && !contains(req.Transfers, "basic") {
+		lfsErrorResponse(w, http.StatusUnprocessableEntity, "Only the basic transfer adapter is supported")
+		return
+	}
+
+	if !gsh.lfsAccess(w, r, repoPath, req.Operation) {
+		return
+	}
+
+	base := lfsBaseURL(r, gsh.forwardedProto(r), gsh.BasePath)
+	var header map[string]string
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		header = map[string]string{"Authorization": auth}
+	}
+
+	resp := lfsBatchResponse{Transfer: "basic", Objects: []lfsObject{}, HashAlgo: "sha256"}
+	for _, obj := range req.Objects {
+		out := lfsObject{OID: obj.OID, Size: obj.Size}
+
+		if !lfsOIDPattern.MatchString(obj.OID) || obj.Size < 0 {
+			out.Error = &lfsError{Code: http.StatusUnprocessableEntity, Message: "Invalid object"}
+			resp.Objects = append(resp.Objects, out)
+			continue
+		}
+
+		fi, err := os.Stat(lfsObjectPath(repoPath, obj.OID))
+		exists := err == nil && fi.Size() == obj.Size
+		action := lfsAction{Href: base + "/" + obj.OID, Header: header}
+
+		switch {
+		case req.Operation == "upload" && !exists && gsh.MaxBodyBytes > 0 && obj.Size > gsh.MaxBodyBytes:
+			out.Error = &lfsError{Code: http.StatusUnprocessableEntity, Message: fmt.Sprintf("Object is larger than %d bytes", gsh.MaxBodyBytes)}
+		case req.Operation == "download" && !exists:
+			out.Error = &lfsError{Code: http.StatusNotFound, Message: "Object does not exist"}
+		case req.Operation == "download":
+			out.Authenticated = true
+			out.Actions = map[string]lfsAction{"download": action}
+		case !exists:
+			// Objects already stored get no action, there is nothing to
+			// upload. The upload is held to the size declared here.
+			out.Authenticated = true
+			action.Href += "?size=" + strconv.FormatInt(obj.Size, 10)
+			out.Actions = map[string]lfsAction{"upload": action}
+		}
+		resp.Objects = append(resp.Objects, out)
+	}
+
+	w.Header().Set("Content-Type", lfsMediaType)
+	setHeaders(w, hdrNoCache())
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (gsh GitSmartHTTP) handleLFSDownload(s Service, w http.ResponseWriter, r *http.Request) {
+	params := s.ParseURLNamedParams(r)
+	repoPath, ok := gsh.resolveRepo(w, r, params["repoPath"])
+	if !ok || !gsh.lfsAccess(w, r, repoPath, "download") {
+		return
+	}
+
+	oid := params["oid"]
+	f, err := os.Open(lfsObjectPath(repoPath, oid))
+	if err != nil {
+		lfsErrorResponse(w, http.StatusNotFound, "Object does not exist")
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		lfsErrorResponse(w, http.StatusInternalServerError, "Cannot read object")
+		return
+	}
+
+	// Objects are named by their content like git objects.
+	w.Header().Set("ETag", `"`+oid+`"`)
+	serveContent(s, w, r, fi, "application/octet-stream", hdrCacheForever(), f)
+}
+
+func (gsh GitSmartHTTP) handleLFSUpload(s Service, w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	params := s.ParseURLNamedParams(r)
+	repoPath, ok := gsh.resolveRepo(w, r, params["repoPath"])
+	if !ok || !gsh.lfsAccess(w, r, repoPath, "upload") {
+		return
+	}
+
+	// Uploads are held to the size the batch request declared, and to
+	// MaxBodyBytes.
+	size, err := strconv.ParseInt(r.URL.Query().Get("size"), 10, 64)
+	if err != nil || size < 0 {
+		lfsErrorResponse(w, http.StatusUnprocessableEntity, "Missing object size, upload through the batch API")
+		return
+	}
+	if gsh.MaxBodyBytes > 0 && size > gsh.MaxBodyBytes {
+		requestLog(r).Info("LFS object too large", "repo", repoPath, "size", size, "limit", gsh.MaxBodyBytes)
+		lfsErrorResponse(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Object is larger than %d bytes", gsh.MaxBodyBytes))
+		return
+	}
+
+	oid := params["oid"]
+	dst := lfsObjectPath(repoPath, oid)
+	if _, err := os.Stat(dst); err == nil {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	tmpDir := filepath.Join(repoPath, "lfs", "tmp")
+	if err := os.MkdirAll(tmpDir, 0o755); err != nil {
+		requestLog(r).Error("Cannot create LFS directory", "repo", repoPath, "err", err)
+		lfsErrorResponse(w, http.StatusInternalServerError, "Cannot store object")
+		return
+	}
+	tmp, err := os.CreateTemp(tmpDir, oid+"-")
+	if err != nil {
+		requestLog(r).Error("Cannot create LFS object", "repo", repoPath, "err", err)
+		lfsErrorResponse(w, http.StatusInternalServerError, "Cannot store object")
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	// The object is only moved into place once its content matches its
+	// name, a broken upload leaves nothing behind.
+	h := sha256.New()
+	var raw io.Reader = r.Body
+	if gsh.MaxBodyBytes > 0 {
+		raw = http.MaxBytesReader(w, r.Body, gsh.MaxBodyBytes)
+	}
+	body, err := decodeRequestBody(r, newIdleTimeoutReader(w, raw, gsh.BodyIdleTimeout))
+	if err != nil {
+		tmp.Close()
+		lfsBodyError(w, err)
+		return
+	}
+	defer body.Close()
+	// One byte more than declared is enough to tell the object is larger.
+	n, err := io.Copy(io.MultiWriter(tmp, h), io.LimitReader(body, size+1))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if isTooLarge(err) {
+		requestLog(r).Info("LFS object too large", "repo", repoPath, "oid", oid, "limit", gsh.MaxBodyBytes)
+		lfsErrorResponse(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Object is larger than %d bytes", gsh.MaxBodyBytes))
+		return
+	}
+	if err != nil {
+		if isTimeout(err) || isClientGone(err) || errors.Is(err, errBadEncoding) || r.Context().Err() != nil {
+			requestLog(r).Info("Cannot read LFS object", "repo", repoPath, "oid", oid, "err", err)
+			lfsErrorResponse(w, http.StatusBadRequest, "Cannot read object")
+			return
+		}
+		requestLog(r).Error("Cannot store LFS object", "repo", repoPath, "oid", oid, "err", err)
+		lfsErrorResponse(w, http.StatusInternalServerError, "Cannot store object")
+		return
+	}
+
+	if n != size {
+		lfsErrorResponse(w, http.StatusUnprocessableEntity, fmt.Sprintf("Object is not the declared %d bytes", size))
+		return
+	}
+	if hex.EncodeToString(h.Sum(nil)) != oid {
+		lfsErrorResponse(w, http.StatusUnprocessableEntity, "Object content does not match its oid")
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err == nil {
+		err = os.Rename(tmp.Name(), dst)
+	}
+	if err != nil {
+		requestLog(r).Error("Cannot store LFS object", "repo", repoPath, "oid", oid, "err", err)
+		lfsErrorResponse(w, http.StatusInternalServerError, "Cannot store object")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// lfsBaseURL returns the URL objects of the repository of the batch
+// request r are transferred at. r has had basePath stripped.
+func lfsBaseURL(r *http.Request, forwardedProto, basePath string) string {
+	scheme := "http"
+	if r.TLS != nil || forwardedProto == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + strings.TrimSuffix(basePath, "/") + strings.TrimSuffix(r.URL.Path, "/batch")
+}
+
+// lfsBodyError answers a request whose body can't be decoded, see
+// decodeRequestBody.
+func lfsBodyError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errUnsupportedEncoding) {
+		lfsErrorResponse(w, http.StatusUnsupportedMediaType, "Unsupported Content-Encoding")
+		return
+	}
+	lfsErrorResponse(w, http.StatusBadRequest, "Cannot decode request body")
+}
+
+func lfsErrorResponse(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", lfsMediaType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"message": msg})
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
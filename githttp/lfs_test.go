@@ -0,0 +1,197 @@
+package githttp
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newLFSServer serves an empty repository repo.git with the LFS API.
+func newLFSServer(t *testing.T, cfg Config) *httptest.Server {
+	t.Helper()
+	root := t.TempDir()
+	repo := filepath.Join(root, "repo.git")
+	if err := os.MkdirAll(filepath.Join(repo, "objects"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(repo, "HEAD"), []byte("ref: refs/heads/main\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.ReposRootPath = root
+	cfg.LFS, cfg.ReceivePack, cfg.UploadPack = true, true, true
+	cfg.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	h, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func lfsBatch(t *testing.T, srv *httptest.Server, operation string, objects ...lfsObject) lfsBatchResponse {
+	t.Helper()
+	b, _ := json.Marshal(lfsBatchRequest{Operation: operation, Objects: objects})
+	resp, err := http.Post(srv.URL+"/repo.git/info/lfs/objects/batch", lfsMediaType, strings.NewReader(string(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("batch %s: %s %s", operation, resp.Status, body)
+	}
+
+	var out lfsBatchResponse
+	if err := json.Unmarshal(body, &out); err != nil {
+		t.Fatalf("batch %s: %s in %s", operation, err, body)
+	}
+	if operation == "download" && len(objects) == 0 && !strings.Contains(string(body), `"objects":[]`) {
+		t.Errorf("empty batch answered %s", body)
+	}
+	return out
+}
+
+func lfsPut(t *testing.T, href, content string) int {
+	t.Helper()
+	req, err := http.NewRequest("PUT", href, strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func lfsOID(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestLFSUploadDownload(t *testing.T) {
+	srv := newLFSServer(t, Config{})
+	lfsBatch(t, srv, "download")
+
+	content := "0123456789abcdef"
+	obj := lfsObject{OID: lfsOID(content), Size: int64(len(content))}
+	up := lfsBatch(t, srv, "upload", obj)
+	href := up.Objects[0].Actions["upload"].Href
+	if !strings.HasSuffix(href, "?size=16") {
+		t.Fatalf("upload href %s doesn't carry the size", href)
+	}
+
+	// The content must be the declared size, and match the oid.
+	if code := lfsPut(t, strings.TrimSuffix(href, "16")+"15", content[:15]); code != http.StatusUnprocessableEntity {
+		t.Errorf("upload of another size: %d, want 422", code)
+	}
+	if code := lfsPut(t, href, content+"x"); code != http.StatusUnprocessableEntity {
+		t.Errorf("upload longer than declared: %d, want 422", code)
+	}
+	if code := lfsPut(t, href, strings.ToUpper(content)); code != http.StatusUnprocessableEntity {
+		t.Errorf("upload of other content: %d, want 422", code)
+	}
+	if code := lfsPut(t, strings.TrimSuffix(href, "?size=16"), content); code != http.StatusUnprocessableEntity {
+		t.Errorf("upload without a size: %d, want 422", code)
+	}
+	if code := lfsPut(t, href, content); code != http.StatusOK {
+		t.Fatalf("upload: %d", code)
+	}
+
+	down := lfsBatch(t, srv, "download", obj)
+	dl := down.Objects[0].Actions["download"].Href
+
+	req, _ := http.NewRequest("GET", dl, nil)
+	req.Header.Set("Range", "bytes=4-7")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent || string(b) != "4567" {
+		t.Errorf("range request: %d %q", resp.StatusCode, b)
+	}
+	etag := resp.Header.Get("ETag")
+	if etag != `"`+obj.OID+`"` {
+		t.Errorf("ETag %s", etag)
+	}
+
+	req, _ = http.NewRequest("GET", dl, nil)
+	req.Header.Set("If-None-Match", etag)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("conditional request: %d, want 304", resp.StatusCode)
+	}
+}
+
+func TestLFSUploadTooLarge(t *testing.T) {
+	srv := newLFSServer(t, Config{MaxBodyBytes: 10})
+	content := strings.Repeat("x", 1000)
+	obj := lfsObject{OID: lfsOID(content), Size: int64(len(content))}
+
+	up := lfsBatch(t, srv, "upload", obj)
+	if e := up.Objects[0].Error; e == nil || up.Objects[0].Actions != nil {
+		t.Errorf("batch offered to upload an object over MaxBodyBytes: %+v", up.Objects[0])
+	}
+
+	href := srv.URL + "/repo.git/info/lfs/objects/" + obj.OID
+	if code := lfsPut(t, href+"?size=1000", content); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("declared too large: %d, want 413", code)
+	}
+	// Declared within the limit, sent beyond it.
+	if code := lfsPut(t, href+"?size=10", content); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("body too large: %d, want 413", code)
+	}
+}
+
+// TestLFSBatchEncoding checks the batch API decodes request bodies like
+// the git services do.
+func TestLFSBatchEncoding(t *testing.T) {
+	srv := newLFSServer(t, Config{})
+	batch, _ := json.Marshal(lfsBatchRequest{Operation: "download"})
+	var zl bytes.Buffer
+	zw := zlib.NewWriter(&zl)
+	zw.Write(batch)
+	zw.Close()
+
+	for _, tc := range []struct {
+		encoding string
+		body     []byte
+		status   int
+	}{
+		{"deflate", zl.Bytes(), http.StatusOK},
+		{"gzip", batch, http.StatusBadRequest},
+		{"br", batch, http.StatusUnsupportedMediaType},
+	} {
+		req, _ := http.NewRequest("POST", srv.URL+"/repo.git/info/lfs/objects/batch", bytes.NewReader(tc.body))
+		req.Header.Set("Content-Type", lfsMediaType)
+		req.Header.Set("Content-Encoding", tc.encoding)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s: %s %s, want %d", tc.encoding, resp.Status, b, tc.status)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package githttp
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ListingPath is where the repository listing is served when enabled. It
+// can't collide with a repository route, those all end in a file name
+// below the repository.
+const ListingPath = "/_repos"
+
+// maxListingLimit caps the page size of the repository listing.
+const maxListingLimit = 1000
+
+var errListingFull = errors.New("listing page is full")
+
+type repoListing struct {
+	Repositories []string `json:"repositories"`
+	// NextOffset is the offset of the next page, absent on the last one.
+	NextOffset int `json:"next_offset,omitempty"`
+}
+
+// handleListing answers with the repositories below the roots the user may
+// fetch from, sorted and paginated with the offset and limit query
+// parameters. Directories deeper than ListingDepth below a root are not
+// looked at.
+func (gsh GitSmartHTTP) handleListing(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		methodNotAllowed(w, r)
+		return
+	}
+
+	if gsh.Authenticator != nil && !gsh.AnonymousRead && gsh.authenticatedUser(r) == "" {
+		gsh.challenge(w, r)
+		return
+	}
+
+	offset, err1 := queryInt(r, "offset", 0)
+	limit, err2 := queryInt(r, "limit", maxListingLimit)
+	if err1 != nil || err2 != nil || offset < 0 || limit < 1 {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	limit = min(limit, maxListingLimit)
+
+	user := gsh.authenticatedUser(r)
+	listing := repoListing{Repositories: []string{}}
+	seen := 0
+
+	for _, root := range gsh.roots() {
+		err := gsh.walkRepos(root.Path, func(repoPath string) error {
+			name := gsh.repoName(repoPath)
+			if gsh.Authorize != nil && !gsh.Authorize(user, name, uploadPack) {
+				return nil
+			}
+
+			seen++
+			switch {
+			case seen <= offset:
+			case len(listing.Repositories) == limit:
+				listing.NextOffset = offset + limit
+				return errListingFull
+			default:
+				listing.Repositories = append(listing.Repositories, strings.TrimSuffix(gsh.BasePath, "/")+"/"+name)
+			}
+			return nil
+		})
+		if errors.Is(err, errListingFull) {
+			break
+		}
+		if err != nil {
+			requestLog(r).Error("Cannot list repositories", "root", root.Path, "err", err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	setHeaders(w, hdrNoCache())
+	json.NewEncoder(w).Encode(listing)
+}
+
+// walkRepos calls fn with every git repository below root, in lexical
+// order, without descending into repositories or hidden directories.
+func (gsh GitSmartHTTP) walkRepos(root string, fn func(repoPath string) error) error {
+	root = filepath.Clean(root)
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Unreadable directories are left out, not fatal.
+			if p == root {
+				return err
+			}
+			return fs.SkipDir
+		}
+		if !d.IsDir() || p == root {
+			return nil
+		}
+
+		if strings.HasPrefix(d.Name(), ".") {
+			return fs.SkipDir
+		}
+		if isGitRepo(p) {
+			if err := fn(p); err != nil {
+				return err
+			}
+			return fs.SkipDir
+		}
+
+		rel, _ := filepath.Rel(root, p)
+		if gsh.ListingDepth > 0 && strings.Count(rel, string(filepath.Separator))+1 >= gsh.ListingDepth {
+			return fs.SkipDir
+		}
+		return nil
+	})
+}
+
+func queryInt(r *http.Request, name string, def int) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	return strconv.Atoi(v)
+}
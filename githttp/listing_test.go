@@ -0,0 +1,30 @@
+package githttp
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestListingRateLimited(t *testing.T) {
+	h, err := New(Config{
+		ReposRootPath: t.TempDir(),
+		EnableListing: true,
+		RateLimit:     0.001,
+		RateBurst:     1,
+		Logger:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", ListingPath, nil))
+		if rec.Code != want {
+			t.Errorf("listing %d: %d, want %d", i, rec.Code, want)
+		}
+	}
+}
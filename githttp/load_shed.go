@@ -0,0 +1,61 @@
+package githttp
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+)
+
+// isNewFetch reports whether the request starts a fetch or clone. Only
+// these are shed, so fetches that are already negotiating can finish.
+func isNewFetch(s Service, r *http.Request) bool {
+	return s.Name == "info-refs" && r.FormValue("service") == uploadPack
+}
+
+// overloaded reports whether any of the configured shedding thresholds has
+// been reached.
+func (gsh GitSmartHTTP) overloaded() bool {
+	if gsh.ShedGitProcesses > 0 && gsh.inFlight.Load() >= int64(gsh.ShedGitProcesses) {
+		return true
+	}
+
+	// The request being considered is already counted.
+	if gsh.ShedRequests > 0 && gsh.inFlightRequests.Load() > int64(gsh.ShedRequests) {
+		return true
+	}
+	return false
+}
+
+// shed answers a request turned away because of load with 503.
+func (gsh GitSmartHTTP) shed(w http.ResponseWriter) {
+	retryAfter := int(math.Ceil(gsh.ShedRetryAfter.Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Retry-After", fmt.Sprint(retryAfter))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	fmt.Fprintln(w, "Server is overloaded, please try again later")
+}
+
+// acquireAdvertisement takes a slot for generating a ref advertisement. It
+// never blocks, false means the limit has been reached.
+func (gsh GitSmartHTTP) acquireAdvertisement() bool {
+	if gsh.advertisements == nil {
+		return true
+	}
+
+	select {
+	case gsh.advertisements <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (gsh GitSmartHTTP) releaseAdvertisement() {
+	if gsh.advertisements != nil {
+		<-gsh.advertisements
+	}
+}
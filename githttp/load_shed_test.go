@@ -0,0 +1,111 @@
+package githttp
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadShedding(t *testing.T) {
+	gsh, err := NewGitSmartHTTP(&GitSmartHTTPConfig{
+		ReposRootPath:    t.TempDir(),
+		UploadPack:       true,
+		ShedGitProcesses: 2,
+		ShedRequests:     3,
+		ShedRetryAfter:   1500 * time.Millisecond,
+		Logger:           slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fetch := func(method, path string) *http.Response {
+		var body io.Reader
+		if method == "POST" {
+			body = strings.NewReader("0000")
+		}
+		rec := httptest.NewRecorder()
+		gsh.ServeHTTP(rec, httptest.NewRequest(method, path, body))
+		return rec.Result()
+	}
+	advertisement := "/repo.git/info/refs?service=git-upload-pack"
+
+	for _, tc := range []struct {
+		name          string
+		processes, in int64
+		method, path  string
+		shed          bool
+	}{
+		{"idle", 0, 0, "GET", advertisement, false},
+		{"below the process threshold", 1, 0, "GET", advertisement, false},
+		{"process threshold", 2, 0, "GET", advertisement, true},
+		{"request threshold", 0, 3, "GET", advertisement, true},
+		// Fetches past the advertisement are already under way.
+		{"negotiation", 2, 3, "POST", "/repo.git/git-upload-pack", false},
+		{"push advertisement", 2, 3, "GET", "/repo.git/info/refs?service=git-receive-pack", false},
+	} {
+		gsh.inFlight.Store(tc.processes)
+		gsh.inFlightRequests.Store(tc.in)
+		resp := fetch(tc.method, tc.path)
+
+		switch {
+		case tc.shed && resp.StatusCode != http.StatusServiceUnavailable:
+			t.Errorf("%s: %s, want 503", tc.name, resp.Status)
+		case tc.shed && resp.Header.Get("Retry-After") != "2":
+			t.Errorf("%s: Retry-After %q, want 2", tc.name, resp.Header.Get("Retry-After"))
+		case !tc.shed && resp.StatusCode == http.StatusServiceUnavailable:
+			t.Errorf("%s: shed", tc.name)
+		}
+	}
+}
+
+func TestMaxAdvertisements(t *testing.T) {
+	gitEnv(t)
+	root := t.TempDir()
+	runGit(t, "", "init", "-q", "--bare", filepath.Join(root, "repo.git"))
+
+	gsh, err := NewGitSmartHTTP(&GitSmartHTTPConfig{
+		ReposRootPath:     root,
+		UploadPack:        true,
+		ReceivePack:       true,
+		MaxAdvertisements: 2,
+		ShedRetryAfter:    3 * time.Second,
+		Logger:            slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	advertise := func(service string) *http.Response {
+		rec := httptest.NewRecorder()
+		gsh.ServeHTTP(rec, httptest.NewRequest("GET", "/repo.git/info/refs?service="+service, nil))
+		return rec.Result()
+	}
+
+	// Hold every slot, as advertisements in progress would.
+	for range 2 {
+		if !gsh.acquireAdvertisement() {
+			t.Fatal("no advertisement slot")
+		}
+	}
+	for _, service := range []string{uploadPack, receivePack} {
+		resp := advertise(service)
+		if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "3" {
+			t.Errorf("%s while saturated: %s, Retry-After %q", service, resp.Status, resp.Header.Get("Retry-After"))
+		}
+	}
+
+	gsh.releaseAdvertisement()
+	if resp := advertise(uploadPack); resp.StatusCode != http.StatusOK {
+		t.Errorf("with a free slot: %s", resp.Status)
+	}
+	// The slot taken by the request was given back.
+	if !gsh.acquireAdvertisement() {
+		t.Error("advertisement slot leaked")
+	}
+}
@@ -0,0 +1,58 @@
+package githttp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+)
+
+// Logger receives the server's log messages. args are alternating keys and
+// values, as with log/slog, whose *slog.Logger implements it.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// requestLogger adds the request ID to every message of a request.
+type requestLogger struct {
+	Logger
+	id string
+}
+
+func (l requestLogger) Debug(msg string, args ...any) {
+	l.Logger.Debug(msg, append([]any{"request_id", l.id}, args...)...)
+}
+
+func (l requestLogger) Info(msg string, args ...any) {
+	l.Logger.Info(msg, append([]any{"request_id", l.id}, args...)...)
+}
+
+func (l requestLogger) Error(msg string, args ...any) {
+	l.Logger.Error(msg, append([]any{"request_id", l.id}, args...)...)
+}
+
+type loggerKey struct{}
+
+// withRequestLogger returns r carrying a logger tagged with a new request
+// ID.
+func withRequestLogger(r *http.Request, l Logger) (*http.Request, requestLogger) {
+	rl := requestLogger{Logger: l, id: newRequestID()}
+	return r.WithContext(context.WithValue(r.Context(), loggerKey{}, rl)), rl
+}
+
+// requestLog returns the logger of the request, see withRequestLogger.
+func requestLog(r *http.Request) Logger {
+	if l, ok := r.Context().Value(loggerKey{}).(Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,110 @@
+package githttp
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// scheduleGC runs git gc on the repository in the background, unless a gc
+// started by the server is already running there. It cleans up after pushes
+// that were killed half way, which leave their quarantined objects behind.
+func (gsh GitSmartHTTP) scheduleGC(repoPath string) {
+	if _, running := gsh.maintenance.LoadOrStore(repoPath, struct{}{}); running {
+		return
+	}
+
+	go func() {
+		defer gsh.maintenance.Delete(repoPath)
+
+		// Pruning must not race pushes from other servers, whose objects
+		// aren't referenced yet.
+		if gsh.PushLock {
+			unlock, err := lockRepoForPush(context.Background(), repoPath, gsh.PushLockTimeout)
+			if err != nil {
+				gsh.Logger.Error("Cannot lock repository for gc", "repo", repoPath, "err", err)
+				return
+			}
+			defer unlock()
+		}
+
+		gs := gsh.newGitRPCClient(false)
+		gs.GC(context.Background(), repoPath, gsh.GCPruneExpire)
+
+		gsh.gitStarted()
+		out, err := gs.Output()
+		gsh.gitFinished()
+
+		if err != nil {
+			gsh.Logger.Error("git gc failed", "repo", repoPath, "err", err, "stderr", exitStderr(err), "output", string(out))
+			return
+		}
+		gsh.Logger.Info("git gc finished", "repo", repoPath)
+	}()
+}
+
+// maybeRepack repacks the repository in the background when it has more
+// than RepackLooseObjects loose objects, at most once per RepackInterval.
+// Dumb clients fetch loose objects one request at a time, a pack takes
+// a single one.
+//
+// A dumb client reads the list of packs once and falls back to it when a
+// loose object is gone, so the loose objects just packed are only removed
+// by the next repack, RepackInterval later, when clients that started
+// before the pack existed are long done.
+func (gsh GitSmartHTTP) maybeRepack(repoPath string) {
+	if gsh.RepackLooseObjects <= 0 || estimateLooseObjects(repoPath) <= gsh.RepackLooseObjects {
+		return
+	}
+
+	now := time.Now()
+	if last, ok := gsh.lastRepack.Load(repoPath); ok && now.Sub(last.(time.Time)) < gsh.RepackInterval {
+		return
+	}
+	if _, running := gsh.maintenance.LoadOrStore(repoPath, struct{}{}); running {
+		return
+	}
+	gsh.lastRepack.Store(repoPath, now)
+
+	go func() {
+		defer gsh.maintenance.Delete(repoPath)
+
+		// A repack must not race pushes from other servers either.
+		if gsh.PushLock {
+			unlock, err := lockRepoForPush(context.Background(), repoPath, gsh.PushLockTimeout)
+			if err != nil {
+				gsh.Logger.Error("Cannot lock repository for repack", "repo", repoPath, "err", err)
+				return
+			}
+			defer unlock()
+		}
+
+		prune := gsh.newGitRPCClient(false)
+		prune.PrunePacked(context.Background(), repoPath)
+		repack := gsh.newGitRPCClient(false)
+		repack.Repack(context.Background(), repoPath)
+
+		for _, gs := range []*GitRPCClient{prune, repack} {
+			gsh.gitStarted()
+			out, err := gs.Output()
+			gsh.gitFinished()
+
+			if err != nil {
+				gsh.Logger.Error("git repack failed", "repo", repoPath, "args", gs.cmd.Args, "err", err, "stderr", exitStderr(err), "output", string(out))
+				return
+			}
+		}
+		gsh.Logger.Info("git repack finished", "repo", repoPath)
+	}()
+}
+
+// estimateLooseObjects estimates the number of loose objects the way
+// git gc --auto does, from the size of a single fan-out directory.
+func estimateLooseObjects(repoPath string) int {
+	entries, err := os.ReadDir(filepath.Join(repoPath, "objects", "17"))
+	if err != nil {
+		return 0
+	}
+	return len(entries) * 256
+}
@@ -0,0 +1,134 @@
+package githttp
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestIntegrationRepackLooseObjects serves info/refs to dumb clients of a
+// repository with many loose objects, which is repacked in the background.
+func TestIntegrationRepackLooseObjects(t *testing.T) {
+	url, repo := newIntegrationServer(t, Config{RepackLooseObjects: 100})
+	// Keep the objects of the push loose.
+	runGit(t, repo, "config", "receive.unpackLimit", "100000")
+
+	work := filepath.Join(t.TempDir(), "work")
+	runGit(t, "", "init", "-q", "-b", "main", work)
+	for i := range 2000 {
+		if err := os.WriteFile(filepath.Join(work, fmt.Sprint(i)), []byte(fmt.Sprint(i)), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runGit(t, work, "add", ".")
+	runGit(t, work, "commit", "-q", "-m", "many files")
+	runGit(t, work, "push", "-q", url, "main")
+
+	// The estimate looks at a single fan-out directory.
+	fanOut := filepath.Join(repo, "objects", "17")
+	loose, _ := filepath.Glob(filepath.Join(fanOut, "*"))
+	if len(loose) == 0 {
+		t.Fatal("no loose objects in objects/17")
+	}
+
+	dumbInfoRefs := func() {
+		t.Helper()
+		resp, err := http.Get(url + "/info/refs")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("info/refs: %s", resp.Status)
+		}
+	}
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		for deadline := time.Now().Add(10 * time.Second); !cond(); time.Sleep(20 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+		}
+	}
+
+	dumbInfoRefs()
+	waitFor("a pack listed in objects/info/packs", func() bool {
+		b, _ := os.ReadFile(filepath.Join(repo, "objects", "info", "packs"))
+		return strings.Contains(string(b), "P pack-")
+	})
+	// Dumb clients that listed no packs yet still find the loose objects.
+	if _, err := os.Stat(loose[0]); err != nil {
+		t.Errorf("loose object removed by the first repack: %s", err)
+	}
+
+	// The next repack removes the objects packed by the previous one. It
+	// is skipped while the previous one is still finishing.
+	waitFor("the packed loose objects to be removed", func() bool {
+		dumbInfoRefs()
+		_, err := os.Stat(loose[0])
+		return os.IsNotExist(err)
+	})
+}
+
+// TestIntegrationGCAfterFailedPush times out pushes to a repository holding
+// the quarantine directory of an earlier failed push: git gc removes it
+// when GCAfterFailedPush is set.
+func TestIntegrationGCAfterFailedPush(t *testing.T) {
+	gitBinary, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git is not installed")
+	}
+	// Pushes hang, advertisements are served.
+	wrapper := filepath.Join(t.TempDir(), "git")
+	script := fmt.Sprintf("#!/bin/sh\ncase \"$*\" in *advertise-refs*) ;; *receive-pack*) exec sleep 10;; esac\nexec %s \"$@\"\n", gitBinary)
+	if err := os.WriteFile(wrapper, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, gc := range []bool{false, true} {
+		url, repo := newIntegrationServer(t, Config{
+			GitBinary:         wrapper,
+			GitTimeout:        300 * time.Millisecond,
+			GCAfterFailedPush: gc,
+			GCPruneExpire:     "1.hour.ago",
+			// Timeouts are logged as errors.
+			Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		})
+		stale := filepath.Join(repo, "objects", "tmp_objdir-incoming-stale")
+		if err := os.MkdirAll(stale, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		old := time.Now().Add(-2 * time.Hour)
+		if err := os.Chtimes(stale, old, old); err != nil {
+			t.Fatal(err)
+		}
+
+		a := filepath.Join(t.TempDir(), "a")
+		runGit(t, "", "clone", "-q", url, a)
+		commitFile(t, a, "1")
+		if out, err := gitCmd(a, "push", "origin", "main").CombinedOutput(); err == nil {
+			t.Fatalf("push didn't time out:\n%s", out)
+		}
+
+		// Without gc, give one that shouldn't run a moment to show up.
+		wait := time.Second
+		if gc {
+			wait = 5 * time.Second
+		}
+		removed := false
+		for deadline := time.Now().Add(wait); !removed && time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+			_, err := os.Stat(stale)
+			removed = os.IsNotExist(err)
+		}
+		if removed != gc {
+			t.Errorf("GCAfterFailedPush %t: stale quarantine removed %t", gc, removed)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package githttp
+
+import "time"
+
+// Metrics receives measurements from the handlers. Implementations must be
+// safe for concurrent use.
+type Metrics interface {
+	// IncRequest counts a finished request for the named service.
+	IncRequest(service string, status int)
+	// ObserveDuration records how long a request for the named service took.
+	ObserveDuration(service string, d time.Duration)
+	// AddBytes adds n bytes written back to the client for the named service.
+	AddBytes(service string, n int64)
+	// AddInFlight adds delta, 1 when a git subprocess starts and -1 when it
+	// exits, to the number of git subprocesses running.
+	AddInFlight(delta int)
+}
+
+// noopMetrics is the default Metrics that discards everything.
+type noopMetrics struct{}
+
+func (noopMetrics) IncRequest(service string, status int)           {}
+func (noopMetrics) ObserveDuration(service string, d time.Duration) {}
+func (noopMetrics) AddBytes(service string, n int64)                {}
+func (noopMetrics) AddInFlight(delta int)                           {}
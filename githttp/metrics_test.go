@@ -0,0 +1,107 @@
+package githttp
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMetrics records the calls of the handlers.
+type fakeMetrics struct {
+	mu        sync.Mutex
+	requests  map[requestKey]int
+	durations map[string]int
+	bytes     map[string]int64
+	inFlight  int
+	started   int
+}
+
+func newFakeMetrics() *fakeMetrics {
+	return &fakeMetrics{
+		requests:  make(map[requestKey]int),
+		durations: make(map[string]int),
+		bytes:     make(map[string]int64),
+	}
+}
+
+func (m *fakeMetrics) IncRequest(service string, status int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[requestKey{service, status}]++
+}
+
+func (m *fakeMetrics) ObserveDuration(service string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.durations[service]++
+}
+
+func (m *fakeMetrics) AddBytes(service string, n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bytes[service] += n
+}
+
+func (m *fakeMetrics) AddInFlight(delta int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inFlight += delta
+	if delta > 0 {
+		m.started += delta
+	}
+}
+
+func TestMetricsCalls(t *testing.T) {
+	m := newFakeMetrics()
+	url, _ := newIntegrationServer(t, Config{Metrics: m})
+	work := t.TempDir()
+	a := filepath.Join(work, "a")
+	runGit(t, "", "clone", "-q", url, a)
+	commitFile(t, a, "1")
+	runGit(t, a, "push", "-q", "origin", "main")
+	runGit(t, "", "-c", "protocol.version=0", "clone", "-q", url, filepath.Join(work, "b"))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, key := range []requestKey{
+		{"info-refs", 200},
+		{"upload-pack", 200},
+		{"receive-pack", 200},
+	} {
+		if m.requests[key] == 0 {
+			t.Errorf("no request counted for %v, got %v", key, m.requests)
+		}
+		if m.durations[key.service] != m.requests[key] {
+			t.Errorf("%s: %d durations for %d requests", key.service, m.durations[key.service], m.requests[key])
+		}
+		if m.bytes[key.service] <= 0 {
+			t.Errorf("%s: %d bytes", key.service, m.bytes[key.service])
+		}
+	}
+	if m.started == 0 || m.inFlight != 0 {
+		t.Errorf("%d git processes started, %d still counted as running", m.started, m.inFlight)
+	}
+}
+
+func TestMetricsInFlightConcurrent(t *testing.T) {
+	m := newPrometheusMetrics()
+	gsh, err := NewGitSmartHTTP(&GitSmartHTTPConfig{ReposRootPath: t.TempDir(), Metrics: m})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for range 100 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			gsh.gitStarted()
+			gsh.gitFinished()
+		}()
+	}
+	wg.Wait()
+	if m.inFlight != 0 || gsh.inFlight.Load() != 0 {
+		t.Errorf("in flight %d and %d after every process finished", m.inFlight, gsh.inFlight.Load())
+	}
+}
@@ -0,0 +1,23 @@
+package githttp
+
+import "net/http"
+
+// Middleware wraps a handler to intercept requests and responses, e.g. to
+// add headers or check credentials of its own.
+type Middleware func(http.Handler) http.Handler
+
+// WithMiddleware returns a copy of gsh whose handler is wrapped in mw,
+// outside of the middlewares already applied. The first of mw is
+// outermost.
+func (gsh GitSmartHTTP) WithMiddleware(mw ...Middleware) GitSmartHTTP {
+	gsh.handler = chain(gsh.handler, mw)
+	return gsh
+}
+
+// chain wraps h in mw, the first middleware ending up outermost.
+func chain(h http.Handler, mw []Middleware) http.Handler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
@@ -0,0 +1,84 @@
+package githttp
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// recordMiddleware appends name to calls on the way in and out.
+func recordMiddleware(calls *[]string, name string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			*calls = append(*calls, name+" in")
+			next.ServeHTTP(w, r)
+			*calls = append(*calls, name+" out")
+		})
+	}
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	var calls []string
+	cfg := &GitSmartHTTPConfig{
+		ReposRootPath: t.TempDir(),
+		HealthPath:    "/healthz",
+		Logger:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Middlewares: []Middleware{
+			recordMiddleware(&calls, "a"),
+			recordMiddleware(&calls, "b"),
+		},
+	}
+	gsh, err := NewGitSmartHTTP(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gsh = gsh.WithMiddleware(
+		recordMiddleware(&calls, "c"),
+		recordMiddleware(&calls, "d"),
+	)
+
+	gsh.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/healthz", nil))
+
+	want := "c in, d in, a in, b in, b out, a out, d out, c out"
+	if got := strings.Join(calls, ", "); got != want {
+		t.Errorf("calls %s, want %s", got, want)
+	}
+}
+
+func TestMiddlewareShortCircuit(t *testing.T) {
+	deny := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-Token") != "secret" {
+				http.Error(w, "denied", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	h, err := New(Config{
+		ReposRootPath: t.TempDir(),
+		HealthPath:    "/healthz",
+		Logger:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Middlewares:   []Middleware{deny},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("without token: %d, want 403", rec.Code)
+	}
+
+	req := httptest.NewRequest("GET", "/healthz", nil)
+	req.Header.Set("X-Token", "secret")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code == http.StatusForbidden {
+		t.Error("with token: still denied")
+	}
+}
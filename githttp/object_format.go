@@ -0,0 +1,47 @@
+package githttp
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// objectIDLength returns the length of hex object names in the repository
+// at repoPath, 64 when extensions.objectFormat is sha256 and 40 otherwise.
+func objectIDLength(repoPath string) int {
+	if repoObjectFormat(repoPath) == "sha256" {
+		return 64
+	}
+	return 40
+}
+
+// repoObjectFormat reads extensions.objectFormat from the repository
+// config, defaulting to sha1. It only understands the plain
+// "[extensions]" / "objectformat = ..." form git init writes.
+func repoObjectFormat(repoPath string) string {
+	f, err := os.Open(filepath.Join(repoPath, "config"))
+	if err != nil {
+		f, err = os.Open(filepath.Join(repoPath, ".git", "config"))
+		if err != nil {
+			return "sha1"
+		}
+	}
+	defer f.Close()
+
+	var section string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") {
+			section = strings.ToLower(strings.Trim(line, "[] \t"))
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if ok && section == "extensions" && strings.EqualFold(strings.TrimSpace(key), "objectformat") {
+			return strings.ToLower(strings.TrimSpace(value))
+		}
+	}
+	return "sha1"
+}
@@ -0,0 +1,95 @@
+package githttp
+
+import (
+	"container/list"
+	"sync"
+)
+
+// packCache is a size bounded LRU cache of pack and idx file contents.
+// Those files are immutable, so an entry keyed by path, size and mtime never
+// goes stale. Concurrent misses for the same key share a single read.
+type packCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	ll       *list.List
+	entries  map[string]*list.Element
+	loading  map[string]*packLoad
+}
+
+type packEntry struct {
+	key  string
+	data []byte
+}
+
+type packLoad struct {
+	wg   sync.WaitGroup
+	data []byte
+	err  error
+}
+
+func newPackCache(maxBytes int64) *packCache {
+	return &packCache{
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		entries:  make(map[string]*list.Element),
+		loading:  make(map[string]*packLoad),
+	}
+}
+
+// get returns the cached content for key, calling load on a miss.
+func (c *packCache) get(key string, load func() ([]byte, error)) ([]byte, error) {
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		c.ll.MoveToFront(el)
+		c.mu.Unlock()
+		return el.Value.(*packEntry).data, nil
+	}
+
+	if l, ok := c.loading[key]; ok {
+		c.mu.Unlock()
+		l.wg.Wait()
+		return l.data, l.err
+	}
+
+	l := &packLoad{}
+	l.wg.Add(1)
+	c.loading[key] = l
+	c.mu.Unlock()
+
+	l.data, l.err = load()
+	l.wg.Done()
+
+	c.mu.Lock()
+	delete(c.loading, key)
+	if l.err == nil {
+		c.add(key, l.data)
+	}
+	c.mu.Unlock()
+
+	return l.data, l.err
+}
+
+// fits reports whether a file of size bytes can be cached at all.
+func (c *packCache) fits(size int64) bool {
+	return size <= c.maxBytes
+}
+
+// add must be called with c.mu held.
+func (c *packCache) add(key string, data []byte) {
+	n := int64(len(data))
+	if !c.fits(n) {
+		return
+	}
+
+	for c.size+n > c.maxBytes {
+		el := c.ll.Back()
+		e := el.Value.(*packEntry)
+		c.ll.Remove(el)
+		delete(c.entries, e.key)
+		c.size -= int64(len(e.data))
+	}
+
+	c.entries[key] = c.ll.PushFront(&packEntry{key: key, data: data})
+	c.size += n
+}
@@ -0,0 +1,100 @@
+package githttp
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPackCacheHit(t *testing.T) {
+	c := newPackCache(10)
+	var loads int
+	load := func() ([]byte, error) {
+		loads++
+		return []byte("pack"), nil
+	}
+
+	for i := 0; i < 3; i++ {
+		data, err := c.get("a", load)
+		if err != nil || string(data) != "pack" {
+			t.Fatalf("get = %q, %v", data, err)
+		}
+	}
+	if loads != 1 {
+		t.Errorf("loaded %d times, want 1", loads)
+	}
+}
+
+func TestPackCacheEviction(t *testing.T) {
+	c := newPackCache(10)
+	var loads int
+	load := func(s string) func() ([]byte, error) {
+		return func() ([]byte, error) {
+			loads++
+			return []byte(s), nil
+		}
+	}
+
+	c.get("a", load("aaaa"))
+	c.get("b", load("bbbb"))
+	c.get("a", load("aaaa"))
+	// Evicts b, the least recently used.
+	c.get("c", load("cccc"))
+	c.get("a", load("aaaa"))
+	if loads != 3 {
+		t.Errorf("loaded %d times, want 3", loads)
+	}
+	if _, ok := c.entries["b"]; ok {
+		t.Error("b was not evicted")
+	}
+	if c.size > c.maxBytes {
+		t.Errorf("size %d exceeds %d", c.size, c.maxBytes)
+	}
+
+	// Too large to be cached.
+	c.get("d", load("ddddddddddd"))
+	if _, ok := c.entries["d"]; ok || c.fits(11) {
+		t.Error("entry larger than the cache was cached")
+	}
+}
+
+func TestPackCacheError(t *testing.T) {
+	c := newPackCache(10)
+	if _, err := c.get("a", func() ([]byte, error) { return nil, errors.New("boom") }); err == nil {
+		t.Fatal("expected the load error")
+	}
+	if _, ok := c.entries["a"]; ok {
+		t.Error("failed load was cached")
+	}
+}
+
+func TestPackCacheConcurrentMiss(t *testing.T) {
+	c := newPackCache(1 << 20)
+	var loads atomic.Int32
+	release := make(chan struct{})
+	load := func() ([]byte, error) {
+		loads.Add(1)
+		<-release
+		return []byte("pack"), nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if data, err := c.get("a", load); err != nil || string(data) != "pack" {
+				t.Errorf("get = %q, %v", data, err)
+			}
+		}()
+	}
+	close(release)
+	wg.Wait()
+
+	// Goroutines arriving after the load finished hit the cache, those
+	// arriving during it share it.
+	if n := loads.Load(); n != 1 {
+		t.Errorf("loaded %d times, want 1", n)
+	}
+}
@@ -0,0 +1,73 @@
+package githttp
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPktWrite(t *testing.T) {
+	for _, tc := range []struct {
+		payload string
+		want    string
+	}{
+		{"", "0004"},
+		{"a\n", "0006a\n"},
+		// Lowercase hex, zero padded.
+		{strings.Repeat("x", 26), "001e" + strings.Repeat("x", 26)},
+		// The length counts bytes, not runes.
+		{"héllo\n", "000bhéllo\n"},
+	} {
+		if got := pktWrite(tc.payload); got != tc.want {
+			t.Errorf("pktWrite(%q) = %q, want %q", tc.payload, got, tc.want)
+		}
+	}
+
+	longest := strings.Repeat("x", maxPktLen-4)
+	if got := pktWrite(longest); got[:4] != "fff0" || len(got) != maxPktLen {
+		t.Errorf("pktWrite of the longest payload starts with %q and is %d bytes", got[:4], len(got))
+	}
+}
+
+func TestPktWriteTooLong(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("pktWrite accepted a payload longer than a pkt-line")
+		}
+	}()
+	pktWrite(strings.Repeat("x", maxPktLen-3))
+}
+
+func TestPktWriteBand(t *testing.T) {
+	for _, maxLen := range []int{1000, maxPktLen} {
+		for _, n := range []int{0, 1, maxLen - 5, maxLen - 4, 3*(maxLen-5) + 7} {
+			payload := strings.Repeat("é", n/2) + strings.Repeat("y", n%2)
+			framed := pktWriteBand(2, payload, maxLen)
+
+			var got strings.Builder
+			for rest := framed; rest != ""; {
+				size, err := strconv.ParseUint(rest[:4], 16, 16)
+				if err != nil {
+					t.Fatalf("maxLen %d, %d bytes: bad length %q", maxLen, n, rest[:4])
+				}
+				if int(size) > maxLen || size < 5 {
+					t.Fatalf("maxLen %d, %d bytes: pkt-line of %d bytes", maxLen, n, size)
+				}
+				if rest[4] != 2 {
+					t.Fatalf("maxLen %d, %d bytes: band %d", maxLen, n, rest[4])
+				}
+				got.WriteString(rest[5:size])
+				rest = rest[size:]
+			}
+			if got.String() != payload {
+				t.Errorf("maxLen %d, %d bytes: payload not reassembled", maxLen, n)
+			}
+		}
+	}
+}
+
+func TestPktFlush(t *testing.T) {
+	if got := pktFlush(); got != "0000" {
+		t.Errorf("pktFlush() = %q", got)
+	}
+}
@@ -0,0 +1,154 @@
+package githttp
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MetricsPath is where the Prometheus metrics are served. It can't collide
+// with a repository, every git route ends in a file name below the repo.
+const MetricsPath = "/metrics"
+
+// durationBuckets are the upper bounds, in seconds, of the request duration
+// histogram. Clones of large repositories take minutes.
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600}
+
+type requestKey struct {
+	service string
+	status  int
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// prometheusMetrics is a Metrics that keeps everything in memory and
+// exposes it in the Prometheus text format.
+type prometheusMetrics struct {
+	mu        sync.Mutex
+	requests  map[requestKey]uint64
+	durations map[string]*histogram
+	bytes     map[string]int64
+	inFlight  int
+}
+
+func newPrometheusMetrics() *prometheusMetrics {
+	return &prometheusMetrics{
+		requests:  make(map[requestKey]uint64),
+		durations: make(map[string]*histogram),
+		bytes:     make(map[string]int64),
+	}
+}
+
+func (m *prometheusMetrics) IncRequest(service string, status int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[requestKey{service, status}]++
+}
+
+func (m *prometheusMetrics) ObserveDuration(service string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h, ok := m.durations[service]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(durationBuckets))}
+		m.durations[service] = h
+	}
+
+	s := d.Seconds()
+	for i, le := range durationBuckets {
+		if s <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += s
+	h.count++
+}
+
+func (m *prometheusMetrics) AddBytes(service string, n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bytes[service] += n
+}
+
+func (m *prometheusMetrics) AddInFlight(delta int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inFlight += delta
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format.
+func (m *prometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		methodNotAllowed(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	setHeaders(w, hdrNoCache())
+	m.write(w)
+}
+
+func (m *prometheusMetrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP git_http_backend_requests_total Requests handled, by service and HTTP status.")
+	fmt.Fprintln(w, "# TYPE git_http_backend_requests_total counter")
+	keys := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].service != keys[j].service {
+			return keys[i].service < keys[j].service
+		}
+		return keys[i].status < keys[j].status
+	})
+	for _, k := range keys {
+		fmt.Fprintf(w, "git_http_backend_requests_total{service=%q,code=\"%d\"} %d\n", k.service, k.status, m.requests[k])
+	}
+
+	fmt.Fprintln(w, "# HELP git_http_backend_request_duration_seconds Time taken to handle a request, by service.")
+	fmt.Fprintln(w, "# TYPE git_http_backend_request_duration_seconds histogram")
+	for _, service := range sortedKeys(m.durations) {
+		h := m.durations[service]
+		for i, le := range durationBuckets {
+			fmt.Fprintf(w, "git_http_backend_request_duration_seconds_bucket{service=%q,le=%q} %d\n", service, formatFloat(le), h.counts[i])
+		}
+		fmt.Fprintf(w, "git_http_backend_request_duration_seconds_bucket{service=%q,le=\"+Inf\"} %d\n", service, h.count)
+		fmt.Fprintf(w, "git_http_backend_request_duration_seconds_sum{service=%q} %s\n", service, formatFloat(h.sum))
+		fmt.Fprintf(w, "git_http_backend_request_duration_seconds_count{service=%q} %d\n", service, h.count)
+	}
+
+	fmt.Fprintln(w, "# HELP git_http_backend_response_bytes_total Bytes written to clients, by service.")
+	fmt.Fprintln(w, "# TYPE git_http_backend_response_bytes_total counter")
+	for _, service := range sortedKeys(m.bytes) {
+		fmt.Fprintf(w, "git_http_backend_response_bytes_total{service=%q} %d\n", service, m.bytes[service])
+	}
+
+	fmt.Fprintln(w, "# HELP git_http_backend_git_processes Git subprocesses currently running.")
+	fmt.Fprintln(w, "# TYPE git_http_backend_git_processes gauge")
+	fmt.Fprintf(w, "git_http_backend_git_processes %d\n", m.inFlight)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
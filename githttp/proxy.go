@@ -0,0 +1,84 @@
+package githttp
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ParseCIDRs parses a comma separated list of networks. A bare address
+// stands for itself.
+func ParseCIDRs(v string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(v, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// isTrustedProxy reports whether ip belongs to one of the TrustedProxies.
+func (gsh GitSmartHTTP) isTrustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range gsh.TrustedProxies {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client that made r. When the peer is
+// a trusted proxy, X-Forwarded-For is walked from the right, skipping the
+// trusted proxies that appended to it, and the first other address is the
+// client. Addresses left of it may have been made up by the client.
+func (gsh GitSmartHTTP) clientIP(r *http.Request) string {
+	ip := remoteIP(r)
+	if !gsh.isTrustedProxy(ip) {
+		return ip
+	}
+
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		if !gsh.isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// forwardedProto returns the scheme a trusted proxy received r with, from
+// X-Forwarded-Proto, or the empty string.
+func (gsh GitSmartHTTP) forwardedProto(r *http.Request) string {
+	if !gsh.isTrustedProxy(remoteIP(r)) {
+		return ""
+	}
+	proto, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Proto"), ",")
+	return strings.ToLower(strings.TrimSpace(proto))
+}
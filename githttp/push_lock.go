@@ -0,0 +1,52 @@
+package githttp
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// pushLockFile is the lock file taken in a repository while a push runs.
+const pushLockFile = "git-http-backend-push.lock"
+
+// pushLockPoll is how often a held push lock is tried again.
+const pushLockPoll = 50 * time.Millisecond
+
+var errPushLockTimeout = errors.New("timed out waiting for the push lock")
+
+// lockRepoForPush takes an advisory lock on the repository that other
+// servers sharing it, e.g. over NFS, respect too. It waits up to timeout
+// for pushes holding it. The returned function releases the lock.
+func lockRepoForPush(ctx context.Context, repoPath string, timeout time.Duration) (func(), error) {
+	f, err := os.OpenFile(filepath.Join(repoPath, pushLockFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		err := tryLockFile(f)
+		if err == nil {
+			return func() {
+				unlockFile(f)
+				f.Close()
+			}, nil
+		}
+		if !errors.Is(err, errLockHeld) || time.Now().After(deadline) {
+			f.Close()
+			if errors.Is(err, errLockHeld) {
+				err = errPushLockTimeout
+			}
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, ctx.Err()
+		case <-time.After(pushLockPoll):
+		}
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !unix
+
+package githttp
+
+import (
+	"errors"
+	"os"
+)
+
+var errLockHeld = errors.New("lock is held")
+
+func tryLockFile(f *os.File) error {
+	return errors.New("file locks are not supported on this platform")
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
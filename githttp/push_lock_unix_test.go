@@ -0,0 +1,84 @@
+//go:build unix
+
+package githttp
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestHoldPushLock is not a test: run by TestIntegrationPushLockHeld in a
+// process of its own, it holds the push lock of a repository, like a push
+// on another server, until its stdin is closed.
+func TestHoldPushLock(t *testing.T) {
+	repo := os.Getenv("GIT_HTTP_BACKEND_HOLD_PUSH_LOCK")
+	if repo == "" {
+		t.Skip("helper process")
+	}
+	unlock, err := lockRepoForPush(context.Background(), repo, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	fmt.Println("locked")
+	bufio.NewReader(os.Stdin).ReadString('\n')
+}
+
+func TestIntegrationPushLockHeld(t *testing.T) {
+	logs := &syncBuffer{}
+	url, repo := newIntegrationServer(t, Config{
+		PushLock:        true,
+		PushLockTimeout: 300 * time.Millisecond,
+		Logger:          slog.New(slog.NewTextHandler(logs, nil)),
+	})
+	a := filepath.Join(t.TempDir(), "a")
+	runGit(t, "", "clone", "-q", url, a)
+	head := commitFile(t, a, "1")
+
+	holder := exec.Command(os.Args[0], "-test.run=^TestHoldPushLock$")
+	holder.Env = append(os.Environ(), "GIT_HTTP_BACKEND_HOLD_PUSH_LOCK="+repo)
+	release, err := holder.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := holder.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := holder.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer release.Close()
+	if line, _ := bufio.NewReader(stdout).ReadString('\n'); line != "locked\n" {
+		t.Fatalf("helper didn't take the lock: %q", line)
+	}
+
+	start := time.Now()
+	out, err := gitCmd(a, "push", "origin", "main").CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "503") {
+		t.Errorf("push while another process holds the lock: %v\n%s", err, out)
+	}
+	if d := time.Since(start); d < 300*time.Millisecond {
+		t.Errorf("push refused after %s, before PushLockTimeout", d)
+	}
+	if !strings.Contains(logs.String(), errPushLockTimeout.Error()) {
+		t.Errorf("lock timeout not logged:\n%s", logs)
+	}
+
+	release.Close()
+	if err := holder.Wait(); err != nil {
+		t.Fatalf("helper: %s", err)
+	}
+	runGit(t, a, "push", "-q", "origin", "main")
+	if got := runGit(t, repo, "rev-parse", "main"); got != head {
+		t.Errorf("main is %s after the lock was released, want %s", got, head)
+	}
+}
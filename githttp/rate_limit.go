@@ -0,0 +1,134 @@
+package githttp
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a set of token buckets keyed by an arbitrary string, each
+// refilling at rate tokens per second up to burst.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+	sweepAt int
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+		sweepAt: 1024,
+	}
+}
+
+// allow takes a token from key's bucket. When the bucket is empty it
+// returns false and how long until the next token is available.
+func (rl *rateLimiter) allow(key string) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	b, ok := rl.buckets[key]
+	if !ok {
+		if len(rl.buckets) >= rl.sweepAt {
+			rl.sweep(now)
+		}
+		b = &tokenBucket{tokens: rl.burst, last: now}
+		rl.buckets[key] = b
+	}
+
+	b.tokens = math.Min(rl.burst, b.tokens+now.Sub(b.last).Seconds()*rl.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / rl.rate * float64(time.Second))
+		return false, wait
+	}
+
+	b.tokens--
+	return true, 0
+}
+
+// sweep drops the buckets that have refilled completely, they are no
+// different from a new one. Must be called with rl.mu held.
+func (rl *rateLimiter) sweep(now time.Time) {
+	for key, b := range rl.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rl.rate >= rl.burst {
+			delete(rl.buckets, key)
+		}
+	}
+	rl.sweepAt = 2 * len(rl.buckets)
+	if rl.sweepAt < 1024 {
+		rl.sweepAt = 1024
+	}
+}
+
+// allowRepo applies the per repository read or write limit.
+func (gsh GitSmartHTTP) allowRepo(s Service, r *http.Request) (bool, time.Duration) {
+	limiter := gsh.repoReadLimiter
+	if isWrite(s, r) {
+		limiter = gsh.repoWriteLimiter
+	}
+	if limiter == nil {
+		return true, 0
+	}
+
+	repo := path.Clean("/" + s.ParseURLNamedParams(r)["repoPath"])
+	return limiter.allow(repo)
+}
+
+// allowClient applies the per client IP limit.
+func (gsh GitSmartHTTP) allowClient(r *http.Request) (bool, time.Duration) {
+	if gsh.clientLimiter == nil {
+		return true, 0
+	}
+	return gsh.clientLimiter.allow(gsh.clientIP(r))
+}
+
+// rateLimited is the body of a 429 for JSON clients.
+type rateLimited struct {
+	Message    string `json:"message"`
+	RetryAfter int    `json:"retry_after"`
+}
+
+// tooManyRequests answers a rate limited request. The LFS API and the
+// listing, and clients accepting JSON, get a JSON body, git clients text.
+func tooManyRequests(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	secs := int(math.Ceil(retryAfter.Seconds()))
+	w.Header().Set("Retry-After", fmt.Sprint(secs))
+
+	var contentType string
+	switch {
+	case strings.Contains(r.URL.Path, "/info/lfs/"):
+		contentType = lfsMediaType
+	case r.URL.Path == ListingPath, strings.Contains(r.Header.Get("Accept"), "json"):
+		contentType = "application/json"
+	default:
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprintln(w, "Rate limit exceeded, please try again later")
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(rateLimited{Message: "rate limited", RetryAfter: secs})
+}
@@ -0,0 +1,188 @@
+package githttp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTooManyRequestsBody(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "repo.git", "objects"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	batch := `{"operation":"download","objects":[]}`
+	for _, tc := range []struct {
+		name, method, path, accept, body string
+		cfg                              Config
+		// contentType is the type of the 429, a JSON one for a JSON body.
+		contentType string
+	}{
+		{"listing", "GET", ListingPath, "", "", Config{RateLimit: 0.001}, "application/json"},
+		{"lfs", "POST", "/repo.git/info/lfs/objects/batch", lfsMediaType, batch, Config{RateLimit: 0.001}, lfsMediaType},
+		{"lfs per repository", "POST", "/repo.git/info/lfs/objects/batch", lfsMediaType, batch, Config{RepoReadRate: 0.001}, lfsMediaType},
+		{"json client", "GET", "/repo.git/HEAD", "application/json", "", Config{RateLimit: 0.001}, "application/json"},
+		{"git", "GET", "/repo.git/info/refs?service=git-upload-pack", "*/*", "", Config{RateLimit: 0.001}, "text/plain"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := tc.cfg
+			cfg.ReposRootPath = root
+			cfg.RateBurst, cfg.RepoReadBurst = 1, 1
+			cfg.EnableListing, cfg.LFS, cfg.UploadPack = true, true, true
+			cfg.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+			h, err := New(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var rec *httptest.ResponseRecorder
+			for range 2 {
+				req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+				req.Header.Set("Accept", tc.accept)
+				rec = httptest.NewRecorder()
+				h.ServeHTTP(rec, req)
+			}
+			if rec.Code != http.StatusTooManyRequests {
+				t.Fatalf("%d, want 429", rec.Code)
+			}
+			if got := rec.Header().Get("Content-Type"); got != tc.contentType {
+				t.Errorf("Content-Type %s, want %s", got, tc.contentType)
+			}
+			if rec.Header().Get("Retry-After") == "" {
+				t.Error("no Retry-After")
+			}
+
+			if tc.contentType == "text/plain" {
+				if !strings.Contains(rec.Body.String(), "Rate limit exceeded") {
+					t.Errorf("body %q", rec.Body)
+				}
+				return
+			}
+			var body rateLimited
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("%s in %q", err, rec.Body)
+			}
+			if body.Message != "rate limited" || body.RetryAfter < 1 {
+				t.Errorf("body %+v", body)
+			}
+		})
+	}
+}
+
+// TestRepoRateLimits exhausts the limits of one repository, the others are
+// served as before.
+func TestRepoRateLimits(t *testing.T) {
+	h, err := New(Config{
+		ReposRootPath:  t.TempDir(),
+		UploadPack:     true,
+		ReceivePack:    true,
+		RepoReadRate:   0.001,
+		RepoReadBurst:  2,
+		RepoWriteRate:  0.001,
+		RepoWriteBurst: 1,
+		Logger:         slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	read := "/info/refs?service=git-upload-pack"
+	write := "/info/refs?service=git-receive-pack"
+	for i, tc := range []struct {
+		path    string
+		limited bool
+	}{
+		{"/hot.git" + read, false},
+		{"/hot.git" + read, false},
+		{"/hot.git" + read, true},
+		{"/hot.git/HEAD", true},
+		{"/cold.git" + read, false},
+		{"/team/hot.git" + read, false},
+		// Pushes have a budget of their own.
+		{"/hot.git" + write, false},
+		{"/hot.git" + write, true},
+		{"/cold.git" + write, false},
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", tc.path, nil))
+		if limited := rec.Code == http.StatusTooManyRequests; limited != tc.limited {
+			t.Errorf("request %d, %s: %d, limited %t", i, tc.path, rec.Code, tc.limited)
+		}
+	}
+}
+
+func TestClientRateLimit(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("192.0.2.0/24")
+	h, err := New(Config{
+		ReposRootPath:  t.TempDir(),
+		UploadPack:     true,
+		RateLimit:      0.001,
+		RateBurst:      2,
+		TrustedProxies: []*net.IPNet{proxies},
+		Logger:         slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, tc := range []struct {
+		remote, forwardedFor string
+		limited              bool
+	}{
+		{"198.51.100.1", "", false},
+		{"198.51.100.1", "", false},
+		{"198.51.100.1", "", true},
+		{"198.51.100.2", "", false},
+		// Behind a trusted proxy the client is the forwarded address.
+		{"192.0.2.1", "203.0.113.1", false},
+		{"192.0.2.1", "203.0.113.2", false},
+		{"192.0.2.1", "203.0.113.3", false},
+		{"192.0.2.2", "203.0.113.1", false},
+		{"192.0.2.1", "203.0.113.1", true},
+		// Others can't pick another address to dodge the limit.
+		{"198.51.100.1", "203.0.113.9", true},
+	} {
+		req := httptest.NewRequest("GET", "/repo.git/info/refs?service=git-upload-pack", nil)
+		req.RemoteAddr = tc.remote + ":1234"
+		if tc.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", tc.forwardedFor)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if limited := rec.Code == http.StatusTooManyRequests; limited != tc.limited {
+			t.Errorf("request %d from %s for %s: %d, limited %t", i, tc.remote, tc.forwardedFor, rec.Code, tc.limited)
+		}
+		if tc.limited && rec.Header().Get("Retry-After") == "" {
+			t.Errorf("request %d: no Retry-After", i)
+		}
+	}
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	rl := newRateLimiter(10, 1)
+	for i := range 1024 {
+		if ok, _ := rl.allow(fmt.Sprint(i)); !ok {
+			t.Fatalf("first request of client %d limited", i)
+		}
+	}
+	if ok, wait := rl.allow("0"); ok || wait <= 0 {
+		t.Errorf("second request allowed %t, wait %s", ok, wait)
+	}
+
+	// Every bucket refills within 100ms, the next new client drops them.
+	time.Sleep(150 * time.Millisecond)
+	rl.allow("new")
+	if n := len(rl.buckets); n != 1 {
+		t.Errorf("%d buckets after the sweep, want 1", n)
+	}
+}
@@ -0,0 +1,256 @@
+package githttp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// refUpdate is a single "<old-id> <new-id> <ref>" command sent by git
+// send-pack at the beginning of a receive-pack request.
+type refUpdate struct {
+	OldID string
+	NewID string
+	Ref   string
+}
+
+// receivePackRequest is the command list of a receive-pack request.
+type receivePackRequest struct {
+	// Shallow are the ids of the "shallow <id>" lines a client with a
+	// shallow repository sends ahead of the commands.
+	Shallow      []string
+	Commands     []refUpdate
+	Capabilities map[string]struct{}
+	// Signed is set when the commands came inside a push certificate.
+	Signed bool
+	// Options are the push options sent with git push -o.
+	Options []string
+	// Raw holds every byte consumed from the body, so it can be replayed to
+	// git ahead of the remaining pack data.
+	Raw []byte
+}
+
+func (rp *receivePackRequest) hasCapability(c string) bool {
+	_, ok := rp.Capabilities[c]
+	return ok
+}
+
+func (rp *receivePackRequest) hasOption(o string) bool {
+	for _, opt := range rp.Options {
+		if opt == o {
+			return true
+		}
+	}
+	return false
+}
+
+// readReceivePackRequest reads the pkt-line command list up to and including
+// the terminating flush packet, followed by the push options if the client
+// sends them. Commands of a signed push are taken from the push certificate.
+// Leading shallow lines are recorded, the capabilities come with the first
+// line after them.
+func readReceivePackRequest(r *bufio.Reader) (*receivePackRequest, error) {
+	rp := &receivePackRequest{
+		Capabilities: make(map[string]struct{}),
+	}
+
+	var inCert, inCertCommands bool
+	for {
+		hdr := make([]byte, 4)
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			return nil, err
+		}
+		rp.Raw = append(rp.Raw, hdr...)
+
+		size, err := strconv.ParseUint(string(hdr), 16, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pkt-line length %q", hdr)
+		}
+		if size == 0 {
+			if rp.hasCapability("push-options") {
+				return rp, readPushOptions(r, rp)
+			}
+			return rp, nil
+		}
+		if size < 4 {
+			return nil, fmt.Errorf("invalid pkt-line length %q", hdr)
+		}
+
+		line := make([]byte, size-4)
+		if _, err := io.ReadFull(r, line); err != nil {
+			return nil, err
+		}
+		rp.Raw = append(rp.Raw, line...)
+
+		first := len(rp.Commands) == 0 && !rp.Signed
+		if first {
+			if id, ok := strings.CutPrefix(strings.TrimSuffix(string(line), "\n"), "shallow "); ok {
+				if !isObjectID(id) {
+					return nil, errors.New("malformed receive-pack shallow line")
+				}
+				rp.Shallow = append(rp.Shallow, id)
+				continue
+			}
+			if i := bytes.IndexByte(line, 0); i >= 0 {
+				for _, c := range strings.Fields(string(line[i+1:])) {
+					rp.Capabilities[c] = struct{}{}
+				}
+				line = line[:i]
+			}
+		}
+
+		text := strings.TrimSuffix(string(line), "\n")
+		if first && text == "push-cert" {
+			rp.Signed, inCert = true, true
+			continue
+		}
+
+		if inCert {
+			switch {
+			case text == "push-cert-end":
+				inCert = false
+			case text == "":
+				inCertCommands = true
+			case inCertCommands:
+				if cmd, ok := parseRefUpdate(text); ok {
+					rp.Commands = append(rp.Commands, cmd)
+				}
+			}
+			continue
+		}
+
+		cmd, ok := parseRefUpdate(text)
+		if !ok {
+			return nil, errors.New("malformed receive-pack command")
+		}
+		rp.Commands = append(rp.Commands, cmd)
+	}
+}
+
+// readPushOptions reads the flush terminated list of push options.
+func readPushOptions(r *bufio.Reader, rp *receivePackRequest) error {
+	for {
+		hdr := make([]byte, 4)
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			return err
+		}
+		rp.Raw = append(rp.Raw, hdr...)
+
+		size, err := strconv.ParseUint(string(hdr), 16, 16)
+		if err != nil || (size > 0 && size < 4) {
+			return fmt.Errorf("invalid pkt-line length %q", hdr)
+		}
+		if size == 0 {
+			return nil
+		}
+
+		line := make([]byte, size-4)
+		if _, err := io.ReadFull(r, line); err != nil {
+			return err
+		}
+		rp.Raw = append(rp.Raw, line...)
+		rp.Options = append(rp.Options, strings.TrimSuffix(string(line), "\n"))
+	}
+}
+
+func parseRefUpdate(line string) (refUpdate, bool) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 || !isObjectID(fields[0]) || !isObjectID(fields[1]) {
+		return refUpdate{}, false
+	}
+
+	return refUpdate{
+		OldID: fields[0],
+		NewID: fields[1],
+		Ref:   fields[2],
+	}, true
+}
+
+// isDeletion reports whether cmd deletes its ref, its new id being all
+// zeros.
+func (cmd refUpdate) isDeletion() bool {
+	return strings.Trim(cmd.NewID, "0") == ""
+}
+
+// isObjectID reports whether s is a hex SHA-1 or SHA-256 object name.
+func isObjectID(s string) bool {
+	if len(s) != 40 && len(s) != 64 {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// isSymbolicRef reports whether ref is stored as a symbolic ref in the
+// repository. Packed refs are never symbolic.
+func isSymbolicRef(repoPath, ref string) bool {
+	if ref != "HEAD" && (!strings.HasPrefix(ref, "refs/") || strings.Contains(ref, "..")) {
+		return false
+	}
+
+	b, err := os.ReadFile(filepath.Join(repoPath, filepath.FromSlash(ref)))
+	if err != nil {
+		return false
+	}
+	return bytes.HasPrefix(b, []byte("ref: "))
+}
+
+// rejectReceivePack answers a receive-pack request without running git,
+// refusing every command. reasons maps the offending refs to the message
+// shown to the user, the other refs are rejected as collateral.
+func rejectReceivePack(w http.ResponseWriter, rp *receivePackRequest, reasons map[string]string) {
+	w.Header().Set("Content-Type", fmt.Sprintf("application/x-%s-result", receivePack))
+	setHeaders(w, hdrNoCache())
+	w.WriteHeader(http.StatusOK)
+
+	// Longest side-band packet, 0 without side-band.
+	band := 0
+	switch {
+	case rp.hasCapability("side-band-64k"):
+		band = maxPktLen
+	case rp.hasCapability("side-band"):
+		band = 1000
+	}
+
+	var msg strings.Builder
+	for _, reason := range reasons {
+		fmt.Fprintf(&msg, "error: %s\n", reason)
+	}
+	if band > 0 {
+		fmt.Fprint(w, pktWriteBand(2, msg.String(), band))
+	}
+
+	if rp.hasCapability("report-status") || rp.hasCapability("report-status-v2") {
+		var report strings.Builder
+		report.WriteString(pktWrite("unpack ok\n"))
+		for _, cmd := range rp.Commands {
+			reason, ok := reasons[cmd.Ref]
+			if !ok {
+				reason = "push rejected"
+			}
+			report.WriteString(pktWrite(fmt.Sprintf("ng %s %s\n", cmd.Ref, reason)))
+		}
+		report.WriteString(pktFlush())
+
+		if band > 0 {
+			fmt.Fprint(w, pktWriteBand(1, report.String(), band))
+		} else {
+			fmt.Fprint(w, report.String())
+		}
+	}
+
+	if band > 0 {
+		fmt.Fprint(w, pktFlush())
+	}
+}
@@ -0,0 +1,132 @@
+package githttp
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+const (
+	oidA = "1111111111111111111111111111111111111111"
+	oidB = "2222222222222222222222222222222222222222"
+	oidZ = "0000000000000000000000000000000000000000"
+)
+
+func parseReceivePack(t *testing.T, body string) *receivePackRequest {
+	t.Helper()
+	rp, err := readReceivePackRequest(bufio.NewReader(strings.NewReader(body)))
+	if err != nil {
+		t.Fatalf("readReceivePackRequest: %s", err)
+	}
+	if string(rp.Raw) != body {
+		t.Errorf("Raw = %q, want the whole body %q", rp.Raw, body)
+	}
+	return rp
+}
+
+func TestReadReceivePackRequestShallow(t *testing.T) {
+	body := pktWrite("shallow "+oidA+"\n") +
+		pktWrite("shallow "+oidB+"\n") +
+		pktWrite(oidA+" "+oidB+" refs/heads/main\x00report-status side-band-64k\n") +
+		pktWrite(oidZ+" "+oidA+" refs/heads/topic\n") +
+		pktFlush()
+
+	rp := parseReceivePack(t, body)
+	if len(rp.Shallow) != 2 || rp.Shallow[0] != oidA || rp.Shallow[1] != oidB {
+		t.Errorf("Shallow = %q, want [%s %s]", rp.Shallow, oidA, oidB)
+	}
+	if len(rp.Commands) != 2 || rp.Commands[0].Ref != "refs/heads/main" || rp.Commands[1].Ref != "refs/heads/topic" {
+		t.Errorf("Commands = %+v", rp.Commands)
+	}
+	if !rp.hasCapability("report-status") || !rp.hasCapability("side-band-64k") {
+		t.Errorf("Capabilities = %v, want those of the first command", rp.Capabilities)
+	}
+}
+
+func TestReadReceivePackRequestShallowSigned(t *testing.T) {
+	body := pktWrite("shallow "+oidA+"\n") +
+		pktWrite("push-cert\x00report-status\n") +
+		pktWrite("certificate version 0.1\n") +
+		pktWrite("pusher u 0 +0000\n") +
+		pktWrite("\n") +
+		pktWrite(oidA+" "+oidB+" refs/heads/main\n") +
+		pktWrite("push-cert-end\n") +
+		pktFlush()
+
+	rp := parseReceivePack(t, body)
+	if !rp.Signed || len(rp.Shallow) != 1 {
+		t.Errorf("Signed = %t, Shallow = %q", rp.Signed, rp.Shallow)
+	}
+	if len(rp.Commands) != 1 || rp.Commands[0].NewID != oidB {
+		t.Errorf("Commands = %+v", rp.Commands)
+	}
+	if !rp.hasCapability("report-status") {
+		t.Errorf("Capabilities = %v", rp.Capabilities)
+	}
+}
+
+func TestReadReceivePackRequestMalformed(t *testing.T) {
+	for name, body := range map[string]string{
+		"shallow after command": pktWrite(oidA+" "+oidB+" refs/heads/main\x00report-status\n") +
+			pktWrite("shallow "+oidA+"\n") + pktFlush(),
+		"bad shallow id": pktWrite("shallow nope\n") + pktFlush(),
+		"bad command":    pktWrite("nope\n") + pktFlush(),
+		"bad length":     "zzzz",
+		"truncated":      pktWrite(oidA + " " + oidB + " refs/heads/main\n")[:20],
+	} {
+		if _, err := readReceivePackRequest(bufio.NewReader(strings.NewReader(body))); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestReadReceivePackRequestDeletionsAndOptions(t *testing.T) {
+	body := pktWrite(oidA+" "+oidZ+" refs/heads/main\x00report-status push-options\n") +
+		pktWrite(oidB+" "+oidZ+" refs/heads/topic\n") +
+		pktFlush() +
+		pktWrite(AllowDeleteAll+"\n") +
+		pktWrite("ci.skip\n") +
+		pktFlush()
+
+	rp := parseReceivePack(t, body)
+	if len(rp.Commands) != 2 {
+		t.Fatalf("Commands = %+v", rp.Commands)
+	}
+	for _, cmd := range rp.Commands {
+		if !cmd.isDeletion() {
+			t.Errorf("%s is not a deletion", cmd.Ref)
+		}
+	}
+	if !rp.hasOption(AllowDeleteAll) || !rp.hasOption("ci.skip") || rp.hasOption("other") {
+		t.Errorf("Options = %q", rp.Options)
+	}
+}
+
+func TestReadReceivePackRequestOptionsNeedCapability(t *testing.T) {
+	// Without push-options the flush ends the request, what follows is
+	// the pack.
+	body := pktWrite(oidA+" "+oidZ+" refs/heads/main\x00report-status\n") + pktFlush()
+	rp, err := readReceivePackRequest(bufio.NewReader(strings.NewReader(body + "PACK")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rp.Raw) != body || len(rp.Options) != 0 {
+		t.Errorf("Raw = %q, Options = %q", rp.Raw, rp.Options)
+	}
+}
+
+func TestIsDeletion(t *testing.T) {
+	for _, tc := range []struct {
+		newID string
+		want  bool
+	}{
+		{oidZ, true},
+		{strings.Repeat("0", 64), true},
+		{oidA, false},
+		{"0000000000000000000000000000000000000001", false},
+	} {
+		if got := (refUpdate{OldID: oidA, NewID: tc.newID}).isDeletion(); got != tc.want {
+			t.Errorf("isDeletion(%s) = %t, want %t", tc.newID, got, tc.want)
+		}
+	}
+}
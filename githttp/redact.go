@@ -0,0 +1,56 @@
+package githttp
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const redacted = "REDACTED"
+
+// sensitiveHeaders are always masked when request headers are logged.
+var sensitiveHeaders = []string{
+	"Authorization",
+	"Cookie",
+	"Proxy-Authorization",
+}
+
+// redactURL renders u for logging with user info and any configured
+// sensitive query parameters masked.
+func (gsh GitSmartHTTP) redactURL(u *url.URL) string {
+	ru := *u
+	if ru.User != nil {
+		ru.User = url.User(redacted)
+	}
+
+	if ru.RawQuery != "" {
+		q := ru.Query()
+		for key := range q {
+			if gsh.isSensitiveParam(key) {
+				q[key] = []string{redacted}
+			}
+		}
+		ru.RawQuery = q.Encode()
+	}
+	return ru.RequestURI()
+}
+
+func (gsh GitSmartHTTP) isSensitiveParam(key string) bool {
+	for _, p := range gsh.RedactQueryParams {
+		if strings.EqualFold(p, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactHeader returns a copy of h that is safe to log.
+func redactHeader(h http.Header) http.Header {
+	rh := h.Clone()
+	for _, key := range sensitiveHeaders {
+		if _, ok := rh[key]; ok {
+			rh[key] = []string{redacted}
+		}
+	}
+	return rh
+}
@@ -0,0 +1,275 @@
+package githttp
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var errPathEscapesRoot = errors.New("path escapes the repositories root")
+
+// RepoRoot maps the URL paths below Prefix to the repositories in Path.
+type RepoRoot struct {
+	Prefix string
+	Path   string
+}
+
+// roots returns the configured roots, ReposRootPath serving every path
+// when Roots is empty.
+func (gsh GitSmartHTTP) roots() []RepoRoot {
+	if len(gsh.Roots) == 0 {
+		return []RepoRoot{{Prefix: "/", Path: gsh.ReposRootPath}}
+	}
+	return gsh.Roots
+}
+
+// rootFor returns the first root whose prefix the requested URL path is
+// below, and the rest of the path.
+func (gsh GitSmartHTTP) rootFor(requested string) (RepoRoot, string, bool) {
+	for _, root := range gsh.roots() {
+		prefix := strings.TrimSuffix(root.Prefix, "/")
+		if requested == prefix || prefix == "" {
+			return root, strings.TrimPrefix(requested, prefix), true
+		}
+		if rest, ok := strings.CutPrefix(requested, prefix+"/"); ok {
+			return root, "/" + rest, true
+		}
+	}
+	return RepoRoot{}, "", false
+}
+
+// repoName returns the URL path of the repository at fullPath, relative to
+// the roots and slash separated.
+func (gsh GitSmartHTTP) repoName(fullPath string) string {
+	for _, root := range gsh.roots() {
+		rel, err := filepath.Rel(filepath.Clean(root.Path), fullPath)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		return strings.TrimPrefix(path.Join(root.Prefix, filepath.ToSlash(rel)), "/")
+	}
+	return filepath.ToSlash(fullPath)
+}
+
+// isRoot reports whether fullPath is one of the roots themselves.
+func (gsh GitSmartHTTP) isRoot(fullPath string) bool {
+	for _, root := range gsh.roots() {
+		if fullPath == filepath.Clean(root.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// realRoot returns dir with symlinks resolved. A root that can't be
+// resolved is returned unchanged, the health check reports it.
+func realRoot(dir string) string {
+	if dir == "" {
+		return dir
+	}
+	real, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return dir
+	}
+	return real
+}
+
+// resolveRepoPath joins the requested URL path onto root and returns the
+// resulting filesystem path, or an error if it would end up outside root.
+func resolveRepoPath(root, requested string) (string, error) {
+	if strings.IndexByte(requested, 0) >= 0 {
+		return "", errors.New("path contains a NUL byte")
+	}
+
+	root = filepath.Clean(root)
+	full := filepath.Join(root, filepath.FromSlash(requested))
+
+	rel, err := filepath.Rel(root, full)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errPathEscapesRoot
+	}
+	return full, nil
+}
+
+// resolve is resolveRepoPath against the root the path is below. It
+// answers 404 when no root matches and 400 when the path is rejected.
+func (gsh GitSmartHTTP) resolve(w http.ResponseWriter, r *http.Request, requested string) (string, bool) {
+	root, rest, ok := gsh.rootFor(requested)
+	if !ok {
+		w.Header().Set("Content-Type", "text/plain")
+		http.NotFound(w, r)
+		return "", false
+	}
+
+	full, err := resolveRepoPath(root.Path, rest)
+	if err != nil {
+		requestLog(r).Info("Rejected path", "path", requested, "err", err)
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusBadRequest)
+		return "", false
+	}
+	return full, true
+}
+
+// resolveRepo is resolve for a repository path, it answers 404 unless the
+// path is a git repository directory. The root itself is never served as a
+// repository.
+func (gsh GitSmartHTTP) resolveRepo(w http.ResponseWriter, r *http.Request, requested string) (string, bool) {
+	full, ok := gsh.resolve(w, r, requested)
+	if !ok {
+		return "", false
+	}
+
+	if !gsh.FollowSymlinks && gsh.escapesRoot(requested, full) {
+		requestLog(r).Info("Rejected symlink out of the root", "path", requested)
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusForbidden)
+		return "", false
+	}
+
+	if strings.TrimSpace(strings.Trim(requested, "/")) == "" || gsh.isRoot(full) || !isGitRepo(full) {
+		w.Header().Set("Content-Type", "text/plain")
+		http.NotFound(w, r)
+		return "", false
+	}
+	return full, true
+}
+
+// escapesRoot reports whether full, the path requested resolves to, leads
+// out of its root once symlinks are resolved. Paths that don't exist don't
+// escape, they aren't found later on.
+func (gsh GitSmartHTTP) escapesRoot(requested, full string) bool {
+	root, _, ok := gsh.rootFor(requested)
+	if !ok {
+		return false
+	}
+	real, err := filepath.EvalSymlinks(full)
+	if err != nil {
+		return false
+	}
+	return !isBelow(root.Path, real)
+}
+
+// isBelow reports whether p is dir or inside it, lexically.
+func isBelow(dir, p string) bool {
+	rel, err := filepath.Rel(filepath.Clean(dir), p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// isGitRepo reports whether path is a directory laid out like a git
+// repository, either bare or with a .git directory.
+func isGitRepo(path string) bool {
+	for _, dir := range []string{path, filepath.Join(path, ".git")} {
+		head, err := os.Stat(filepath.Join(dir, "HEAD"))
+		if err != nil || !head.Mode().IsRegular() {
+			continue
+		}
+		if objects, err := os.Stat(filepath.Join(dir, "objects")); err == nil && objects.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPathLimits answers 414 for paths longer than MaxPathLength and 400
+// for paths with more than MaxPathDepth segments.
+func (gsh GitSmartHTTP) checkPathLimits(w http.ResponseWriter, r *http.Request) bool {
+	p := r.URL.Path
+	if gsh.MaxPathLength > 0 && len(p) > gsh.MaxPathLength {
+		requestLog(r).Info("Rejected path", "length", len(p))
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusRequestURITooLong)
+		return false
+	}
+
+	if gsh.MaxPathDepth > 0 && pathDepth(p) > gsh.MaxPathDepth {
+		requestLog(r).Info("Rejected path", "depth", pathDepth(p))
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// pathDepth counts the non-empty segments of a slash separated path.
+func pathDepth(p string) int {
+	n := 0
+	for _, seg := range strings.Split(p, "/") {
+		if seg != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// autoCreateRepo creates the missing bare repository a push is heading for
+// when AutoCreate is enabled. It returns false when it answered the request
+// itself.
+func (gsh GitSmartHTTP) autoCreateRepo(w http.ResponseWriter, r *http.Request, requested, serviceType string) bool {
+	if !gsh.AutoCreate || serviceType != receivePack || !gsh.serviceAccess(receivePack) {
+		return true
+	}
+
+	full, ok := gsh.resolve(w, r, requested)
+	if !ok {
+		return false
+	}
+	if strings.TrimSpace(strings.Trim(requested, "/")) == "" || gsh.isRoot(full) {
+		return true
+	}
+	if _, err := os.Stat(full); !os.IsNotExist(err) {
+		return true
+	}
+	if !gsh.canCreateRepo(r, requested, full) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusForbidden)
+		return false
+	}
+
+	if !gsh.authorize(w, r, full, receivePack) {
+		return false
+	}
+
+	gs := gsh.newGitRPCClient(false)
+	gs.InitBare(r.Context(), full, gsh.InitTemplate)
+	if _, err := gs.Output(); err != nil {
+		requestLog(r).Error("Cannot create repository", "repo", full, "err", err, "stderr", exitStderr(err))
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+
+	requestLog(r).Info("Created repository", "repo", full)
+	return true
+}
+
+// canCreateRepo reports whether a repository may be created at full, which
+// doesn't exist. Its nearest existing ancestor must not lead out of the
+// root through a symlink unless FollowSymlinks, and no ancestor below the
+// root may be a repository already.
+func (gsh GitSmartHTTP) canCreateRepo(r *http.Request, requested, full string) bool {
+	root, _, ok := gsh.rootFor(requested)
+	if !ok {
+		return false
+	}
+
+	checked := false
+	for dir := filepath.Dir(full); dir != filepath.Clean(root.Path) && isBelow(root.Path, dir); dir = filepath.Dir(dir) {
+		if _, err := os.Stat(dir); err != nil {
+			continue
+		}
+		if !checked && !gsh.FollowSymlinks && gsh.escapesRoot(requested, dir) {
+			requestLog(r).Info("Rejected symlink out of the root", "path", requested)
+			return false
+		}
+		checked = true
+		if isGitRepo(dir) {
+			requestLog(r).Info("Refused to create a repository inside another", "path", requested, "repo", dir)
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,350 @@
+package githttp
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCanCreateRepo(t *testing.T) {
+	// The temporary directory may itself be below a symlink, e.g. on macOS.
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(dir, "root")
+	outside := filepath.Join(dir, "outside")
+	for _, d := range []string{root, outside, filepath.Join(root, "r.git", "objects")} {
+		if err := os.MkdirAll(d, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(root, "r.git", "HEAD"), []byte("ref: refs/heads/main\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Skipf("cannot create symlinks: %s", err)
+	}
+
+	for _, tc := range []struct {
+		requested      string
+		followSymlinks bool
+		want           bool
+	}{
+		{"/new.git", false, true},
+		{"/group/sub/new.git", false, true},
+		{"/link/new.git", true, true},
+		{"/link/new.git", false, false},
+		{"/link/missing/new.git", false, false},
+		{"/r.git/new.git", true, false},
+		{"/r.git/objects/new.git", true, false},
+	} {
+		gsh := GitSmartHTTP{GitSmartHTTPConfig: &GitSmartHTTPConfig{
+			ReposRootPath:  root,
+			FollowSymlinks: tc.followSymlinks,
+		}}
+		full := filepath.Join(root, filepath.FromSlash(tc.requested))
+		r := httptest.NewRequest("GET", tc.requested, nil)
+		if got := gsh.canCreateRepo(r, tc.requested, full); got != tc.want {
+			t.Errorf("canCreateRepo(%s, follow=%t) = %t, want %t", tc.requested, tc.followSymlinks, got, tc.want)
+		}
+	}
+}
+
+// TestIntegrationAutoCreateTemplate pushes to a missing repository, which
+// is created from the template directory.
+func TestIntegrationAutoCreateTemplate(t *testing.T) {
+	template := t.TempDir()
+	hook := "#!/bin/sh\nexit 0\n"
+	if err := os.MkdirAll(filepath.Join(template, "hooks"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(template, "hooks", "post-receive"), []byte(hook), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(template, "description"), []byte("from the template\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	url, repo := newIntegrationServer(t, Config{AutoCreate: true, InitTemplate: template})
+	url = strings.TrimSuffix(url, "/repo.git") + "/team/new.git"
+	created := filepath.Join(filepath.Dir(repo), "team", "new.git")
+
+	work := filepath.Join(t.TempDir(), "work")
+	runGit(t, "", "init", "-q", "-b", "main", work)
+	commitFile(t, work, "1")
+	runGit(t, work, "push", "-q", url, "main")
+
+	if b, err := os.ReadFile(filepath.Join(created, "hooks", "post-receive")); err != nil || string(b) != hook {
+		t.Errorf("template hook: %q, %v", b, err)
+	}
+	if b, _ := os.ReadFile(filepath.Join(created, "description")); string(b) != "from the template\n" {
+		t.Errorf("description %q", b)
+	}
+}
+
+func TestValidateInitTemplate(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, template := range []string{filepath.Join(t.TempDir(), "missing"), file} {
+		cfg := Config{ReposRootPath: t.TempDir(), AutoCreate: true, InitTemplate: template}
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("template %s accepted", template)
+		}
+	}
+}
+
+func TestResolveRepoPath(t *testing.T) {
+	root := filepath.FromSlash("/srv/git")
+	for _, tc := range []struct {
+		requested, want string
+	}{
+		{"/a.git", "/srv/git/a.git"},
+		{"/team/../a.git", "/srv/git/a.git"},
+		{"", "/srv/git"},
+		{"/", "/srv/git"},
+		// Absolute paths are below the root like any other.
+		{"//etc/passwd", "/srv/git/etc/passwd"},
+		// Still encoded, a file named %2e%2e.
+		{"/%2e%2e/a.git", "/srv/git/%2e%2e/a.git"},
+		{"/..", ""},
+		{"/../git-other/a.git", ""},
+		{"/team/../../etc", ""},
+		{"/a\x00.git", ""},
+	} {
+		got, err := resolveRepoPath(root, tc.requested)
+		switch {
+		case tc.want == "" && err == nil:
+			t.Errorf("resolveRepoPath(%q) = %s, want an error", tc.requested, got)
+		case tc.want != "" && (err != nil || got != filepath.FromSlash(tc.want)):
+			t.Errorf("resolveRepoPath(%q) = %s, %v, want %s", tc.requested, got, err, tc.want)
+		}
+	}
+}
+
+// TestRepoPathRequests requests files of repositories through paths
+// trying to leave the roots, through symlinks, and of things that are no
+// repositories.
+func TestRepoPathRequests(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	public := filepath.Join(dir, "public")
+	private := filepath.Join(dir, "private")
+	fakeRepo := func(p string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Join(p, "objects"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(p, "HEAD"), []byte("ref: refs/heads/main\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The roots look like repositories themselves.
+	fakeRepo(public)
+	fakeRepo(private)
+	fakeRepo(filepath.Join(public, "a.git"))
+	fakeRepo(filepath.Join(private, "secret.git"))
+	fakeRepo(filepath.Join(dir, "outside.git"))
+	if err := os.WriteFile(filepath.Join(public, "file.git"), []byte("not a repository"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(public, "a.git"), filepath.Join(public, "inside.git")); err != nil {
+		t.Skipf("cannot create symlinks: %s", err)
+	}
+	if err := os.Symlink(filepath.Join(dir, "outside.git"), filepath.Join(public, "outside.git")); err != nil {
+		t.Fatal(err)
+	}
+	// A linked directory above the repository.
+	if err := os.Symlink(dir, filepath.Join(public, "elsewhere")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(public, filepath.Join(public, "self")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, followSymlinks := range []bool{false, true} {
+		h, err := New(Config{
+			Roots:          []RepoRoot{{Prefix: "/public", Path: public}, {Prefix: "/private", Path: private}},
+			UploadPack:     true,
+			FollowSymlinks: followSymlinks,
+			Logger:         slog.New(slog.NewTextHandler(io.Discard, nil)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		outside := http.StatusForbidden
+		if followSymlinks {
+			outside = http.StatusOK
+		}
+		for _, tc := range []struct {
+			path string
+			want int
+		}{
+			{"/public/a.git/HEAD", http.StatusOK},
+			{"/public/%2e%2e/outside.git/HEAD", http.StatusBadRequest},
+			{"/public/a.git/%2e%2e/%2e%2e/outside.git/HEAD", http.StatusBadRequest},
+			{"/public/..%2foutside.git/HEAD", http.StatusBadRequest},
+			// Out of one root into the other.
+			{"/public/../private/secret.git/HEAD", http.StatusBadRequest},
+			{"/public/%2e%2e/private/secret.git/HEAD", http.StatusBadRequest},
+			{"/publicity/a.git/HEAD", http.StatusNotFound},
+			{"//public/a.git/HEAD", http.StatusNotFound},
+			{"/public/inside.git/HEAD", http.StatusOK},
+			{"/public/outside.git/HEAD", outside},
+			{"/public/elsewhere/outside.git/HEAD", outside},
+			{"/public/elsewhere/private/secret.git/HEAD", outside},
+			{"/public/self/a.git/HEAD", http.StatusOK},
+			{"/public/file.git/HEAD", http.StatusNotFound},
+			{"/public/missing.git/HEAD", http.StatusNotFound},
+			// The roots aren't served as repositories.
+			{"/public/HEAD", http.StatusNotFound},
+			{"/HEAD", http.StatusNotFound},
+		} {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", tc.path, nil))
+			if rec.Code != tc.want {
+				t.Errorf("FollowSymlinks %t, GET %s: %d, want %d", followSymlinks, tc.path, rec.Code, tc.want)
+			}
+		}
+	}
+}
+
+func TestPathLimits(t *testing.T) {
+	long := "/" + strings.Repeat("x", 100) + ".git/HEAD"
+	deep := "/a/b/c/d/e.git/HEAD"
+	for _, limited := range []bool{false, true} {
+		cfg := Config{
+			ReposRootPath: t.TempDir(),
+			UploadPack:    true,
+			Logger:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+		}
+		if limited {
+			cfg.MaxPathLength, cfg.MaxPathDepth = 100, 4
+		}
+		h, err := New(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, tc := range []struct {
+			path string
+			want int
+		}{
+			{"/a.git/HEAD", http.StatusNotFound},
+			{"/a/b/c.git/HEAD", http.StatusNotFound},
+			{"/" + strings.Repeat("x", 99-len("/.git/HEAD")) + ".git/HEAD", http.StatusNotFound},
+			{long, http.StatusRequestURITooLong},
+			{deep, http.StatusBadRequest},
+			// Empty segments don't count.
+			{"/a//b///c.git/HEAD", http.StatusNotFound},
+			{"/" + strings.Repeat("a/", 1000) + "r.git/info/refs?service=git-upload-pack", http.StatusRequestURITooLong},
+		} {
+			want := tc.want
+			if !limited {
+				want = http.StatusNotFound
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", tc.path, nil))
+			if rec.Code != want {
+				t.Errorf("limited %t, GET %.40s...: %d, want %d", limited, tc.path, rec.Code, want)
+			}
+		}
+	}
+}
+
+// TestEmptyRepoPath serves a root that is itself a repository: requests
+// that don't name a repository below it answer 404.
+func TestEmptyRepoPath(t *testing.T) {
+	gitEnv(t)
+	root := t.TempDir()
+	runGit(t, "", "init", "-q", "--bare", root)
+
+	h, err := New(Config{
+		ReposRootPath: root,
+		UploadPack:    true,
+		ReceivePack:   true,
+		Logger:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct{ method, path string }{
+		{"GET", "/info/refs?service=git-upload-pack"},
+		{"GET", "/info/refs?service=git-receive-pack"},
+		{"GET", "//info/refs?service=git-upload-pack"},
+		{"GET", "/%20/info/refs?service=git-upload-pack"},
+		{"GET", "/./info/refs?service=git-upload-pack"},
+		{"GET", "/HEAD"},
+		{"GET", "//HEAD"},
+		{"GET", "/info/refs"},
+		{"POST", "/git-upload-pack"},
+		{"POST", "//git-receive-pack"},
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(tc.method, tc.path, strings.NewReader("0000")))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("%s %s: %d, want 404", tc.method, tc.path, rec.Code)
+		}
+	}
+}
+
+// TestSymlinkedRoot serves a root that is a symlink: its repositories are
+// served, while links and paths out of its real location are still refused.
+func TestSymlinkedRoot(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	real := filepath.Join(dir, "real")
+	for _, repo := range []string{filepath.Join(real, "a.git"), filepath.Join(dir, "outside.git")} {
+		if err := os.MkdirAll(filepath.Join(repo, "objects"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(repo, "HEAD"), []byte("ref: refs/heads/main\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root := filepath.Join(dir, "root")
+	if err := os.Symlink(real, root); err != nil {
+		t.Skipf("cannot create symlinks: %s", err)
+	}
+	if err := os.Symlink(filepath.Join(dir, "outside.git"), filepath.Join(real, "outside.git")); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := New(Config{
+		ReposRootPath: root,
+		UploadPack:    true,
+		Logger:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		path string
+		want int
+	}{
+		{"/a.git/HEAD", http.StatusOK},
+		{"/outside.git/HEAD", http.StatusForbidden},
+		{"/../outside.git/HEAD", http.StatusBadRequest},
+		{"/%2e%2e/outside.git/HEAD", http.StatusBadRequest},
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", tc.path, nil))
+		if rec.Code != tc.want {
+			t.Errorf("GET %s: %d, want %d", tc.path, rec.Code, tc.want)
+		}
+	}
+}
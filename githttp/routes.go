@@ -0,0 +1,103 @@
+package githttp
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+)
+
+// route returns the service that handles path. When several patterns
+// match, the one capturing the longest repoPath wins, so the result doesn't
+// depend on the order of Services. Routes end in fixed file names except
+// loose-ref, whose ref name would otherwise swallow the files of
+// repositories below a directory named refs; a loose ref named like one of
+// those files, e.g. refs/remotes/origin/HEAD, is not served. Among equally
+// specific matches a service accepting method is preferred, so the caller
+// can tell a 405 from a 404.
+func (gsh GitSmartHTTP) route(path, method string) (Service, bool) {
+	best := -1
+	bestLen := 0
+
+	for i, s := range gsh.Services {
+		m := s.Pattern.FindStringSubmatchIndex(path)
+		if m == nil {
+			continue
+		}
+
+		repoLen := len(path)
+		if idx := s.Pattern.SubexpIndex("repoPath"); idx >= 0 {
+			repoLen = m[2*idx+1] - m[2*idx]
+		}
+
+		switch {
+		case best < 0, repoLen > bestLen:
+		case repoLen == bestLen && s.Method == method && gsh.Services[best].Method != method:
+		default:
+			continue
+		}
+		best, bestLen = i, repoLen
+	}
+
+	if best < 0 {
+		return Service{}, false
+	}
+	return gsh.Services[best], true
+}
+
+// overlappingServices returns a warning for every pair of services with the
+// same method whose patterns can match the same path. route resolves those
+// by specificity, the warning is there to catch mistakes in the table.
+func overlappingServices(services []Service) []string {
+	var warnings []string
+
+	for i, a := range services {
+		for _, b := range services[i+1:] {
+			if a.Method != b.Method {
+				continue
+			}
+
+			if a.Pattern.String() == b.Pattern.String() {
+				warnings = append(warnings, fmt.Sprintf("route %s duplicates %s", b.Name, a.Name))
+				continue
+			}
+
+			sa, sb := literalSuffix(a.Pattern), literalSuffix(b.Pattern)
+			if sa == "" || sb == "" {
+				continue
+			}
+			if strings.HasSuffix(sa, sb) || strings.HasSuffix(sb, sa) {
+				warnings = append(warnings, fmt.Sprintf("route %s overlaps %s", b.Name, a.Name))
+			}
+		}
+	}
+	return warnings
+}
+
+// literalSuffix returns the literal text a pattern must end with, ignoring
+// the end-of-text anchor.
+func literalSuffix(re *regexp.Regexp) string {
+	parsed, err := syntax.Parse(re.String(), syntax.Perl)
+	if err != nil {
+		return ""
+	}
+	parsed = parsed.Simplify()
+	if parsed.Op != syntax.OpConcat {
+		return ""
+	}
+
+	var suffix []rune
+	subs := parsed.Sub
+loop:
+	for i := len(subs) - 1; i >= 0; i-- {
+		switch subs[i].Op {
+		case syntax.OpEndText:
+			continue
+		case syntax.OpLiteral:
+			suffix = append(append([]rune{}, subs[i].Rune...), suffix...)
+			continue
+		}
+		break loop
+	}
+	return string(suffix)
+}
@@ -0,0 +1,142 @@
+package githttp
+
+import (
+	"io"
+	"log/slog"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestRoute(t *testing.T) {
+	gsh, err := NewGitSmartHTTP(&GitSmartHTTPConfig{
+		ReposRootPath: t.TempDir(),
+		ReceivePack:   true,
+		UploadPack:    true,
+		LFS:           true,
+		Logger:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pack := "pack-" + strings.Repeat("a", 40)
+	for _, tc := range []struct {
+		method, path string
+		// want is the name of the service, empty when none matches.
+		want, repoPath string
+	}{
+		{"GET", "/foo/HEAD", "head", "/foo"},
+		{"GET", "/foo/objects/pack/" + pack + ".pack", "pack-file", "/foo"},
+		{"GET", "/foo/objects/pack/" + pack + ".idx", "idx-file", "/foo"},
+		{"GET", "/foo/objects/ab/" + strings.Repeat("c", 38), "loose-object", "/foo"},
+		{"GET", "/foo/objects/info/packs", "info-packs", "/foo"},
+		{"GET", "/foo/objects/info/alternates", "alternates", "/foo"},
+		{"GET", "/foo/info/refs", "info-refs", "/foo"},
+		{"GET", "/foo/packed-refs", "packed-refs", "/foo"},
+		{"GET", "/foo/refs/heads/main", "loose-ref", "/foo"},
+		{"POST", "/foo/git-upload-pack", "upload-pack", "/foo"},
+		{"POST", "/foo/git-receive-pack", "receive-pack", "/foo"},
+		{"POST", "/foo/info/lfs/objects/batch", "lfs-batch", "/foo"},
+		{"PUT", "/foo/info/lfs/objects/" + strings.Repeat("d", 64), "lfs-upload", "/foo"},
+		// A route for the path exists, with another method: 405.
+		{"GET", "/foo/git-upload-pack", "upload-pack", "/foo"},
+		// Repositories below a directory named refs.
+		{"GET", "/team/refs/proj.git/HEAD", "head", "/team/refs/proj.git"},
+		{"GET", "/team/refs/proj.git/info/refs", "info-refs", "/team/refs/proj.git"},
+		{"POST", "/team/refs/proj.git/git-upload-pack", "upload-pack", "/team/refs/proj.git"},
+		{"GET", "/team/refs/proj.git/refs/heads/main", "loose-ref", "/team/refs/proj.git"},
+		{"GET", "/team/refs/proj.git/objects/pack/" + pack + ".pack", "pack-file", "/team/refs/proj.git"},
+		// Repositories named like the files of another.
+		{"GET", "/objects/pack/HEAD", "head", "/objects/pack"},
+		{"GET", "/info/refs/info/refs", "info-refs", "/info/refs"},
+		{"GET", "/HEAD/HEAD", "head", "/HEAD"},
+		{"GET", "/HEAD/info/refs", "info-refs", "/HEAD"},
+		{"GET", "/foo/unknown", "", ""},
+		{"GET", "/foo/objects/pack/pack-1234.pack", "", ""},
+	} {
+		// The order of the services must not matter.
+		for _, reversed := range []bool{false, true} {
+			g := gsh
+			if reversed {
+				g.Services = make([]Service, len(gsh.Services))
+				for i, s := range gsh.Services {
+					g.Services[len(gsh.Services)-1-i] = s
+				}
+			}
+
+			s, ok := g.route(tc.path, tc.method)
+			switch {
+			case !ok && tc.want != "":
+				t.Errorf("%s %s: no route, want %s", tc.method, tc.path, tc.want)
+			case !ok:
+			case s.Name != tc.want:
+				t.Errorf("%s %s (reversed %v): route %s, want %s", tc.method, tc.path, reversed, s.Name, tc.want)
+			default:
+				m := s.Pattern.FindStringSubmatch(tc.path)
+				if got := m[s.Pattern.SubexpIndex("repoPath")]; got != tc.repoPath {
+					t.Errorf("%s %s: repoPath %s, want %s", tc.method, tc.path, got, tc.repoPath)
+				}
+			}
+		}
+	}
+}
+
+func TestOverlappingServices(t *testing.T) {
+	log := &syncBuffer{}
+	gsh, err := NewGitSmartHTTP(&GitSmartHTTPConfig{
+		ReposRootPath: t.TempDir(),
+		ReceivePack:   true,
+		UploadPack:    true,
+		LFS:           true,
+		Logger:        slog.New(slog.NewTextHandler(log, nil)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := overlappingServices(gsh.Services); len(w) > 0 || strings.Contains(log.String(), "Overlapping") {
+		t.Errorf("built-in routes overlap: %q\n%s", w, log.String())
+	}
+
+	services := append(gsh.Services,
+		Service{Name: "head-again", Method: "GET", Pattern: regexp.MustCompile("(?P<repoPath>.*)/HEAD$")},
+		Service{Name: "refs", Method: "GET", Pattern: regexp.MustCompile("(?P<repoPath>.*)/refs$")},
+		// Another method doesn't overlap.
+		Service{Name: "put-head", Method: "PUT", Pattern: regexp.MustCompile("(?P<repoPath>.*)/HEAD$")},
+	)
+	got := strings.Join(overlappingServices(services), "\n")
+	for _, want := range []string{"route head-again duplicates head", "route refs overlaps info-refs"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("warnings %q, want %q", got, want)
+		}
+	}
+	if strings.Contains(got, "put-head") {
+		t.Errorf("routes with other methods reported: %q", got)
+	}
+}
+
+// TestIntegrationRepoBelowRefs clones and pushes a repository whose path
+// goes through a directory named refs, over the smart and dumb protocols.
+func TestIntegrationRepoBelowRefs(t *testing.T) {
+	url, repo := newIntegrationServer(t, Config{})
+	runGit(t, "", "init", "-q", "--bare", filepath.Join(filepath.Dir(repo), "team", "refs", "proj.git"))
+	url = strings.TrimSuffix(url, "/repo.git") + "/team/refs/proj.git"
+
+	work := t.TempDir()
+	a := filepath.Join(work, "a")
+	runGit(t, "", "clone", "-q", url, a)
+	head := commitFile(t, a, "1")
+	runGit(t, a, "push", "-q", "origin", "main")
+
+	dumb := filepath.Join(work, "dumb")
+	cmd := exec.Command("git", "clone", "-q", url, dumb)
+	cmd.Env = append(cmd.Environ(), "GIT_SMART_HTTP=0")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("dumb clone: %s\n%s", err, out)
+	}
+	if got := runGit(t, dumb, "rev-parse", "HEAD"); got != head {
+		t.Errorf("dumb clone: HEAD %s, want %s", got, head)
+	}
+}
@@ -0,0 +1,98 @@
+package githttp
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// signedPushHook is the pre-receive hook pushes to repositories requiring
+// signed pushes run with. receive-pack checks the push certificate but
+// leaves the verdict to the hooks. Anything but a good signature by a known
+// signer over a nonce of this server is rejected: SSH signatures by keys
+// missing from gpg.ssh.allowedSignersFile are good, but have no signer. The
+// repository's own pre-receive hook runs next.
+const signedPushHook = `#!/bin/sh
+if [ "$GIT_PUSH_CERT_STATUS" != G ] || [ -z "$GIT_PUSH_CERT_SIGNER" ] || [ "$GIT_PUSH_CERT_NONCE_STATUS" != OK ]; then
+	echo "push certificate rejected: signature ${GIT_PUSH_CERT_STATUS:-missing}, signer ${GIT_PUSH_CERT_SIGNER:-unknown}, nonce ${GIT_PUSH_CERT_NONCE_STATUS:-missing}" >&2
+	exit 1
+fi
+hook="$(dirname "$0")/pre-receive.repo"
+if [ -x "$hook" ]; then
+	exec "$hook"
+fi
+`
+
+// requiresSignedPush reports whether pushes to the repository must be
+// signed: its http.requireSignedPush git config when set, RequireSignedPush
+// otherwise. A value git can't read requires them, rather than silently
+// letting unsigned pushes through.
+func (gsh GitSmartHTTP) requiresSignedPush(ctx context.Context, repoPath string) bool {
+	gs := gsh.newGitRPCClient(false)
+	gs.ConfigBool(ctx, repoPath, "http.requireSignedPush")
+	out, err := gs.Output()
+
+	var exitErr *exec.ExitError
+	switch {
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == 1:
+		return gsh.RequireSignedPush
+	case err != nil:
+		return true
+	}
+	return strings.TrimSpace(string(out)) == "true"
+}
+
+// pushCertConfig returns the -c options receive-pack needs to hand out and
+// check push certificate nonces.
+func (gsh GitSmartHTTP) pushCertConfig() []string {
+	// The advertisement and the push run in separate processes, allow the
+	// nonce to be a little old.
+	return []string{
+		"receive.certNonceSeed=" + gsh.PushCertNonceSeed,
+		"receive.certNonceSlop=300",
+	}
+}
+
+// signedPushHooks returns a directory for core.hooksPath holding
+// signedPushHook as pre-receive and links to the other hooks of the
+// repository, and a function removing it once the push is done.
+func (gsh GitSmartHTTP) signedPushHooks(ctx context.Context, repoPath string) (string, func(), error) {
+	gs := gsh.newGitRPCClient(false)
+	gs.GitPath(ctx, repoPath, "hooks")
+	out, err := gs.Output()
+	if err != nil {
+		return "", nil, err
+	}
+	repoHooks := strings.TrimSpace(string(out))
+	if !filepath.IsAbs(repoHooks) {
+		repoHooks = filepath.Join(repoPath, repoHooks)
+	}
+
+	dir, err := os.MkdirTemp("", "git-http-backend-hooks-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+
+	// A repository without hooks has no hooks directory.
+	entries, _ := os.ReadDir(repoHooks)
+	for _, e := range entries {
+		name := e.Name()
+		if name == "pre-receive" {
+			name = "pre-receive.repo"
+		}
+		if err := os.Symlink(filepath.Join(repoHooks, e.Name()), filepath.Join(dir, name)); err != nil {
+			cleanup()
+			return "", nil, err
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "pre-receive"), []byte(signedPushHook), 0o755); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return dir, cleanup, nil
+}
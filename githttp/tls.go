@@ -0,0 +1,131 @@
+package githttp
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TLSEnabled reports whether both a certificate and a key are configured.
+func (gsh GitSmartHTTP) TLSEnabled() bool {
+	return gsh.TLSCertFile != "" && gsh.TLSKeyFile != ""
+}
+
+// TLSConfig returns the TLS configuration of the HTTPS listener, with the
+// configured key pair loaded.
+func (gsh GitSmartHTTP) TLSConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(gsh.TLSCertFile, gsh.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{
+		MinVersion:             tls.VersionTLS12,
+		Certificates:           []tls.Certificate{cert},
+		NextProtos:             []string{"h2", "http/1.1"},
+		SessionTicketsDisabled: !gsh.TLSSessionTickets,
+	}
+
+	if gsh.TLSSessionTickets && gsh.TLSTicketRotation > 0 {
+		if err := rotateSessionTicketKeys(cfg, gsh.TLSTicketRotation, gsh.Logger); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+// rotateSessionTicketKeys installs a fresh session ticket key every
+// interval. The two previous keys are kept so tickets issued shortly before
+// a rotation can still be resumed.
+func rotateSessionTicketKeys(cfg *tls.Config, interval time.Duration, l Logger) error {
+	var keys [][32]byte
+
+	rotate := func() error {
+		var key [32]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+
+		keys = append([][32]byte{key}, keys...)
+		if len(keys) > 3 {
+			keys = keys[:3]
+		}
+		cfg.SetSessionTicketKeys(keys)
+		return nil
+	}
+
+	if err := rotate(); err != nil {
+		return err
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			if err := rotate(); err != nil {
+				l.Error("Cannot rotate TLS session ticket keys", "err", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// isTooEarly reports whether a request replayed from TLS 1.3 early data
+// must be refused. Go never accepts 0-RTT itself, but a TLS terminating
+// proxy may forward early data marked with "Early-Data: 1" (RFC 8470).
+// RPC POSTs are never idempotent so they are always refused, GETs only
+// when early data is not allowed.
+func (gsh GitSmartHTTP) isTooEarly(r *http.Request) bool {
+	if r.Header.Get("Early-Data") != "1" {
+		return false
+	}
+	return !gsh.AllowEarlyData || (r.Method != "GET" && r.Method != "HEAD")
+}
+
+func tooEarly(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusTooEarly)
+	fmt.Fprintln(w, "Request sent in TLS early data, please retry")
+}
+
+// RedirectToHTTPS answers every request with a permanent redirect to the
+// same URL on the HTTPS port. Requests a trusted proxy received over HTTPS
+// are served, redirecting them would loop.
+func (gsh GitSmartHTTP) RedirectToHTTPS(tlsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if gsh.forwardedProto(r) == "https" {
+			gsh.ServeHTTP(w, r)
+			return
+		}
+
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		} else {
+			// An IPv6 literal without a port, JoinHostPort adds the
+			// brackets back.
+			host = strings.Trim(host, "[]")
+		}
+		if tlsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(tlsPort))
+		}
+
+		u := *r.URL
+		u.Scheme = "https"
+		u.Host = host
+		http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+	})
+}
+
+// tlsLogAttrs describes the TLS connection a request came in on, for the
+// access log.
+func tlsLogAttrs(cs *tls.ConnectionState) []any {
+	attrs := []any{"tls", tls.VersionName(cs.Version), "cipher", tls.CipherSuiteName(cs.CipherSuite)}
+	if len(cs.PeerCertificates) > 0 {
+		attrs = append(attrs, "client_cert", cs.PeerCertificates[0].Subject.String())
+	}
+	return attrs
+}
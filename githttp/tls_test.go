@@ -0,0 +1,114 @@
+package githttp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEarlyData(t *testing.T) {
+	for _, allow := range []bool{false, true} {
+		h, err := New(Config{
+			ReposRootPath:  t.TempDir(),
+			UploadPack:     true,
+			ReceivePack:    true,
+			AllowEarlyData: allow,
+			Logger:         slog.New(slog.NewTextHandler(io.Discard, nil)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, tc := range []struct {
+			method, path string
+			early, want  bool
+		}{
+			{"POST", "/repo.git/git-receive-pack", true, true},
+			{"POST", "/repo.git/git-upload-pack", true, true},
+			{"GET", "/repo.git/info/refs?service=git-upload-pack", true, !allow},
+			{"HEAD", "/repo.git/HEAD", true, !allow},
+			{"POST", "/repo.git/git-receive-pack", false, false},
+			{"GET", "/repo.git/info/refs?service=git-upload-pack", false, false},
+		} {
+			req := httptest.NewRequest(tc.method, tc.path, strings.NewReader("0000"))
+			if tc.early {
+				req.Header.Set("Early-Data", "1")
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if got := rec.Code == http.StatusTooEarly; got != tc.want {
+				t.Errorf("allow %t, %s %s with early data %t: %d", allow, tc.method, tc.path, tc.early, rec.Code)
+			}
+		}
+	}
+}
+
+// clientCertificate returns a self-signed client certificate for cn.
+func clientCertificate(t *testing.T, cn string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestLogTLS(t *testing.T) {
+	for _, logTLS := range []bool{false, true} {
+		log := &syncBuffer{}
+		h, err := New(Config{
+			ReposRootPath: t.TempDir(),
+			UploadPack:    true,
+			LogTLS:        logTLS,
+			Logger:        slog.New(slog.NewTextHandler(log, nil)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := httptest.NewUnstartedServer(h)
+		srv.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+		srv.StartTLS()
+		defer srv.Close()
+
+		client := srv.Client()
+		tr := client.Transport.(*http.Transport)
+		tr.TLSClientConfig.MaxVersion = tls.VersionTLS12
+		tr.TLSClientConfig.CipherSuites = []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}
+		tr.TLSClientConfig.Certificates = []tls.Certificate{clientCertificate(t, "ci-bot")}
+
+		resp, err := client.Get(srv.URL + "/repo.git/HEAD")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		out := log.String()
+		for _, want := range []string{`tls="TLS 1.2"`, "cipher=TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", `client_cert="CN=ci-bot"`} {
+			if strings.Contains(out, want) != logTLS {
+				t.Errorf("LogTLS %t, %s logged: %t\n%s", logTLS, want, !logTLS, out)
+			}
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// listen opens the TCP listener for addr and applies the configured
+// backlog and accept throttling.
+func listen(addr string, backlog int, acceptRate float64) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if backlog > 0 {
+		if err := setListenBacklog(ln, backlog); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+
+	if acceptRate > 0 {
+		ln = newThrottledListener(ln, acceptRate)
+	}
+	return ln, nil
+}
+
+// listenUnix opens a Unix domain socket listener at path. A socket left
+// behind by a server that didn't shut down cleanly is removed first, any
+// other file at path is an error. The socket file is removed again when
+// the listener is closed.
+func listenUnix(path string, acceptRate float64) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if acceptRate > 0 {
+		return newThrottledListener(ln, acceptRate), nil
+	}
+	return ln, nil
+}
+
+// throttledListener spaces out accepted connections so that at most rate
+// connections are accepted per second. Connections that arrive faster wait
+// in the kernel's accept queue. Accept must not be called concurrently.
+type throttledListener struct {
+	net.Listener
+	interval time.Duration
+	next     time.Time
+}
+
+func newThrottledListener(ln net.Listener, rate float64) *throttledListener {
+	return &throttledListener{
+		Listener: ln,
+		interval: time.Duration(float64(time.Second) / rate),
+	}
+}
+
+func (tl *throttledListener) Accept() (net.Conn, error) {
+	if wait := time.Until(tl.next); wait > 0 {
+		time.Sleep(wait)
+	}
+
+	conn, err := tl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	tl.next = time.Now().Add(tl.interval)
+	return conn, nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+// TestListenBacklog reads the accept queue length back from the kernel,
+// which reports it in tcpi_sacked for listening sockets.
+func TestListenBacklog(t *testing.T) {
+	ln, err := listen("127.0.0.1:0", 7, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	rc, err := ln.(syscall.Conn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var info syscall.TCPInfo
+	var errno syscall.Errno
+	err = rc.Control(func(fd uintptr) {
+		size := uint32(syscall.SizeofTCPInfo)
+		_, _, errno = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP, syscall.TCP_INFO,
+			uintptr(unsafe.Pointer(&info)), uintptr(unsafe.Pointer(&size)), 0)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	if info.Sacked != 7 {
+		t.Errorf("backlog %d, want 7", info.Sacked)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package main
+
+import "testing"
+
+func TestListenBacklog(t *testing.T) {
+	if ln, err := listen("127.0.0.1:0", 7, 0); err == nil {
+		ln.Close()
+		t.Error("backlog accepted on a platform that can't set it")
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAcceptRate(t *testing.T) {
+	ln, err := listen("127.0.0.1:0", 0, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	for i := 0; i < 3; i++ {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+	}
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		c, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+	}
+	// The first connection is accepted right away, the others 50ms apart.
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Errorf("3 connections accepted in %s at 20 per second", d)
+	}
+}
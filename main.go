@@ -1,18 +1,21 @@
 package main
 
 import (
-	"compress/gzip"
+	"bufio"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
-	"path"
-	"regexp"
-	"strconv"
+	"os/exec"
+	"strings"
 	"time"
+
+	"github.com/jaxi/git-http-backend/githttp"
 )
 
 // VERSION is the version of the binary
@@ -22,8 +25,6 @@ var VERSION string
 var COMMIT string
 
 const (
-	uploadPack  = "git-upload-pack"
-	receivePack = "git-receive-pack"
 	//BANNER shows at the beginning of the command line
 	BANNER = `
        _ _     _   _   _          _             _               _
@@ -36,362 +37,309 @@ const (
 `
 )
 
-// Service defines the Git Smart HTTP request by the given method and pattern
-type Service struct {
-	Method  string
-	Pattern *regexp.Regexp
-	Handler func(s Service, w http.ResponseWriter, r *http.Request)
-}
-
-// ParseURLNamedParams parse the request into named parameters
-func (s *Service) ParseURLNamedParams(r *http.Request) map[string]string {
-	namedParams := make(map[string]string)
+var gsh githttp.GitSmartHTTP
 
-	subexpNames := s.Pattern.SubexpNames()
-	matches := s.Pattern.FindAllStringSubmatch(r.URL.Path, -1)[0]
+// configure parses the flags and the configuration file and creates gsh. It
+// runs from main rather than init so the package can be tested.
+func configure() {
+	var vsn, check bool
+	var authFile string
+	var logFormat, logLevel string
+	var configFile string
+	gsc := githttp.GitSmartHTTPConfig{}
 
-	for i, match := range matches {
-		if name := subexpNames[i]; name != "" {
-			namedParams[name] = match
+	flag.BoolVar(&vsn, "version", false, "print version")
+	flag.BoolVar(&check, "check", false, "validate the configuration and the repositories, print a report and exit")
+	flag.StringVar(&configFile, "config", "", "file of \"flag-name = value\" settings, flags given on the command line override it")
+	flag.StringVar(&gsc.ReposRootPath, "repos-root-path", "/etc/git-http-backend", "directory that contains git repositories to serve")
+	flag.Func("root", "prefix=dir mapping URL paths below prefix to repositories in dir, may be repeated, replaces -repos-root-path", func(v string) error {
+		prefix, dir, ok := strings.Cut(v, "=")
+		if !ok || !strings.HasPrefix(prefix, "/") || dir == "" {
+			return fmt.Errorf("expected /prefix=dir, got %q", v)
 		}
-	}
-	return namedParams
-}
-
-// GitSmartHTTPConfig is the configuration for GitSmartHTTP
-type GitSmartHTTPConfig struct {
-	ReposRootPath string
-	ReceivePack   bool
-	UploadPack    bool
-	Port          int
-}
-
-// GitSmartHTTP acts as an Git Smart HTTP server's handler and deal
-// with all kinds of Git HTTP request
-type GitSmartHTTP struct {
-	Services []Service
-	*GitSmartHTTPConfig
-}
+		gsc.Roots = append(gsc.Roots, githttp.RepoRoot{Prefix: prefix, Path: dir})
+		return nil
+	})
+	flag.StringVar(&gsc.BasePath, "base-path", "", "URL path the server is mounted at behind a proxy, e.g. /git, stripped before routing")
+	flag.StringVar(&gsc.CommitterEmailDomain, "committer-email-domain", "", "domain of the committer email set for authenticated pushes (default http.<client address>)")
+	flag.Func("git-env", "KEY=VALUE set in the environment of git processes, may be repeated", func(v string) error {
+		if k, _, ok := strings.Cut(v, "="); !ok || k == "" {
+			return fmt.Errorf("expected KEY=VALUE, got %q", v)
+		}
+		gsc.GitEnv = append(gsc.GitEnv, v)
+		return nil
+	})
+	flag.BoolVar(&gsc.ReceivePack, "git-receive-pack", true, "whether to receive what is pushed into repository")
+	flag.BoolVar(&gsc.UploadPack, "git-upload-pack", true, "whether to send objects packed back to git-fetch-pack")
+	flag.IntVar(&gsc.Port, "port", 8080, "port that the Git server backend runs on")
+	flag.StringVar(&gsc.UnixSocket, "unix-socket", "", "path of a Unix domain socket to listen on instead of -port")
+	flag.StringVar(&gsc.GitBinary, "git-binary", "git", "name or path of the git executable")
+	flag.StringVar(&gsc.TLSCertFile, "tls-cert", "", "TLS certificate file, enables HTTPS together with -tls-key")
+	flag.StringVar(&gsc.TLSKeyFile, "tls-key", "", "TLS private key file, enables HTTPS together with -tls-cert")
+	flag.IntVar(&gsc.TLSPort, "tls-port", 8443, "port that HTTPS is served on")
+	flag.BoolVar(&gsc.TLSRedirect, "tls-redirect", false, "redirect plain HTTP requests on -port to HTTPS")
+	flag.BoolVar(&gsc.TLSSessionTickets, "tls-session-tickets", true, "allow TLS session resumption with session tickets")
+	flag.DurationVar(&gsc.TLSTicketRotation, "tls-ticket-rotation", 0, "rotate the TLS session ticket key at this interval, 0 to leave it to the TLS library")
+	flag.BoolVar(&gsc.AllowEarlyData, "allow-early-data", false, "accept GET requests forwarded from TLS 1.3 early data (Early-Data: 1), POSTs are always refused")
+	flag.Func("hide-refs", "comma separated ref prefixes hidden from fetching clients, e.g. refs/internal/", func(v string) error {
+		gsc.HideRefs = strings.Split(v, ",")
+		return nil
+	})
+	flag.Func("cors-origins", "comma separated origins allowed to call the server from a browser, or *", func(v string) error {
+		gsc.CORSOrigins = strings.Split(v, ",")
+		return nil
+	})
+	flag.BoolVar(&gsc.RequireSignedPush, "require-signed-push", false, "reject pushes without a verified git push --signed certificate, unless a repository sets http.requireSignedPush=false")
+	flag.StringVar(&gsc.PushCertNonceSeed, "push-cert-nonce-seed", "", "seed for push certificate nonces, shared by servers serving the same repositories (default random)")
+	flag.BoolVar(&gsc.DenySymrefUpdates, "deny-symref-updates", false, "reject pushes that update a symbolic ref such as HEAD")
+	flag.IntVar(&gsc.ListenBacklog, "listen-backlog", 0, "length of the listener's accept queue, 0 for the OS default")
+	flag.Float64Var(&gsc.AcceptRate, "accept-rate", 0, "maximum number of connections accepted per second, 0 for unlimited")
+	flag.StringVar(&authFile, "auth-file", "", "file of user:hash lines enabling basic authentication, hashes made with the hash-password command")
+	flag.DurationVar(&gsc.AuthCacheTTL, "auth-cache-ttl", time.Minute, "how long accepted credentials are remembered instead of hashing the password again, 0 to disable")
+	flag.StringVar(&gsc.AuthRealm, "auth-realm", "git-http-backend", "realm sent in the basic authentication challenge")
+	flag.BoolVar(&gsc.AnonymousRead, "anonymous-read", false, "allow fetching without credentials when authentication is enabled")
+	flag.Int64Var(&gsc.MaxBodyBytes, "max-body-bytes", 1<<30, "maximum size of an RPC request body, 0 for unlimited")
+	flag.DurationVar(&gsc.BodyIdleTimeout, "body-idle-timeout", 0, "abort a request when the client sends no body data for this long, 0 to disable")
+
+	gsc.RedactQueryParams = []string{"access_token", "token", "password"}
+	flag.Func("redact-query-params", "comma separated query parameters to mask in the logs (default access_token,token,password)", func(v string) error {
+		gsc.RedactQueryParams = strings.Split(v, ",")
+		return nil
+	})
+	flag.Int64Var(&gsc.PackCacheSize, "pack-cache-size", 0, "bytes of pack and idx files to cache in memory, 0 to disable")
+	flag.Float64Var(&gsc.RepoReadRate, "repo-read-rate", 0, "fetch requests per second allowed per repository, 0 for unlimited")
+	flag.IntVar(&gsc.RepoReadBurst, "repo-read-burst", 10, "burst of fetch requests allowed per repository")
+	flag.Float64Var(&gsc.RepoWriteRate, "repo-write-rate", 0, "push requests per second allowed per repository, 0 for unlimited")
+	flag.IntVar(&gsc.RepoWriteBurst, "repo-write-burst", 5, "burst of push requests allowed per repository")
+	flag.Float64Var(&gsc.RateLimit, "rate-limit", 0, "requests per second allowed per client IP, 0 for unlimited")
+	flag.IntVar(&gsc.RateBurst, "rate-burst", 20, "burst of requests allowed per client IP")
+	flag.Func("trusted-proxies", "comma separated CIDRs of proxies whose X-Forwarded-For and X-Forwarded-Proto headers are trusted", func(v string) error {
+		nets, err := githttp.ParseCIDRs(v)
+		gsc.TrustedProxies = nets
+		return err
+	})
+	flag.BoolVar(&gsc.GCAfterFailedPush, "gc-after-failed-push", false, "run git gc on a repository after a push to it was killed")
+	flag.StringVar(&gsc.GCPruneExpire, "gc-prune-expire", "1.hour.ago", "age passed to git gc --prune")
+	flag.IntVar(&gsc.ShedGitProcesses, "shed-git-processes", 0, "reject new fetches with 503 once this many git processes are running, 0 to disable")
+	flag.IntVar(&gsc.ShedRequests, "shed-requests", 0, "reject new fetches with 503 once this many requests are in flight, 0 to disable")
+	flag.DurationVar(&gsc.ShedRetryAfter, "shed-retry-after", 5*time.Second, "Retry-After sent with requests rejected due to overload")
+	flag.IntVar(&gsc.MaxAdvertisements, "max-advertisements", 0, "maximum number of ref advertisements generated at once, 0 for unlimited")
+	flag.BoolVar(&gsc.FollowSymlinks, "follow-symlinks", true, "serve repositories reached through symlinks leading out of the repositories root, refuse them with 403 when false")
+	flag.BoolVar(&gsc.LogHeaders, "log-headers", false, "log request headers, with credentials masked")
+	flag.BoolVar(&gsc.Compress, "compress", false, "gzip responses, except pack data, for clients that accept it")
+	flag.BoolVar(&gsc.PushLock, "push-lock", false, "serialize pushes to a repository with a file lock, also across servers sharing it")
+	flag.DurationVar(&gsc.PushLockTimeout, "push-lock-timeout", 30*time.Second, "how long a push waits for the lock before getting 503")
+	flag.IntVar(&gsc.RepackLooseObjects, "repack-loose-objects", 0, "repack repositories served to dumb clients with more loose objects than this, 0 to disable")
+	flag.DurationVar(&gsc.RepackInterval, "repack-interval", time.Hour, "minimum time between two automatic repacks of a repository")
+	flag.BoolVar(&gsc.DenyDeleteAll, "deny-delete-all", false, "reject pushes deleting every ref of a repository unless pushed with -o "+githttp.AllowDeleteAll)
+	flag.BoolVar(&gsc.EnableListing, "enable-listing", false, "list the repositories as JSON on "+githttp.ListingPath)
+	flag.IntVar(&gsc.ListingDepth, "listing-depth", 4, "directories below a root searched for repositories by the listing, 0 for unlimited")
+	flag.BoolVar(&gsc.LFS, "lfs", false, "serve the Git LFS batch API and store LFS objects in the repositories")
+	flag.BoolVar(&gsc.ObjectInfo, "object-info", false, "advertise the protocol v2 object-info command")
+	flag.BoolVar(&gsc.Promisor, "promisor", false, "allow partial clones with --filter and lazy fetches of the objects they omit, not with -hide-refs")
+	flag.BoolVar(&gsc.Mirror, "mirror", false, "serve repositories read-only, refusing every push")
+	flag.BoolVar(&gsc.AutoCreate, "auto-create", false, "create a bare repository when pushing to one that does not exist")
+	flag.StringVar(&gsc.InitTemplate, "init-template", "", "template directory of the repositories created by -auto-create, see git init --template")
+	flag.StringVar(&gsc.Cgroup.Parent, "cgroup-parent", "", "cgroup v2 directory to create a cgroup for each git process in, Linux only")
+	flag.StringVar(&gsc.Cgroup.CPUMax, "cgroup-cpu-max", "", "cpu.max of each git process' cgroup, e.g. \"50000 100000\" for half a CPU")
+	flag.Int64Var(&gsc.Cgroup.MemoryMax, "cgroup-memory-max", 0, "memory.max in bytes of each git process' cgroup, 0 for unlimited")
+	flag.DurationVar(&gsc.GitVersionInterval, "git-version-interval", 0, "check the git version again at this interval, 0 to only check on SIGHUP")
+	flag.IntVar(&gsc.MaxPathLength, "max-path-length", 1024, "longest request path accepted, 0 for unlimited")
+	flag.IntVar(&gsc.MaxPathDepth, "max-path-depth", 32, "most path segments accepted in a request path, 0 for unlimited")
+	flag.DurationVar(&gsc.ReadTimeout, "read-timeout", 0, "maximum time to read a whole request, 0 for unlimited")
+	flag.DurationVar(&gsc.WriteTimeout, "write-timeout", 0, "maximum time to write a whole response, 0 for unlimited")
+	flag.DurationVar(&gsc.IdleTimeout, "idle-timeout", 2*time.Minute, "how long idle keep-alive connections are kept open")
+	flag.DurationVar(&gsc.GitTimeout, "git-timeout", 0, "kill git processes running longer than this and answer 504, 0 for unlimited")
+	flag.DurationVar(&gsc.ShutdownTimeout, "shutdown-timeout", 30*time.Second, "time given to requests in flight to finish on SIGINT or SIGTERM")
+	flag.StringVar(&gsc.HealthPath, "health-path", "/healthz", "path of the health check, empty to disable")
+	flag.StringVar(&gsc.HealthCanary, "health-canary", "", "repository the health check advertises the refs of, empty to skip")
+	flag.DurationVar(&gsc.HealthCanaryTimeout, "health-canary-timeout", 2*time.Second, "time the health check gives the canary repository")
+	flag.BoolVar(&gsc.MetricsEnabled, "metrics", false, "serve Prometheus metrics on "+githttp.MetricsPath)
+	flag.StringVar(&logFormat, "log-format", "text", "format of the log lines, text or json")
+	flag.StringVar(&logLevel, "log-level", "info", "least severe messages logged: debug, info or error")
+	flag.BoolVar(&gsc.LogTLS, "log-tls", false, "log the TLS version, cipher suite and client certificate of HTTPS requests")
+	flag.StringVar(&gsc.AccessLogFormat, "access-log-format", "", "write the access log to stdout in the common or combined log format instead of the structured request log")
 
-// NewGitSmartHTTP returns a GitSmartHTTP
-func NewGitSmartHTTP(cfg *GitSmartHTTPConfig) GitSmartHTTP {
-	gsh := GitSmartHTTP{
-		GitSmartHTTPConfig: cfg,
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, fmt.Sprintf(BANNER, VERSION, COMMIT))
+		flag.PrintDefaults()
 	}
 
-	gsh.Services = []Service{
-		Service{
-			Method:  "GET",
-			Pattern: regexp.MustCompile("(?P<repoPath>.*)/HEAD$"),
-			Handler: gsh.handleTextFile,
-		},
-		Service{
-			Method:  "GET",
-			Pattern: regexp.MustCompile("(?P<repoPath>.*)/info/packs$"),
-			Handler: gsh.handleInfoPacks,
-		},
-		Service{
-			Method:  "GET",
-			Pattern: regexp.MustCompile("(?P<repoPath>.*)/info/refs$"),
-			Handler: gsh.handleInfoRefs,
-		},
-		Service{
-			Method:  "GET",
-			Pattern: regexp.MustCompile("(?P<repoPath>.*)/objects/info/alternates$"),
-			Handler: gsh.handleTextFile,
-		},
-		Service{
-			Method:  "GET",
-			Pattern: regexp.MustCompile("(?P<repoPath>.*)/objects/info/http-alternates$"),
-			Handler: gsh.handleTextFile,
-		},
-		Service{
-			Method:  "GET",
-			Pattern: regexp.MustCompile("(?P<repoPath>.*)/objects/[0-9a-f]{2}/[0-9a-f]{38}$"),
-			Handler: gsh.handleLooseObject,
-		},
-		Service{
-			Method:  "GET",
-			Pattern: regexp.MustCompile("(?P<repoPath>.*)/objects/pack/pack-[0-9a-f]{40}\\.pack$"),
-			Handler: gsh.handlePackFile,
-		},
-		Service{
-			Method:  "GET",
-			Pattern: regexp.MustCompile("(?P<repoPath>.*)/objects/pack/pack-[0-9a-f]{40}\\.idx$"),
-			Handler: gsh.handleIdxFile,
-		},
-		Service{
-			Method:  "POST",
-			Pattern: regexp.MustCompile("(?P<repoPath>.*)/(?P<serviceType>git-upload-pack)$"),
-			Handler: gsh.handleServiceRPC,
-		},
-		Service{
-			Method:  "POST",
-			Pattern: regexp.MustCompile("(?P<repoPath>.*)/(?P<serviceType>git-receive-pack)$"),
-			Handler: gsh.handleServiceRPC,
-		},
-	}
-	return gsh
-}
+	flag.Parse()
 
-// ServerHttp implements the iServerHttp nterface of http.Handler
-func (gsh GitSmartHTTP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// Log request
-	log.Printf(`%s - - "%s %s %s"`, r.RemoteAddr, r.Method, r.URL.Path, r.Proto)
-
-	for _, service := range gsh.Services {
-		if service.Pattern.MatchString(r.URL.Path) {
-			if r.Method == service.Method {
-				service.Handler(service, w, r)
-			} else {
-				methodNotAllowed(w, r)
-			}
-			break
-		}
+	if vsn {
+		fmt.Printf("git-http-backend version: %s, commit: %s\n", VERSION, COMMIT)
+		os.Exit(0)
 	}
-}
-
-func (gsh GitSmartHTTP) handleTextFile(s Service, w http.ResponseWriter, r *http.Request) {
-	gsh.sendFile(w, r, "text/plain", hdrNoCache())
-}
 
-func (gsh GitSmartHTTP) handleInfoPacks(s Service, w http.ResponseWriter, r *http.Request) {
-	gsh.sendFile(w, r, "text/plain; charset=utf-8", hdrNoCache())
-}
-
-func (gsh GitSmartHTTP) handleLooseObject(s Service, w http.ResponseWriter, r *http.Request) {
-	gsh.sendFile(w, r, "application/x-git-loose-object", hdrCacheForever())
-}
-
-func (gsh GitSmartHTTP) handlePackFile(s Service, w http.ResponseWriter, r *http.Request) {
-	gsh.sendFile(w, r, "application/x-git-packed-objects", hdrCacheForever())
-}
-
-func (gsh GitSmartHTTP) handleIdxFile(s Service, w http.ResponseWriter, r *http.Request) {
-	gsh.sendFile(w, r, "application/x-git-packed-objects-toc", hdrCacheForever())
-}
-
-func (gsh GitSmartHTTP) handleInfoRefs(s Service, w http.ResponseWriter, r *http.Request) {
-	defer r.Body.Close()
-
-	serviceType := r.FormValue("service")
-
-	namedURLParams := s.ParseURLNamedParams(r)
-	repoPath := path.Join(gsh.ReposRootPath, namedURLParams["repoPath"])
-
-	gs := NewGitRPCClient(&GitRPCClientConfig{
-		Stream: false,
-	})
-
-	if gsh.serviceAccess(serviceType) {
-		w.Header().Add("Content-Type", fmt.Sprintf("application/x-%s-advertisement", serviceType))
-		setHeaders(w, hdrNoCache())
-		w.WriteHeader(http.StatusOK)
-
-		rpcCfg := map[string]struct{}{
-			"advertise_refs": struct{}{},
+	if flag.NArg() >= 1 {
+		switch flag.Args()[0] {
+		case "version":
+			fmt.Printf("git-http-backend version: %s, commit: %s\n", VERSION, COMMIT)
+			os.Exit(0)
+		case "help":
+			flag.Usage()
+			os.Exit(0)
+		case "hash-password":
+			os.Exit(hashPassword(os.Stdin, os.Stdout))
 		}
+	}
 
-		if serviceType == uploadPack {
-			gs.UploadPack(repoPath, rpcCfg)
-		} else {
-			gs.ReceivePack(repoPath, rpcCfg)
+	if configFile != "" {
+		if err := loadConfigFile(flag.CommandLine, configFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot load config file: %s\n", err)
+			os.Exit(2)
 		}
-		refs, _ := gs.Output()
-
-		fmt.Fprint(w, pktWrite(fmt.Sprintf("# service=%s\n", serviceType)))
-		fmt.Fprint(w, pktFlush())
-		w.Write(refs)
-	} else {
-		gs.UploadPack(repoPath, map[string]struct{}{})
-		gs.Output()
+	}
 
-		gsh.sendFile(w, r, "text/plain; charset=utf-8", hdrNoCache())
+	logger, err := newSlogLogger(os.Stderr, logFormat, logLevel)
+	if err != nil {
+		log.Fatalf("Cannot configure logging: %s", err)
 	}
-}
+	// Messages still going through the log package end up in the same
+	// format.
+	slog.SetDefault(logger)
+	gsc.Logger = logger
 
-func (gsh GitSmartHTTP) handleServiceRPC(s Service, w http.ResponseWriter, r *http.Request) {
-	defer r.Body.Close()
+	if err := gsc.Validate(); err != nil {
+		log.Fatalf("Invalid configuration: %s", err)
+	}
 
-	namedURLParams := s.ParseURLNamedParams(r)
+	if check {
+		os.Exit(githttp.RunChecks(os.Stdout, &gsc, authFile))
+	}
 
-	repoPath := path.Join(gsh.ReposRootPath, namedURLParams["repoPath"])
-	serviceType := namedURLParams["serviceType"]
+	if _, err := exec.LookPath(gsc.GitBinary); err != nil {
+		log.Fatalf("Cannot find git binary %q: %s", gsc.GitBinary, err)
+	}
 
-	if !gsh.serviceAccess(serviceType) {
-		w.WriteHeader(http.StatusForbidden)
-		w.Header().Set("Content-Type", "text/plain")
-		return
+	if (gsc.TLSCertFile == "") != (gsc.TLSKeyFile == "") {
+		log.Fatal("Both -tls-cert and -tls-key are required to enable TLS")
 	}
 
-	var reqBody []byte
+	if gsc.UnixSocket != "" && gsc.TLSCertFile != "" {
+		log.Fatal("-unix-socket serves plain HTTP and can't be combined with TLS")
+	}
 
-	switch r.Header.Get("Content-Encoding") {
-	case "gzip":
-		reader, err := gzip.NewReader(r.Body)
+	if authFile != "" {
+		auth, err := githttp.LoadStaticAuthenticator(authFile)
 		if err != nil {
-			log.Printf("Cannot parse request body with: %s", err)
-			w.WriteHeader(http.StatusUnprocessableEntity)
-			return
+			log.Fatalf("Cannot load auth file: %s", err)
 		}
-		defer reader.Close()
-		reqBody, _ = ioutil.ReadAll(reader)
-	default:
-		reqBody, _ = ioutil.ReadAll(r.Body)
+		gsc.Authenticator = auth
 	}
 
-	gs := NewGitRPCClient(&GitRPCClientConfig{
-		Stream: true,
-	})
-
-	if serviceType == uploadPack {
-		gs.UploadPack(repoPath, map[string]struct{}{})
-	} else {
-		gs.ReceivePack(repoPath, map[string]struct{}{})
-	}
-
-	w.Header().Set("Content-Type", fmt.Sprintf("application/x-%s-result", serviceType))
-
-	if err := gs.Start(); err != nil {
-		log.Printf("Git RPC call %s cannot be started successfully: %s", serviceType, err)
+	if gsc.Cgroup.Enabled() {
+		if err := githttp.PrepareCgroupParent(gsc.Cgroup); err != nil {
+			log.Fatalf("Cannot use cgroup %s: %s", gsc.Cgroup.Parent, err)
+		}
 	}
 
-	gs.StdinWriter.Write(reqBody)
-	io.Copy(w, gs.StdoutReader)
-	io.Copy(w, gs.StderrReader)
-
-	if err := gs.Wait(); err != nil {
-		log.Printf("Git RPC call %s cannot be stopped properly: %s", serviceType, err)
+	if gsh, err = githttp.NewGitSmartHTTP(&gsc); err != nil {
+		log.Fatalf("Cannot create handler: %s", err)
 	}
 }
 
-func pktWrite(s string) string {
-	sSize := strconv.FormatInt(int64(len(s)+4), 16)
-	sSize = fmt.Sprintf("%04s", sSize)
-	return sSize + s
-}
-
-func pktFlush() string {
-	return "0000"
-}
+func main() {
+	configure()
 
-func (gsh GitSmartHTTP) sendFile(w http.ResponseWriter, r *http.Request, contentType string, hdr map[string]string) {
-	fullPath := path.Join(gsh.ReposRootPath, r.URL.Path)
+	mux := http.NewServeMux()
+	mux.Handle("/", gsh)
 
-	f, err := os.Open(fullPath)
-	if err != nil {
-		w.Header().Set("Content-Type", "text/plain")
-		http.NotFound(w, r)
-		return
-	}
+	gsh.RefreshGitVersion()
+	go gsh.WatchGitVersion()
 
-	fInfo, err := f.Stat()
-	if err != nil {
-		fmt.Fprintf(w, "Cannot fetch file %v", err)
-		return
+	if gsh.Mirror {
+		log.Printf("Mirror mode: pushes are refused")
 	}
 
-	size := strconv.FormatInt(fInfo.Size(), 10)
-	mtime := fInfo.ModTime().Format(time.RFC850)
+	srv := newServer(mux)
+	servers := []*http.Server{srv}
 
-	setHeaders(w, hdr)
+	var ln net.Listener
+	if gsh.UnixSocket != "" {
+		var err error
+		if ln, err = listenUnix(gsh.UnixSocket, gsh.AcceptRate); err != nil {
+			log.Fatalf("Cannot listen on %s: %s", gsh.UnixSocket, err)
+		}
+		log.Printf(BANNER+"    Running on %s", VERSION, COMMIT, gsh.UnixSocket)
+	} else if !gsh.TLSEnabled() {
+		ln = mustListen(gsh.Port)
+		log.Printf(BANNER+"    Running on port %d", VERSION, COMMIT, gsh.Port)
+	} else {
+		if gsh.TLSRedirect {
+			redirect := newServer(gsh.RedirectToHTTPS(gsh.TLSPort))
+			servers = append(servers, redirect)
 
-	w.Header().Set("Content-Type", contentType)
-	w.Header().Set("Content-Length", size)
-	w.Header().Set("Last-Modified", mtime)
+			rln := mustListen(gsh.Port)
+			log.Printf("Redirecting HTTP on port %d to HTTPS", gsh.Port)
+			go redirect.Serve(rln)
+		}
 
-	io.Copy(w, f)
-}
+		tlsCfg, err := gsh.TLSConfig()
+		if err != nil {
+			log.Fatalf("Cannot configure TLS: %s", err)
+		}
+		srv.TLSConfig = tlsCfg
 
-func (gsh GitSmartHTTP) serviceAccess(service string) bool {
-	if service == uploadPack {
-		return gsh.UploadPack
+		ln = tls.NewListener(mustListen(gsh.TLSPort), tlsCfg)
+		log.Printf(BANNER+"    Running on port %d (TLS)", VERSION, COMMIT, gsh.TLSPort)
 	}
 
-	if service == receivePack {
-		return gsh.ReceivePack
-	}
+	go func() {
+		if err := srv.Serve(ln); err != http.ErrServerClosed {
+			log.Fatalf("Server stopped: %s", err)
+		}
+	}()
 
-	return false
+	shutdownOnSignal(servers...)
 }
 
-func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/plain")
-	if r.Proto == "HTTP/1.1" {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-	} else {
-		w.WriteHeader(http.StatusBadRequest)
+// hashPassword prints the hash of the password read from the first line of
+// in, for the -auth-file.
+func hashPassword(in io.Reader, out io.Writer) int {
+	pass, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		log.Printf("Cannot read password: %s", err)
+		return 1
 	}
-}
-
-func hdrNoCache() map[string]string {
-	return map[string]string{
-		"Expires":       "Fri, 01 Jan 1980 00:00:00 GMT",
-		"Pragma":        "no-cache",
-		"Cache-Control": "no-cache, max-age=0, must-revalidate",
+	pass = strings.TrimRight(pass, "\r\n")
+	if pass == "" {
+		log.Print("Empty password, pass it on stdin")
+		return 1
 	}
-}
-
-func hdrCacheForever() map[string]string {
-	now := time.Now()
-	expires := now.Add(31536000 * time.Second)
 
-	return map[string]string{
-		"Date":          now.Format(time.RFC850),
-		"Expires":       expires.Format(time.RFC850),
-		"Cache-Control": "public, max-age=31536000",
+	hash, err := githttp.HashPassword(pass)
+	if err != nil {
+		log.Printf("Cannot hash password: %s", err)
+		return 1
 	}
+	fmt.Fprintln(out, hash)
+	return 0
 }
 
-func setHeaders(w http.ResponseWriter, hdr map[string]string) {
-	for key, value := range hdr {
-		w.Header().Set(key, value)
+func mustListen(port int) net.Listener {
+	ln, err := listen(fmt.Sprintf(":%d", port), gsh.ListenBacklog, gsh.AcceptRate)
+	if err != nil {
+		log.Fatalf("Cannot listen on port %d: %s", port, err)
 	}
+	return ln
 }
 
-var gsh GitSmartHTTP
-
-func init() {
-	var vsn bool
-	gsc := GitSmartHTTPConfig{}
-
-	flag.BoolVar(&vsn, "version", false, "print version")
-	flag.StringVar(&gsc.ReposRootPath, "repos-root-path", "/etc/git-http-backend", "directory that contains git repositories to serve")
-	flag.BoolVar(&gsc.ReceivePack, receivePack, true, "whether to receive what is pushed into repository")
-	flag.BoolVar(&gsc.UploadPack, uploadPack, true, "whether to send objects packed back to git-fetch-pack")
-	flag.IntVar(&gsc.Port, "port", 8080, "port that the Git server backend runs on")
-
-	flag.Usage = func() {
-		fmt.Fprint(os.Stderr, fmt.Sprintf(BANNER, VERSION, COMMIT))
-		flag.PrintDefaults()
-	}
-
-	flag.Parse()
-
-	if vsn {
-		fmt.Printf("git-http-backend version: %s, commit: %s\n", VERSION, COMMIT)
-		os.Exit(0)
+// newSlogLogger returns a logger writing text or json lines to w, dropping
+// messages below level.
+func newSlogLogger(w io.Writer, format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, err
 	}
+	opts := &slog.HandlerOptions{Level: lvl}
 
-	if flag.NArg() >= 1 {
-		switch flag.Args()[0] {
-		case "version":
-			fmt.Printf("git-http-backend version: %s, commit: %s\n", VERSION, COMMIT)
-			os.Exit(0)
-		case "help":
-			flag.Usage()
-			os.Exit(0)
-		}
+	switch strings.ToLower(format) {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
 	}
-
-	gsh = NewGitSmartHTTP(&gsc)
-}
-
-func main() {
-
-	mux := http.NewServeMux()
-	mux.Handle("/", gsh)
-	port := fmt.Sprintf(":%d", gsh.Port)
-	log.Printf(BANNER+"    Running on port %d", VERSION, COMMIT, gsh.Port)
-	http.ListenAndServe(port, mux)
+	return nil, fmt.Errorf("unknown log format %q, expected text or json", format)
 }
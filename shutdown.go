@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/jaxi/git-http-backend/githttp"
+)
+
+// requestsContext is the base context of every request. Cancelling it kills
+// the git processes still running once the shutdown grace period is over.
+var requestsContext, cancelRequests = context.WithCancel(context.Background())
+
+// newServer returns an http.Server for h with the configured timeouts,
+// whose requests can be aborted by cancelRequests.
+func newServer(h http.Handler) *http.Server {
+	return &http.Server{
+		Handler:      h,
+		ReadTimeout:  gsh.ReadTimeout,
+		WriteTimeout: gsh.WriteTimeout,
+		IdleTimeout:  gsh.IdleTimeout,
+		BaseContext:  func(net.Listener) context.Context { return requestsContext },
+	}
+}
+
+// shutdownOnSignal blocks until SIGINT or SIGTERM, then stops the servers
+// from accepting connections and gives the requests in flight
+// ShutdownTimeout to finish. Requests still running after that have their
+// git processes killed.
+func shutdownOnSignal(servers ...*http.Server) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	gsh.Logger.Info("Shutting down", "signal", (<-sig).String())
+	signal.Stop(sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), gsh.ShutdownTimeout)
+	defer cancel()
+	if err := shutdown(ctx, servers); err == nil {
+		return
+	}
+
+	gsh.Logger.Info("Requests still in flight, killing their git processes", "timeout", gsh.ShutdownTimeout)
+	cancelRequests()
+
+	// Killed git processes are reaped within githttp.WaitDelay, after which their
+	// handlers return.
+	ctx, cancel = context.WithTimeout(context.Background(), githttp.WaitDelay+time.Second)
+	defer cancel()
+	if err := shutdown(ctx, servers); err != nil {
+		gsh.Logger.Error("Cannot stop the server cleanly", "err", err)
+	}
+}
+
+func shutdown(ctx context.Context, servers []*http.Server) error {
+	var err error
+	for _, srv := range servers {
+		if e := srv.Shutdown(ctx); e != nil {
+			err = e
+		}
+	}
+	return err
+}